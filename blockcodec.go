@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/maruel/rs"
+	"image"
+)
+
+// CodecBlock 为与 H.264 宏块对齐的块编码: 每个单元格为 4/8/16 像素的黑白方块，承载 1 比特
+const CodecBlock = "block"
+
+// 块编码的定位与纠错参数
+const (
+	blockFinderSize = 4 // 四角定位图案的边长(单元格)
+	blockMinRows    = 12
+	blockAspectW    = 16
+	blockAspectH    = 9
+	// blockRSLen 为每个 Reed-Solomon 码字的最大长度
+	blockRSLen = 255
+)
+
+// BlockECCLevels 为纠错等级 0-3 对应的每个码字的纠错字节数，约为码字长度的 7%、15%、25%、30%
+var BlockECCLevels = []int{18, 38, 64, 76}
+
+var (
+	ErrBlockFinder = errors.New("未找到块编码定位图案")
+	ErrBlockSync   = errors.New("块编码时钟图案校验失败")
+)
+
+// BlockLayout 描述块编码符号: Cols x Rows 个单元格
+// 四角为 4x4 的定位图案(外圈黑色、中心 2x2 白色)，第 0 行与第 0 列为黑白交替的时钟图案，其余单元格按行优先顺序存放数据
+// 数据按字节交织到多个 RS(n, n-ECC) 码字中，连续的损坏会分散到不同码字
+type BlockLayout struct {
+	Cols     int
+	Rows     int
+	ECC      int
+	FrameLen int
+}
+
+// BlockCellSize 由二维码大小参数确定块编码单元格的像素大小，只取 4、8、16 以与编码器的变换块对齐
+func BlockCellSize(qrcodeSize int) int {
+	size := -qrcodeSize
+	if size <= 4 && size > 0 {
+		return 4
+	}
+	if size > 8 {
+		return 16
+	}
+	return 8
+}
+
+// NewBlockLayout 返回能容纳 frameLen 字节的最小 16:9 符号，且像素大小不小于 minW x minH
+func NewBlockLayout(frameLen int, ecc int, cellSize int, minW int, minH int) BlockLayout {
+	l := BlockLayout{ECC: ecc, FrameLen: frameLen}
+	for rows := blockMinRows; ; rows += 2 {
+		cols := (rows*blockAspectW/blockAspectH + 1) / 2 * 2
+		l.Cols, l.Rows = cols, rows
+		if l.DataCells() >= l.CodeLen()*8 && cols*cellSize >= minW && rows*cellSize >= minH {
+			return l
+		}
+	}
+}
+
+// Blocks 返回 RS 码字的数量
+func (l BlockLayout) Blocks() int {
+	k := blockRSLen - l.ECC
+	return (l.FrameLen + k - 1) / k
+}
+
+// CodeLen 返回数据与纠错字节的总长度
+func (l BlockLayout) CodeLen() int {
+	return l.FrameLen + l.Blocks()*l.ECC
+}
+
+// reserved 判断单元格是否属于定位图案或时钟图案
+func (l BlockLayout) reserved(x int, y int) bool {
+	if x == 0 || y == 0 {
+		return true
+	}
+	inX := x < blockFinderSize || x >= l.Cols-blockFinderSize
+	inY := y < blockFinderSize || y >= l.Rows-blockFinderSize
+	return inX && inY
+}
+
+// DataCells 返回可以存放数据的单元格数量
+func (l BlockLayout) DataCells() int {
+	n := 0
+	for y := 0; y < l.Rows; y++ {
+		for x := 0; x < l.Cols; x++ {
+			if !l.reserved(x, y) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// patternCell 返回定位图案或时钟图案中的单元格是否为黑色
+func (l BlockLayout) patternCell(x int, y int) bool {
+	fx, fy := x, y
+	if x >= l.Cols-blockFinderSize {
+		fx = x - (l.Cols - blockFinderSize)
+	}
+	if y >= l.Rows-blockFinderSize {
+		fy = y - (l.Rows - blockFinderSize)
+	}
+	inX := x < blockFinderSize || x >= l.Cols-blockFinderSize
+	inY := y < blockFinderSize || y >= l.Rows-blockFinderSize
+	if inX && inY {
+		return fx == 0 || fy == 0 || fx == blockFinderSize-1 || fy == blockFinderSize-1
+	}
+	if y == 0 {
+		return x%2 == 0
+	}
+	return y%2 == 0
+}
+
+// interleave 为每个码字计算纠错字节，返回交织后的码流: 数据字节 i 属于第 i%blocks 个码字
+func (l BlockLayout) interleave(frame []byte) []byte {
+	blocks := l.Blocks()
+	code := make([]byte, l.CodeLen())
+	copy(code, frame)
+	encoder := rs.NewEncoder(rs.QRCodeField256, l.ECC)
+	ecc := make([]byte, l.ECC)
+	for b := 0; b < blocks; b++ {
+		encoder.Encode(l.blockData(code, b), ecc)
+		for j, v := range ecc {
+			code[l.FrameLen+j*blocks+b] = v
+		}
+	}
+	return code
+}
+
+// blockData 取出第 b 个码字的数据字节
+func (l BlockLayout) blockData(code []byte, b int) []byte {
+	blocks := l.Blocks()
+	data := make([]byte, 0, blockRSLen)
+	for i := b; i < l.FrameLen; i += blocks {
+		data = append(data, code[i])
+	}
+	return data
+}
+
+// BlockEncode 将帧数据绘制为块编码符号，帧数据不足 FrameLen 时以 0 填充
+func BlockEncode(frame []byte, l BlockLayout, cellSize int) (*image.Gray, error) {
+	if len(frame) > l.FrameLen {
+		return nil, fmt.Errorf("帧数据长度 %d 超出符号容量 %d", len(frame), l.FrameLen)
+	}
+	code := l.interleave(frame)
+	img := image.NewGray(image.Rect(0, 0, l.Cols*cellSize, l.Rows*cellSize))
+	bit := 0
+	for y := 0; y < l.Rows; y++ {
+		for x := 0; x < l.Cols; x++ {
+			var black bool
+			if l.reserved(x, y) {
+				black = l.patternCell(x, y)
+			} else {
+				if bit < len(code)*8 {
+					black = code[bit/8]&(0x80>>uint(bit%8)) != 0
+				}
+				bit++
+			}
+			v := uint8(0xff)
+			if black {
+				v = 0
+			}
+			for py := y * cellSize; py < (y+1)*cellSize; py++ {
+				row := img.Pix[py*img.Stride:]
+				for px := x * cellSize; px < (x+1)*cellSize; px++ {
+					row[px] = v
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+// blockDetector 保存视频帧的亮度与符号四角的位置，用双线性插值计算每个单元格的中心
+type blockDetector struct {
+	luma   []uint8
+	width  int
+	height int
+	corner [4][2]float64 // 左上、右上、左下、右下
+}
+
+func newBlockDetector(img image.Image) *blockDetector {
+	b := img.Bounds()
+	d := &blockDetector{luma: make([]uint8, b.Dx()*b.Dy()), width: b.Dx(), height: b.Dy()}
+	if gray, ok := img.(*image.Gray); ok {
+		for y := 0; y < d.height; y++ {
+			copy(d.luma[y*d.width:(y+1)*d.width], gray.Pix[gray.PixOffset(b.Min.X, b.Min.Y+y):])
+		}
+		return d
+	}
+	if rgba, ok := img.(*image.RGBA); ok {
+		for y := 0; y < d.height; y++ {
+			src := rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < d.width; x++ {
+				r, g, bl := int(src[x*4]), int(src[x*4+1]), int(src[x*4+2])
+				d.luma[y*d.width+x] = uint8((299*r + 587*g + 114*bl) / 1000)
+			}
+		}
+		return d
+	}
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			d.luma[y*d.width+x] = uint8((299*(r>>8) + 587*(g>>8) + 114*(bl>>8)) / 1000)
+		}
+	}
+	return d
+}
+
+// locate 寻找符号四角: 距离画面四角最近的暗像素即定位图案的外角
+func (d *blockDetector) locate() error {
+	best := [4]int{-1, -1, -1, -1}
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			if d.luma[y*d.width+x] >= 128 {
+				continue
+			}
+			scores := [4]int{x + y, d.width - x + y, x + d.height - y, d.width - x + d.height - y}
+			for c, score := range scores {
+				if best[c] < 0 || score < best[c] {
+					best[c] = score
+					d.corner[c] = [2]float64{float64(x), float64(y)}
+				}
+			}
+		}
+	}
+	if best[0] < 0 {
+		return ErrBlockFinder
+	}
+	// 右侧与下侧的角取像素的外边缘
+	d.corner[1][0]++
+	d.corner[2][1]++
+	d.corner[3][0]++
+	d.corner[3][1]++
+	return nil
+}
+
+// sample 返回单元格中心区域的平均亮度
+func (d *blockDetector) sample(l BlockLayout, x int, y int) float64 {
+	u := (float64(x) + 0.5) / float64(l.Cols)
+	v := (float64(y) + 0.5) / float64(l.Rows)
+	var p [2]float64
+	for i := range p {
+		p[i] = (1-u)*(1-v)*d.corner[0][i] + u*(1-v)*d.corner[1][i] + (1-u)*v*d.corner[2][i] + u*v*d.corner[3][i]
+	}
+	cw := (d.corner[1][0] - d.corner[0][0]) / float64(l.Cols)
+	ch := (d.corner[2][1] - d.corner[0][1]) / float64(l.Rows)
+	rx, ry := int(cw/4), int(ch/4)
+	cx, cy := int(p[0]), int(p[1])
+	var sum, count int
+	for py := cy - ry; py <= cy+ry; py++ {
+		if py < 0 || py >= d.height {
+			continue
+		}
+		for px := cx - rx; px <= cx+rx; px++ {
+			if px < 0 || px >= d.width {
+				continue
+			}
+			sum += int(d.luma[py*d.width+px])
+			count++
+		}
+	}
+	if count == 0 {
+		return 255
+	}
+	return float64(sum) / float64(count)
+}
+
+// BlockDecode 检测块编码符号并读取帧数据，返回帧数据与纠正的字节数
+func BlockDecode(img image.Image, l BlockLayout) ([]byte, int, error) {
+	d := newBlockDetector(img)
+	if err := d.locate(); err != nil {
+		return nil, 0, err
+	}
+	// 由定位图案与时钟图案计算黑白判决门限，并检查网格是否对齐
+	var blackSum, whiteSum float64
+	var blackCount, whiteCount int
+	for y := 0; y < l.Rows; y++ {
+		for x := 0; x < l.Cols; x++ {
+			if !l.reserved(x, y) {
+				continue
+			}
+			if l.patternCell(x, y) {
+				blackSum += d.sample(l, x, y)
+				blackCount++
+			} else {
+				whiteSum += d.sample(l, x, y)
+				whiteCount++
+			}
+		}
+	}
+	threshold := (blackSum/float64(blackCount) + whiteSum/float64(whiteCount)) / 2
+	mismatch := 0
+	for y := 0; y < l.Rows; y++ {
+		for x := 0; x < l.Cols; x++ {
+			if l.reserved(x, y) && (d.sample(l, x, y) < threshold) != l.patternCell(x, y) {
+				mismatch++
+			}
+		}
+	}
+	if mismatch*4 > blackCount+whiteCount {
+		return nil, 0, ErrBlockSync
+	}
+	code := make([]byte, l.CodeLen())
+	bit := 0
+	for y := 0; y < l.Rows && bit < len(code)*8; y++ {
+		for x := 0; x < l.Cols && bit < len(code)*8; x++ {
+			if l.reserved(x, y) {
+				continue
+			}
+			if d.sample(l, x, y) < threshold {
+				code[bit/8] |= 0x80 >> uint(bit%8)
+			}
+			bit++
+		}
+	}
+	// 逐个码字纠错后写回
+	blocks := l.Blocks()
+	decoder := rs.NewDecoder(rs.QRCodeField256)
+	corrected := 0
+	ecc := make([]byte, l.ECC)
+	for b := 0; b < blocks; b++ {
+		data := l.blockData(code, b)
+		for j := range ecc {
+			ecc[j] = code[l.FrameLen+j*blocks+b]
+		}
+		n, err := decoder.Decode(data, ecc)
+		if err != nil {
+			return nil, corrected, fmt.Errorf("第 %d 个码字无法纠错: %v", b, err)
+		}
+		corrected += n
+		for i, v := range data {
+			code[b+i*blocks] = v
+		}
+	}
+	frame := code[:l.FrameLen]
+	if len(frame) < FrameHeaderLen {
+		return nil, corrected, ErrNotFrame
+	}
+	total := FrameHeaderLen + int(binary.BigEndian.Uint16(frame[11:13])) + FrameCRCLen
+	if total > len(frame) {
+		return nil, corrected, fmt.Errorf("帧长度超出符号容量: %d", total)
+	}
+	return frame[:total], corrected, nil
+}
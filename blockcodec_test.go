@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestBlockCodecRoundTrip(t *testing.T) {
+	const cellSize = 8
+	payload := testData(600)
+	frame := MarshalFrame(FrameHeader{Kind: FrameKindData, FileID: [4]byte{2, 7, 1, 8}, Seq: 99}, payload)
+	l := NewBlockLayout(len(frame), BlockECCLevels[1], cellSize, 0, 0)
+	// invertCells 反转矩形区域内数据单元格的颜色
+	invertCells := func(x0, y0, x1, y1 int) func(img *image.Gray) *image.Gray {
+		return func(img *image.Gray) *image.Gray {
+			dst := image.NewGray(img.Bounds())
+			copy(dst.Pix, img.Pix)
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					if l.reserved(x, y) {
+						continue
+					}
+					for py := y * cellSize; py < (y+1)*cellSize; py++ {
+						for px := x * cellSize; px < (x+1)*cellSize; px++ {
+							dst.Pix[py*dst.Stride+px] ^= 0xff
+						}
+					}
+				}
+			}
+			return dst
+		}
+	}
+	tests := []struct {
+		name      string
+		frame     []byte
+		transform func(img *image.Gray) *image.Gray
+		corrected bool
+		err       bool
+	}{
+		{"identity", frame, nil, false, false},
+		{"short frame", MarshalFrame(FrameHeader{Kind: FrameKindData, Seq: 1}, []byte("tail")), nil, false, false},
+		{"on canvas", frame, func(img *image.Gray) *image.Gray {
+			canvas := image.NewGray(image.Rect(0, 0, img.Bounds().Dx()+100, img.Bounds().Dy()+60))
+			draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+			draw.Draw(canvas, img.Bounds().Add(image.Pt(37, 21)), img, image.Point{}, draw.Src)
+			return canvas
+		}, false, false},
+		{"scaled", frame, func(img *image.Gray) *image.Gray {
+			return scaleImage(img, img.Bounds().Dx()*3/2, img.Bounds().Dy()*3/2)
+		}, false, false},
+		{"noise", frame, func(img *image.Gray) *image.Gray { return addNoise(img, 60) }, false, false},
+		{"damaged cells", frame, invertCells(10, 5, 26, 7), true, false},
+		{"destroyed", frame, invertCells(0, 0, l.Cols, l.Rows/2), false, true},
+		{"blank", frame, func(img *image.Gray) *image.Gray {
+			blank := image.NewGray(img.Bounds())
+			draw.Draw(blank, blank.Bounds(), image.White, image.Point{}, draw.Src)
+			return blank
+		}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := BlockEncode(tt.frame, l, cellSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.transform != nil {
+				img = tt.transform(img)
+			}
+			got, corrected, err := BlockDecode(img, l)
+			if tt.err {
+				if err == nil {
+					t.Fatal("损坏的符号没有返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.frame) {
+				t.Fatal("解码的帧数据不一致")
+			}
+			if tt.corrected != (corrected > 0) {
+				t.Errorf("纠正了 %d 个字节", corrected)
+			}
+		})
+	}
+	if _, err := BlockEncode(make([]byte, l.FrameLen+1), l, cellSize); err == nil {
+		t.Error("超出符号容量的帧没有返回错误")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	qrencode "github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// CanvasQuietZone 为固定分辨率画布中二维码四周默认的留白模块数，与 QR 码规范一致
+const CanvasQuietZone = 4
+
+// ParseResolution 解析 "宽x高" 形式的分辨率，空字符串表示不使用固定分辨率
+func ParseResolution(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("无效的分辨率: %s", s)
+	}
+	width, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("无效的分辨率: %s", s)
+	}
+	height, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("无效的分辨率: %s", s)
+	}
+	if width < 16 || height < 16 || width%2 != 0 || height%2 != 0 {
+		return 0, 0, fmt.Errorf("分辨率的宽高需要为不小于 16 的偶数: %s", s)
+	}
+	return width, height, nil
+}
+
+// CanvasLayout 描述固定分辨率画布，写入 IndexData 以便解码时直接裁剪出每个符号
+// 画布按网格均分为格子，每个符号居中放入格子，格子中其余部分留白
+// Version 不为 0 时所有二维码(包括索引二维码)使用同一版本与模块大小，SymbolWidth/SymbolHeight 为符号不含留白的像素大小，Margin 为裁剪时保留的留白像素
+// SymbolWidth 为 0 表示符号大小不固定，解码时裁剪整个格子
+type CanvasLayout struct {
+	Width        int `json:"width"`
+	Height       int `json:"height"`
+	Cols         int `json:"cols"`
+	Rows         int `json:"rows"`
+	QuietZone    int `json:"quiet_zone"`
+	Version      int `json:"version,omitempty"`
+	Module       int `json:"module,omitempty"`
+	SymbolWidth  int `json:"symbol_width,omitempty"`
+	SymbolHeight int `json:"symbol_height,omitempty"`
+	Margin       int `json:"margin,omitempty"`
+}
+
+// cell 返回第 t 个格子在画布中的位置，与 GridCells 的切分方式一致
+func (c *CanvasLayout) cell(t int) image.Rectangle {
+	x, y := t%c.Cols, t/c.Cols
+	return image.Rect(c.Width*x/c.Cols, c.Height*y/c.Rows, c.Width*(x+1)/c.Cols, c.Height*(y+1)/c.Rows)
+}
+
+// minCell 返回最小的格子大小
+func (c *CanvasLayout) minCell() (int, int) {
+	return c.Width / c.Cols, c.Height / c.Rows
+}
+
+// SetVersion 固定二维码版本，选取能放入格子的最大整数模块大小
+func (c *CanvasLayout) SetVersion(version int) error {
+	modules := 17 + 4*version
+	cw, ch := c.minCell()
+	side := cw
+	if ch < side {
+		side = ch
+	}
+	module := side / (modules + 2*c.QuietZone)
+	if module < 1 {
+		return fmt.Errorf("画布分辨率 %dx%d 过小，无法放入 %d 版本的二维码", c.Width, c.Height, version)
+	}
+	c.Version = version
+	c.Module = module
+	c.SymbolWidth = modules * module
+	c.SymbolHeight = modules * module
+	c.Margin = c.QuietZone * module
+	return nil
+}
+
+// WorstCaseQRVersion 返回能放下任意 slice 字节数据帧(含帧头与校验)的最小二维码版本
+// 按字节模式计算(Base45 只含字母数字模式的字符，按字母数字模式计算)，与帧的内容无关，因此后面的数据帧不会超出该版本
+func WorstCaseQRVersion(slice int, payload string, level int) (int, error) {
+	n := EncodedPayloadLen(slice+FrameHeaderLen+FrameCRCLen, payload)
+	worst := "a"
+	if payload == PayloadBase45 {
+		worst = "A"
+	}
+	q, err := qrencode.New(strings.Repeat(worst, n), qrencode.RecoveryLevel(level))
+	if err != nil {
+		return 0, err
+	}
+	return q.VersionNumber, nil
+}
+
+// SetSymbol 记录大小固定的符号(灰度符号、块编码符号)，解码时裁剪出符号本身
+func (c *CanvasLayout) SetSymbol(b image.Rectangle) {
+	c.SymbolWidth = b.Dx()
+	c.SymbolHeight = b.Dy()
+}
+
+// Fits 检查符号能否放入格子
+func (c *CanvasLayout) Fits(b image.Rectangle) error {
+	cw, ch := c.minCell()
+	if b.Dx() > cw || b.Dy() > ch {
+		return fmt.Errorf("符号大小 %dx%d 超出画布格子大小 %dx%d，请增大分辨率或减小 -s", b.Dx(), b.Dy(), cw, ch)
+	}
+	return nil
+}
+
+// QRImage 按固定版本与模块大小生成二维码，四周留白 QuietZone 个模块
+func (c *CanvasLayout) QRImage(content string, level int) (image.Image, error) {
+	q, err := qrencode.NewWithForcedVersion(content, c.Version, qrencode.RecoveryLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = true
+	bitmap := q.Bitmap()
+	return renderModules(len(bitmap[0]), len(bitmap), func(x, y int) bool {
+		return bitmap[y][x]
+	}, c.Module, c.QuietZone), nil
+}
+
+func (c *CanvasLayout) blank() *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	return canvas
+}
+
+// Compose 按行优先顺序将符号居中放入各个格子，不足的格子留白
+func (c *CanvasLayout) Compose(tiles []image.Image) image.Image {
+	canvas := c.blank()
+	for t, tile := range tiles {
+		place(canvas, c.cell(t), tile)
+	}
+	return canvas
+}
+
+// Center 将单个符号(索引二维码)居中放入整个画布
+func (c *CanvasLayout) Center(img image.Image) image.Image {
+	canvas := c.blank()
+	place(canvas, canvas.Bounds(), img)
+	return canvas
+}
+
+// Cells 按记录的布局从视频帧中裁剪出每个格子中的符号，视频被缩放时按比例换算坐标
+func (c *CanvasLayout) Cells(img image.Image) []image.Image {
+	b := img.Bounds()
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	cells := make([]image.Image, 0, c.Cols*c.Rows)
+	for t := 0; t < c.Cols*c.Rows; t++ {
+		r := c.cell(t)
+		if c.SymbolWidth > 0 {
+			// 与 place 相同的偶数偏移
+			w, h := c.SymbolWidth+2*c.Margin, c.SymbolHeight+2*c.Margin
+			min := image.Pt(r.Min.X+(r.Dx()-w)/4*2, r.Min.Y+(r.Dy()-h)/4*2)
+			r = image.Rectangle{Min: min, Max: min.Add(image.Pt(w, h))}
+		}
+		r = image.Rect(
+			b.Min.X+r.Min.X*b.Dx()/c.Width, b.Min.Y+r.Min.Y*b.Dy()/c.Height,
+			b.Min.X+r.Max.X*b.Dx()/c.Width, b.Min.Y+r.Max.Y*b.Dy()/c.Height,
+		).Intersect(b)
+		if ok {
+			cells = append(cells, sub.SubImage(r))
+			continue
+		}
+		cell := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(cell, cell.Bounds(), img, r.Min, draw.Src)
+		cells = append(cells, cell)
+	}
+	return cells
+}
+
+// DecodeCanvasFrame 按固定分辨率画布的布局裁剪并识别视频帧中的所有符号
+// 返回识别结果、需要交给后备识别的符号与无法识别的格子数
+func DecodeCanvasFrame(img image.Image, i int, s IndexReadData, resizeTimes float64, validate FrameValidator, chain *DecoderChain) ([][]byte, []image.Image, int) {
+	symbols := make([][]byte, 0, s.Canvas.Cols*s.Canvas.Rows)
+	var failed []image.Image
+	unreadable := 0
+	for t, cell := range s.Canvas.Cells(img) {
+		if IsBlankCell(cell) {
+			continue
+		}
+		data, err := DecodeSymbol(cell, i, s, resizeTimes, validate, chain)
+		if err != nil {
+			if s.HasFallback() && chain.HasRest() {
+				failed = append(failed, ResizeImage(cell, resizeTimes))
+				continue
+			}
+			fmt.Fprintln(chain.Log(), de, "第", i, "帧第", t, "个符号无法识别:", err)
+			unreadable++
+			continue
+		}
+		symbols = append(symbols, data)
+	}
+	return symbols, failed, unreadable
+}
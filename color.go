@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// ColorChannels 为彩色模式下每个视频帧的通道数，R、G、B 通道各放置一组独立的二维码
+const ColorChannels = 3
+
+// ColorPixelFormat 为彩色模式默认使用的像素格式，不对色度进行子采样
+const ColorPixelFormat = "yuv444p"
+
+// CheckColorPixelFormat 检查像素格式能否承载彩色模式，返回实际使用的像素格式
+// 灰度格式无法承载彩色模式；色度子采样的格式会损失色度分辨率，模块过小时无法识别，只给出警告
+func CheckColorPixelFormat(pixFmt string, qrcodeSize int) (string, error) {
+	if pixFmt == "" {
+		return ColorPixelFormat, nil
+	}
+	f := strings.ToLower(pixFmt)
+	if strings.HasPrefix(f, "gray") || strings.HasPrefix(f, "mono") || f == "pal8" {
+		return "", fmt.Errorf("像素格式 %s 不包含色度信息，无法使用彩色模式", pixFmt)
+	}
+	if strings.Contains(f, "420") || strings.Contains(f, "422") || strings.Contains(f, "411") || strings.Contains(f, "410") ||
+		strings.HasPrefix(f, "nv") || strings.HasPrefix(f, "yuyv") || strings.HasPrefix(f, "uyvy") {
+		fmt.Println(en, "警告: 像素格式", pixFmt, "会对色度进行子采样，R/G/B 通道之间可能互相干扰，建议使用", ColorPixelFormat)
+		if qrcodeSize < 0 && qrcodeSize > -4 {
+			fmt.Println(en, "警告: 二维码模块小于 4 像素，色度子采样后很可能无法识别，建议使用 -s -4 或更大的模块")
+		}
+	}
+	return pixFmt, nil
+}
+
+// MergeChannels 将最多三个黑白二维码画面分别放入 R、G、B 通道，缺少的通道填充白色
+func MergeChannels(planes []image.Image) (image.Image, error) {
+	if len(planes) == 0 || len(planes) > ColorChannels {
+		return nil, errors.New("通道数量无效")
+	}
+	b := planes[0].Bounds()
+	for _, plane := range planes {
+		if plane.Bounds().Size() != b.Size() {
+			return nil, errors.New("各通道画面大小不一致")
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	values := [ColorChannels]uint8{}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			for c := range values {
+				values[c] = 0xff
+				if c < len(planes) {
+					pb := planes[c].Bounds()
+					values[c] = color.GrayModel.Convert(planes[c].At(pb.Min.X+x, pb.Min.Y+y)).(color.Gray).Y
+				}
+			}
+			img.SetRGBA(x, y, color.RGBA{R: values[0], G: values[1], B: values[2], A: 0xff})
+		}
+	}
+	return img, nil
+}
+
+// ChannelImage 取出彩色视频帧中的单个通道作为灰度图像
+func ChannelImage(img image.Image, channel int) *image.Gray {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if rgba, ok := img.(*image.RGBA); ok {
+		for y := 0; y < b.Dy(); y++ {
+			src := rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y+y):]
+			dst := gray.Pix[y*gray.Stride:]
+			for x := 0; x < b.Dx(); x++ {
+				dst[x] = src[x*4+channel]
+			}
+		}
+		return gray
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			v := [ColorChannels]uint32{r, g, bl}[channel]
+			gray.Pix[y*gray.Stride+x] = uint8(v >> 8)
+		}
+	}
+	return gray
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 压缩算法，写入 IndexData 以便解码时还原
+const (
+	CompressNone = "none"
+	CompressZstd = "zstd"
+	CompressGzip = "gzip"
+	CompressXz   = "xz"
+	CompressAuto = "auto"
+	// compressSampleLen 为 auto 模式下试压缩的采样长度
+	compressSampleLen = 256 * 1024
+	// compressMinRatio 为 auto 模式下采样压缩率高于此值时不再压缩
+	compressMinRatio = 0.95
+)
+
+// compressedMagics 为常见已压缩格式的文件头
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 0x03, 0x04},             // zip, docx, apk, jar
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{'R', 'a', 'r', '!', 0x1a, 0x07},   // rar
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'G', 'I', 'F', '8'},               // gif
+	{'I', 'D', '3'},                    // mp3
+	{'O', 'g', 'g', 'S'},               // ogg
+	{'f', 'L', 'a', 'C'},               // flac
+	{0x1a, 0x45, 0xdf, 0xa3},           // mkv, webm
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+}
+
+// compressedExts 为常见已压缩格式的扩展名
+var compressedExts = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".txz": true, ".bz2": true, ".lz4": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true, ".m4a": true,
+	".mp4": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true,
+}
+
+// ParseCompression 检查压缩算法名称，空字符串视为不压缩
+func ParseCompression(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", CompressNone:
+		return CompressNone, nil
+	case CompressZstd, "zst":
+		return CompressZstd, nil
+	case CompressGzip, "gz":
+		return CompressGzip, nil
+	case CompressXz:
+		return CompressXz, nil
+	case CompressAuto:
+		return CompressAuto, nil
+	}
+	return "", fmt.Errorf("不支持的压缩算法: %s", name)
+}
+
+// IsCompressed 根据文件头、扩展名与采样压缩率判断数据是否已经被压缩
+func IsCompressed(filePath string, data []byte) bool {
+	if compressedExts[strings.ToLower(filepath.Ext(filePath))] {
+		return true
+	}
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	// mp4/mov 的文件头位于第 4 字节
+	if len(data) >= 8 && string(data[4:8]) == "ftyp" {
+		return true
+	}
+	sample := data
+	if len(sample) > compressSampleLen {
+		sample = sample[:compressSampleLen]
+	}
+	if len(sample) == 0 {
+		return false
+	}
+	compressed, err := CompressData(sample, CompressZstd)
+	if err != nil {
+		return false
+	}
+	return float64(len(compressed)) > float64(len(sample))*compressMinRatio
+}
+
+// ChooseCompression 解析 auto 模式: 已压缩的数据不再压缩，否则使用 zstd，sample 为文件开头的采样
+func ChooseCompression(name string, filePath string, sample []byte) string {
+	if name != CompressAuto {
+		return name
+	}
+	if IsCompressed(filePath, sample) {
+		return CompressNone
+	}
+	return CompressZstd
+}
+
+// CompressData 使用指定算法压缩数据
+func CompressData(data []byte, name string) ([]byte, error) {
+	if name == CompressNone {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w, err := NewCompressWriter(&buf, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// NewCompressWriter 返回压缩后写入 w 的写入器，Close 时写出剩余数据但不关闭 w
+func NewCompressWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	switch name {
+	case "", CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CompressXz:
+		return xz.NewWriter(w)
+	}
+	return nil, fmt.Errorf("不支持的压缩算法: %s", name)
+}
+
+// NewDecompressReader 返回解压 r 的读取器
+func NewDecompressReader(r io.Reader, name string) (io.ReadCloser, error) {
+	switch name {
+	case "", CompressNone:
+		return io.NopCloser(r), nil
+	case CompressZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressXz:
+		d, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(d), nil
+	}
+	return nil, fmt.Errorf("不支持的压缩算法: %s", name)
+}
+
+// RestoreResult 为还原数据的结果
+type RestoreResult struct {
+	// StreamHash 为解码得到的数据流的 SHA-256
+	StreamHash string
+	// Sealed 为加密在数据流中的元数据，未加密或旧版本的加密文件为 nil
+	Sealed *SealedMeta
+}
+
+// ExpectedHash 返回输出文件应有的 Hash，indexHash 为索引中的 Hash
+// 加密文件的索引中为数据流的 Hash，与解码得到的数据流一致后再使用数据流末尾的原始数据 Hash
+func (r *RestoreResult) ExpectedHash(indexHash string) (string, error) {
+	if r == nil || r.Sealed == nil {
+		return indexHash, nil
+	}
+	if r.StreamHash != indexHash {
+		return "", fmt.Errorf("数据流 Hash %s 与索引不一致", r.StreamHash)
+	}
+	return r.Sealed.Hash, nil
+}
+
+// RestoreFile 将解码得到的数据流文件依次解密、解压后写入 dstPath，失败时删除不完整的输出文件
+func RestoreFile(c *CryptParams, key []byte, compression string, rawSize int64, srcPath string, dstPath string) (*RestoreResult, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return RestoreStream(c, key, compression, rawSize, src, dstPath)
+}
+
+// RestoreStream 将解码得到的数据流依次解密、解压后写入 dstPath，失败时删除不完整的输出文件
+// c 为 nil 表示未加密，compression 为空或 none 表示未压缩，rawSize 为索引中压缩前的长度，不为 0 时检查解压后的长度
+func RestoreStream(c *CryptParams, key []byte, compression string, rawSize int64, src io.Reader, dstPath string) (*RestoreResult, error) {
+	streamHash := sha256.New()
+	var reader io.Reader = io.TeeReader(src, streamHash)
+	var sealed *SealedReader
+	var err error
+	if c != nil {
+		// 解密与解压同时进行，不生成中间文件
+		encrypted := reader
+		pr, pw := io.Pipe()
+		go func() {
+			writer := bufio.NewWriter(pw)
+			err := c.DecryptStream(key, writer, encrypted)
+			if err == nil {
+				err = writer.Flush()
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		reader = pr
+		if c.Sealed {
+			sealed, err = NewSealedReader(pr)
+			if err != nil {
+				return nil, err
+			}
+			reader = sealed
+		}
+	}
+	decompressor, err := NewDecompressReader(reader, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(dst)
+	n, err := io.Copy(writer, decompressor)
+	if err == nil {
+		// 解压结束后读完剩余数据，确保所有加密块都通过认证
+		_, err = io.Copy(io.Discard, reader)
+	}
+	if err == nil && compression != "" && compression != CompressNone && rawSize > 0 && n != rawSize {
+		err = fmt.Errorf("解压后的数据长度 %d 与索引中的原始长度 %d 不一致", n, rawSize)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	dst.Close()
+	if err != nil {
+		_ = os.Remove(dstPath)
+		return nil, err
+	}
+	result := &RestoreResult{StreamHash: hex.EncodeToString(streamHash.Sum(nil))}
+	if sealed != nil {
+		meta := sealed.Meta()
+		result.Sealed = &meta
+	}
+	return result, nil
+}
+
+// RenameSealedOutput 将默认路径的输出文件按加密文件中的文件名重命名为 output_<name>，返回新的路径，失败时返回原路径
+func RenameSealedOutput(path string, name string) (string, error) {
+	if name == "" {
+		return path, nil
+	}
+	dst := filepath.Join(filepath.Dir(path), "output_"+filepath.Base(name))
+	if err := os.Rename(path, dst); err != nil {
+		return path, err
+	}
+	return dst, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreStream(t *testing.T) {
+	data := append(bytes.Repeat([]byte("Lumina "), 3000), testData(5000)...)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	meta := SealedMeta{Name: "doc.pdf", Summary: "测试"}
+	key := testData(32)
+	tests := []struct {
+		name        string
+		compression string
+		encrypt     bool
+		damage      func(stream []byte) []byte
+		rawSize     int64
+		key         []byte
+		err         bool
+	}{
+		{"plain", CompressNone, false, nil, 0, nil, false},
+		{"zstd", CompressZstd, false, nil, 0, nil, false},
+		{"gzip", CompressGzip, false, nil, 0, nil, false},
+		{"xz", CompressXz, false, nil, 0, nil, false},
+		{"sealed", CompressNone, true, nil, 0, nil, false},
+		{"sealed zstd", CompressZstd, true, nil, 0, nil, false},
+		{"sealed gzip", CompressGzip, true, nil, 0, nil, false},
+		{"raw size mismatch", CompressZstd, false, nil, int64(len(data)) + 1, nil, true},
+		{"sealed raw size mismatch", CompressGzip, true, nil, int64(len(data)) - 1, nil, true},
+		{"corrupted gzip", CompressGzip, false, func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b }, 0, nil, true},
+		{"tampered ciphertext", CompressNone, true, func(b []byte) []byte { b[len(b)/2] ^= 1; return b }, 0, nil, true},
+		{"tampered sealed header", CompressNone, true, func(b []byte) []byte { b[10] ^= 1; return b }, 0, nil, true},
+		{"truncated ciphertext", CompressNone, true, func(b []byte) []byte { return b[:len(b)-100] }, 0, nil, true},
+		{"wrong key", CompressNone, true, nil, 0, testData(33)[1:], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c *CryptParams
+			if tt.encrypt {
+				var err error
+				if c, err = NewCryptParams(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := NewEncodeStream(bytes.NewReader(data), tt.compression, c, key, meta)
+			defer s.Close()
+			stream, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plainHash, n := s.Sum(); plainHash != hash || n != int64(len(data)) {
+				t.Fatalf("原始数据 Hash %s 长度 %d", plainHash, n)
+			}
+			rawSize := int64(len(data))
+			if tt.rawSize != 0 {
+				rawSize = tt.rawSize
+			}
+			if tt.damage != nil {
+				stream = tt.damage(stream)
+			}
+			restoreKey := key
+			if tt.key != nil {
+				restoreKey = tt.key
+			}
+			dst := filepath.Join(t.TempDir(), "out")
+			result, err := RestoreStream(c, restoreKey, tt.compression, rawSize, bytes.NewReader(stream), dst)
+			if tt.err {
+				if err == nil {
+					t.Fatal("损坏的数据流没有返回错误")
+				}
+				if FileExists(dst) {
+					t.Error("没有删除不完整的输出文件")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatal("还原的数据不一致")
+			}
+			if result.StreamHash != s.StreamSum() {
+				t.Errorf("数据流 Hash %s, 期望 %s", result.StreamHash, s.StreamSum())
+			}
+			// 加密文件的索引中为数据流的 Hash，否则为原始数据的 Hash
+			indexHash := hash
+			if tt.encrypt {
+				indexHash = s.StreamSum()
+			}
+			expected, err := result.ExpectedHash(indexHash)
+			if err != nil || expected != hash {
+				t.Errorf("输出文件应有的 Hash %s %v", expected, err)
+			}
+			if !tt.encrypt {
+				if result.Sealed != nil {
+					t.Error("未加密的数据流含有加密元数据")
+				}
+				return
+			}
+			if result.Sealed == nil || result.Sealed.Name != meta.Name || result.Sealed.Summary != meta.Summary {
+				t.Fatalf("加密元数据 %+v", result.Sealed)
+			}
+			if _, err := result.ExpectedHash(hash); err == nil {
+				t.Error("索引 Hash 与数据流不一致时没有返回错误")
+			}
+		})
+	}
+}
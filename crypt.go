@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"io"
+	"os"
+)
+
+// 加密参数，写入 IndexData 以便解码时还原
+const (
+	CipherXChaCha20Poly1305 = "xchacha20poly1305"
+	KDFScrypt               = "scrypt"
+	CryptChunkSize          = 64 * 1024
+	cryptNoncePrefixLen     = chacha20poly1305.NonceSizeX - 9
+	cryptSaltLen            = 16
+	cryptKeyCheckLen        = 8
+	// sealedHeaderMaxLen 为加密数据流开头元数据的最大长度
+	sealedHeaderMaxLen = 64 * 1024
+	// PasswordEnv 为解码时读取密码的环境变量
+	PasswordEnv = "LUMINA_PASSWORD"
+)
+
+var (
+	ErrWrongPassword = errors.New("密码错误")
+	ErrTampered      = errors.New("数据认证失败，数据可能被篡改或损坏")
+)
+
+// CryptParams 描述加密所使用的算法与参数
+// KDF 为 scrypt 时文件密钥由密码派生，为 x25519 时文件密钥为随机值并分别包装给每个接收者
+type CryptParams struct {
+	Cipher      string            `json:"cipher"`
+	KDF         string            `json:"kdf"`
+	N           int               `json:"n,omitempty"`
+	R           int               `json:"r,omitempty"`
+	P           int               `json:"p,omitempty"`
+	Salt        string            `json:"salt,omitempty"`
+	NoncePrefix string            `json:"nonce"`
+	Chunk       int               `json:"chunk"`
+	KeyCheck    string            `json:"check,omitempty"`
+	Recipients  []RecipientStanza `json:"recipients,omitempty"`
+	// Sealed 为 true 时文件名、摘要与原始数据的 Hash 加密在数据流中，索引中的 Hash 为密文的 Hash
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+// NewCryptParams 生成新的随机盐与随机数前缀，并使用默认的 scrypt 参数
+func NewCryptParams() (*CryptParams, error) {
+	salt := make([]byte, cryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, cryptNoncePrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return &CryptParams{
+		Cipher:      CipherXChaCha20Poly1305,
+		KDF:         KDFScrypt,
+		N:           1 << 15,
+		R:           8,
+		P:           1,
+		Salt:        hex.EncodeToString(salt),
+		NoncePrefix: hex.EncodeToString(prefix),
+		Chunk:       CryptChunkSize,
+		Sealed:      true,
+	}, nil
+}
+
+// DeriveKey 由密码派生加密密钥，同时返回用于快速识别错误密码的校验值
+func (c *CryptParams) DeriveKey(password string) ([]byte, []byte, error) {
+	if c.KDF != KDFScrypt {
+		return nil, nil, fmt.Errorf("不支持的密钥派生函数: %s", c.KDF)
+	}
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	derived, err := scrypt.Key([]byte(password), salt, c.N, c.R, c.P, chacha20poly1305.KeySize+cryptKeyCheckLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return derived[:chacha20poly1305.KeySize], derived[chacha20poly1305.KeySize:], nil
+}
+
+// SetPassword 派生密钥并记录密码校验值，返回加密密钥
+func (c *CryptParams) SetPassword(password string) ([]byte, error) {
+	key, check, err := c.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	c.KeyCheck = hex.EncodeToString(check)
+	return key, nil
+}
+
+// Unlock 派生密钥并检查密码是否正确
+func (c *CryptParams) Unlock(password string) ([]byte, error) {
+	key, check, err := c.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := hex.DecodeString(c.KeyCheck)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(check, expected) != 1 {
+		return nil, ErrWrongPassword
+	}
+	return key, nil
+}
+
+func (c *CryptParams) aead(key []byte) (cipher.AEAD, []byte, error) {
+	if c.Cipher != CipherXChaCha20Poly1305 {
+		return nil, nil, fmt.Errorf("不支持的加密算法: %s", c.Cipher)
+	}
+	prefix, err := hex.DecodeString(c.NoncePrefix)
+	if err != nil || len(prefix) != cryptNoncePrefixLen {
+		return nil, nil, errors.New("无效的随机数前缀")
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, prefix, nil
+}
+
+// chunkNonce 由随机数前缀、块序号与是否为最后一块组成，防止块被重排或截断
+func chunkNonce(prefix []byte, index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[cryptNoncePrefixLen:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// EncryptedSize 返回明文长度为 size 时的密文长度
+func (c *CryptParams) EncryptedSize(size int64) int64 {
+	chunks := size / int64(c.Chunk)
+	if size%int64(c.Chunk) != 0 || size == 0 {
+		chunks++
+	}
+	return size + chunks*chacha20poly1305.Overhead
+}
+
+// EncryptStream 按块加密 src 并写入 dst
+func (c *CryptParams) EncryptStream(key []byte, dst io.Writer, src io.Reader) error {
+	aead, prefix, err := c.aead(key)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(src, c.Chunk)
+	buf := make([]byte, c.Chunk)
+	out := make([]byte, 0, c.Chunk+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			// 恰好读满一块时需要预读判断是否已到末尾
+			if _, perr := reader.Peek(1); perr == io.EOF {
+				last = true
+			}
+		}
+		out = aead.Seal(out[:0], chunkNonce(prefix, index, last), buf[:n], nil)
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecryptStream 按块解密 src 并写入 dst，任意一块认证失败或密文被截断都会返回 ErrTampered
+func (c *CryptParams) DecryptStream(key []byte, dst io.Writer, src io.Reader) error {
+	aead, prefix, err := c.aead(key)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(src, c.Chunk+aead.Overhead())
+	buf := make([]byte, c.Chunk+aead.Overhead())
+	out := make([]byte, 0, c.Chunk)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, perr := reader.Peek(1); perr == io.EOF {
+				last = true
+			}
+		}
+		out, err = aead.Open(out[:0], chunkNonce(prefix, index, last), buf[:n], nil)
+		if err != nil {
+			return ErrTampered
+		}
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// SealedMeta 为加密文件不写入索引的元数据
+// 加密前的数据流为: 大端序的 uint32 长度与文件名、摘要的 JSON，压缩后的数据，原始数据的 SHA-256
+type SealedMeta struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary,omitempty"`
+	// Hash 为原始数据的 SHA-256，位于数据流末尾，读完数据流后才能得到
+	Hash string `json:"-"`
+}
+
+// SealedHeader 返回加密前数据流开头的元数据
+func SealedHeader(meta SealedMeta) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > sealedHeaderMaxLen {
+		return nil, errors.New("文件名或摘要过长")
+	}
+	header := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	return append(header, data...), nil
+}
+
+// SealedReader 从解密后的数据流中分离出元数据，读取到的只有压缩后的数据
+// 末尾的 Hash 始终保留在缓冲区中不返回，读到末尾后由 Meta 返回
+type SealedReader struct {
+	r    io.Reader
+	meta SealedMeta
+	buf  []byte
+	eof  bool
+}
+
+// NewSealedReader 读取数据流开头的元数据
+func NewSealedReader(r io.Reader) (*SealedReader, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, fmt.Errorf("无法读取加密文件的元数据: %v", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > sealedHeaderMaxLen {
+		return nil, fmt.Errorf("加密文件的元数据长度过大: %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("无法读取加密文件的元数据: %v", err)
+	}
+	s := &SealedReader{r: r, buf: make([]byte, 0, 32*1024)}
+	if err := json.Unmarshal(data, &s.meta); err != nil {
+		return nil, fmt.Errorf("无法解析加密文件的元数据: %v", err)
+	}
+	return s, nil
+}
+
+func (s *SealedReader) Read(p []byte) (int, error) {
+	for len(s.buf) <= sha256.Size {
+		if s.eof {
+			if len(s.buf) < sha256.Size {
+				return 0, io.ErrUnexpectedEOF
+			}
+			s.meta.Hash = hex.EncodeToString(s.buf)
+			return 0, io.EOF
+		}
+		n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+n]
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf[:len(s.buf)-sha256.Size])
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	return n, nil
+}
+
+// Meta 返回元数据，读到数据流末尾后才包含原始数据的 Hash
+func (s *SealedReader) Meta() SealedMeta {
+	return s.meta
+}
+
+// ReadPassword 从终端读取密码(不回显)，提示输出到 log，标准输入不是终端时返回错误，不读取标准输入
+func ReadPassword(log io.Writer, prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("标准输入不是终端，无法输入密码，请通过 -e 参数或 " + PasswordEnv + " 环境变量指定密码")
+	}
+	fmt.Fprint(log, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(log)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// UnlockCrypt 解开文件密钥
+// 接收者加密时读取身份文件(命令行参数或环境变量 LUMINA_IDENTITY)，
+// 密码加密时依次尝试命令行传入的密码、环境变量 LUMINA_PASSWORD 与交互输入的密码，标准输入不是终端时不询问密码，提示输出到 log
+func UnlockCrypt(c *CryptParams, password string, identityPath string, log io.Writer) ([]byte, error) {
+	if c.KDF == KDFX25519 {
+		if identityPath == "" {
+			identityPath = os.Getenv(IdentityEnv)
+		}
+		if identityPath == "" {
+			return nil, errors.New("文件使用公钥加密，请通过 -I 参数或 " + IdentityEnv + " 环境变量指定身份文件")
+		}
+		identities, err := LoadIdentities(identityPath)
+		if err != nil {
+			return nil, err
+		}
+		return c.UnlockIdentities(identities)
+	}
+	if password == "" {
+		password = os.Getenv(PasswordEnv)
+	}
+	if password != "" {
+		return c.Unlock(password)
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		input, err := ReadPassword(log, de+" 请输入解密密码: ")
+		if err != nil {
+			return nil, err
+		}
+		key, err := c.Unlock(input)
+		if err != ErrWrongPassword {
+			return key, err
+		}
+		fmt.Fprintln(log, de, "密码错误，请重新输入")
+	}
+	return nil, ErrWrongPassword
+}
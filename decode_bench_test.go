@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// 解码循环中每一帧从 FFmpeg 输出到交给识别器之前的开销，使用 go test -bench . 运行
+const (
+	benchWidth  = 1920
+	benchHeight = 1080
+)
+
+// benchFrame 返回居中放入 1920x1080 画布的数据二维码
+func benchFrame(b *testing.B) image.Image {
+	frame := make([]byte, 350)
+	_, _ = rand.Read(frame)
+	symbol, err := SymbolEncode(frame, SymbolQR, PayloadBase64, 0, -8)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return CenterCanvas(symbol, benchWidth, benchHeight)
+}
+
+// legacyRawDataToImage 为旧版本解码循环中逐像素 Set 的 rgb24 转换方式，只作为性能对比的基准
+func legacyRawDataToImage(rawData []byte, width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := ((y * width) + x) * 3
+			img.Set(x, y, color.RGBA{R: rawData[offset], G: rawData[offset+1], B: rawData[offset+2], A: 255})
+		}
+	}
+	return img
+}
+
+func BenchmarkRawDataToImage(b *testing.B) {
+	rgbFrame := RGBBytes(benchFrame(b))
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			legacyRawDataToImage(rgbFrame, benchWidth, benchHeight)
+		}
+	})
+	b.Run("channels", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			img := RawDataToImage(rgbFrame, benchWidth, benchHeight)
+			for c := 0; c < ColorChannels; c++ {
+				ChannelImage(img, c)
+			}
+		}
+	})
+}
+
+func BenchmarkGrayDataToImage(b *testing.B) {
+	grayFrame := GrayBytes(benchFrame(b))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		GrayDataToImage(grayFrame, benchWidth, benchHeight)
+	}
+}
+
+func BenchmarkResizeImage(b *testing.B) {
+	img := GrayDataToImage(GrayBytes(benchFrame(b)), benchWidth, benchHeight)
+	b.Run("lanczos3-0.5", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			resize.Resize(benchWidth/2, benchHeight/2, img, resize.Lanczos3)
+		}
+	})
+	for _, x := range []float64{0.5, 1, 1.5} {
+		b.Run(fmt.Sprint(x), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				ResizeImage(img, x)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/liyue201/goqr"
+	"github.com/makiuchi-d/gozxing"
+	qrdecode1 "github.com/makiuchi-d/gozxing/qrcode"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 内置的二维码识别方式
+const (
+	DecoderGozxing = "gozxing"
+	DecoderGoqr    = "goqr"
+	DecoderPyzbar  = "pyzbar"
+)
+
+// DefaultDecoders 为默认的识别顺序，所有识别方式都失败的视频帧保存到待检查目录，由 resolve 命令补全
+const DefaultDecoders = DecoderGozxing + "," + DecoderGoqr + "," + DecoderPyzbar
+
+// FrameDecoder 为一种二维码识别方式，识别失败或结果未通过校验时返回错误，由识别链交给下一个识别方式
+// 识别方式需要可以在多个识别线程中并发调用，并且不能等待用户输入
+type FrameDecoder interface {
+	Name() string
+	Decode(img image.Image, validate FrameValidator, payload string) ([]byte, error)
+}
+
+// DecoderOptions 为创建识别方式时的配置
+type DecoderOptions struct {
+	// Helper 为常驻识别辅助进程的命令，为空时使用程序目录下的 lumina_qrcode.py
+	Helper []string
+	// Log 为识别过程中提示信息的输出位置，为 nil 时输出到标准输出
+	Log io.Writer
+}
+
+// restartReporter 由使用外部进程的识别方式实现，返回进程重启的次数，输出在识别方式统计中
+type restartReporter interface {
+	Restarts() int
+}
+
+// DecoderFactory 创建识别方式，每个识别链创建自己的实例，占用外部进程等资源的识别方式实现 io.Closer
+type DecoderFactory func(opts DecoderOptions) FrameDecoder
+
+var frameDecoders = make(map[string]DecoderFactory)
+
+// RegisterFrameDecoder 注册识别方式，新的识别方式在自己的 init 中注册即可通过 --decoders 使用
+func RegisterFrameDecoder(name string, factory DecoderFactory) {
+	frameDecoders[name] = factory
+}
+
+func init() {
+	RegisterFrameDecoder(DecoderGozxing, func(DecoderOptions) FrameDecoder { return gozxingDecoder{} })
+	RegisterFrameDecoder(DecoderGoqr, func(DecoderOptions) FrameDecoder { return goqrDecoder{} })
+	RegisterFrameDecoder(DecoderPyzbar, newPyzbarDecoder)
+}
+
+// FrameDecoderNames 返回已注册的识别方式名称
+func FrameDecoderNames() []string {
+	names := make([]string, 0, len(frameDecoders))
+	for name := range frameDecoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseDecoders 解析逗号分隔的识别顺序，空字符串视为默认顺序
+func ParseDecoders(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		s = DefaultDecoders
+	}
+	names := make([]string, 0)
+	for _, name := range strings.Split(strings.ToLower(s), ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := frameDecoders[name]; !ok {
+			return nil, fmt.Errorf("不支持的识别方式: %s，可用: %s", name, strings.Join(FrameDecoderNames(), ", "))
+		}
+		for _, n := range names {
+			if n == name {
+				return nil, fmt.Errorf("识别方式重复: %s", name)
+			}
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// DecoderChain 按顺序使用多个识别方式，并统计每个识别方式的成功与失败次数
+// 第一个识别方式在识别线程中快速识别，其余识别方式在后备识别中依次尝试
+type DecoderChain struct {
+	decoders []FrameDecoder
+	log      io.Writer
+	mutex    sync.Mutex
+	success  map[string]int
+	failure  map[string]int
+}
+
+// NewDecoderChain 按名称创建识别链，names 为空时使用默认顺序，使用结束后需要调用 Close
+func NewDecoderChain(names []string, opts DecoderOptions) (*DecoderChain, error) {
+	if len(names) == 0 {
+		var err error
+		names, err = ParseDecoders(DefaultDecoders)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Log == nil {
+		opts.Log = os.Stdout
+	}
+	c := &DecoderChain{log: opts.Log, success: make(map[string]int), failure: make(map[string]int)}
+	for _, name := range names {
+		factory, ok := frameDecoders[name]
+		if !ok {
+			c.Close()
+			return nil, fmt.Errorf("不支持的识别方式: %s", name)
+		}
+		c.decoders = append(c.decoders, factory(opts))
+	}
+	return c, nil
+}
+
+// First 返回第一个识别方式的名称
+func (c *DecoderChain) First() string {
+	return c.decoders[0].Name()
+}
+
+// Log 返回识别过程中提示信息的输出位置
+func (c *DecoderChain) Log() io.Writer {
+	return c.log
+}
+
+// HasRest 判断除第一个识别方式外是否还有其他识别方式
+func (c *DecoderChain) HasRest() bool {
+	return len(c.decoders) > 1
+}
+
+func (c *DecoderChain) decode(d FrameDecoder, img image.Image, validate FrameValidator, payload string) ([]byte, error) {
+	data, err := d.Decode(img, validate, payload)
+	c.mutex.Lock()
+	if err == nil {
+		c.success[d.Name()]++
+	} else {
+		c.failure[d.Name()]++
+	}
+	c.mutex.Unlock()
+	return data, err
+}
+
+// DecodeFast 只使用第一个识别方式，可以在识别线程中并发调用
+func (c *DecoderChain) DecodeFast(img image.Image, validate FrameValidator, payload string) ([]byte, error) {
+	return c.decode(c.decoders[0], img, validate, payload)
+}
+
+// DecodeRest 依次使用第一个识别方式之外的识别方式
+func (c *DecoderChain) DecodeRest(img image.Image, i int, validate FrameValidator, payload string) []byte {
+	return c.decodeFrom(1, img, i, validate, payload)
+}
+
+// Decode 依次使用识别链中的所有识别方式
+func (c *DecoderChain) Decode(img image.Image, i int, validate FrameValidator, payload string) []byte {
+	return c.decodeFrom(0, img, i, validate, payload)
+}
+
+func (c *DecoderChain) decodeFrom(start int, img image.Image, i int, validate FrameValidator, payload string) []byte {
+	for _, d := range c.decoders[start:] {
+		data, err := c.decode(d, img, validate, payload)
+		if err == nil {
+			return data
+		}
+		fmt.Fprintln(c.log, de, "第", i, "帧", err)
+	}
+	return nil
+}
+
+// ResetStats 清空统计，每个文件开始解码时调用
+func (c *DecoderChain) ResetStats() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.success = make(map[string]int)
+	c.failure = make(map[string]int)
+}
+
+// Close 关闭识别方式占用的外部进程
+func (c *DecoderChain) Close() {
+	for _, d := range c.decoders {
+		if closer, ok := d.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
+
+// PrintStats 输出每个识别方式的成功与失败次数
+func (c *DecoderChain) PrintStats() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintln(c.log, de, "  识别方式统计:")
+	for _, d := range c.decoders {
+		if r, ok := d.(restartReporter); ok && r.Restarts() > 0 {
+			fmt.Fprintln(c.log, de, "    "+d.Name()+":", "成功", c.success[d.Name()], "失败", c.failure[d.Name()], "进程重启", r.Restarts())
+			continue
+		}
+		fmt.Fprintln(c.log, de, "    "+d.Name()+":", "成功", c.success[d.Name()], "失败", c.failure[d.Name()])
+	}
+}
+
+// checkFrame 校验识别出的数据帧
+func checkFrame(name string, data []byte, validate FrameValidator) ([]byte, error) {
+	if validate != nil {
+		if err := validate(data); err != nil {
+			return nil, fmt.Errorf("%s 库: 帧校验失败: %v", name, err)
+		}
+	}
+	return data, nil
+}
+
+// gozxingDecoder 使用 gozxing 识别二维码，速度最快，默认在识别线程中使用
+type gozxingDecoder struct{}
+
+func (gozxingDecoder) Name() string {
+	return DecoderGozxing
+}
+
+func (gozxingDecoder) Decode(img image.Image, validate FrameValidator, payload string) ([]byte, error) {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return nil, fmt.Errorf("gozxing 库: qrcode转bmp失败: %v", err)
+	}
+	result, err := qrdecode1.NewQRCodeReader().Decode(bmp, payloadDecodeHints(payload))
+	if err != nil {
+		return nil, fmt.Errorf("gozxing 库: 检测二维码失败: %v", err)
+	}
+	data, err := DecodePayloadText(result.GetText(), payload)
+	if err != nil {
+		return nil, fmt.Errorf("gozxing 库: 数据帧解码失败: %v", err)
+	}
+	return checkFrame(DecoderGozxing, data, validate)
+}
+
+// goqrDecoder 使用 goqr 识别二维码
+type goqrDecoder struct{}
+
+func (goqrDecoder) Name() string {
+	return DecoderGoqr
+}
+
+func (goqrDecoder) Decode(img image.Image, validate FrameValidator, payload string) ([]byte, error) {
+	qrCodes, err := goqr.Recognize(img)
+	if err != nil {
+		return nil, fmt.Errorf("goqr 库: 检测二维码失败: %v", err)
+	}
+	if len(qrCodes) <= 0 {
+		return nil, errors.New("goqr 库: 没有检测到二维码")
+	}
+	data, err := DecodePayload(qrCodes[0].Payload, payload)
+	if err != nil {
+		return nil, fmt.Errorf("goqr 库: 数据帧解码失败: %v", err)
+	}
+	return checkFrame(DecoderGoqr, data, validate)
+}
+
+// SaveTempImage 将图像保存为临时 PNG 文件，供外部识别程序读取，使用后由调用者删除
+func SaveTempImage(img image.Image) (string, error) {
+	file, err := os.CreateTemp("", "lumina_frame_*.png")
+	if err != nil {
+		return "", err
+	}
+	err = png.Encode(file, img)
+	file.Close()
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// DecodeCandidates 从外部识别程序给出的候选结果中取出第一个通过校验的数据帧
+// 二进制载荷时候选结果即为原始字节(zbar 会猜测字节模式的字符集，可能给出多种还原结果)，其他载荷需要先解码
+func DecodeCandidates(name string, candidates [][]byte, validate FrameValidator, payload string) ([]byte, error) {
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%s: 没有检测到二维码", name)
+	}
+	var lastErr error
+	for _, candidate := range candidates {
+		data := candidate
+		if payload != PayloadBinary {
+			var err error
+			data, err = DecodePayload(bytes.TrimSpace(candidate), payload)
+			if err != nil {
+				lastErr = fmt.Errorf("%s: 数据帧解码失败: %v", name, err)
+				continue
+			}
+		}
+		if validate != nil {
+			if err := validate(data); err != nil {
+				lastErr = fmt.Errorf("%s: 帧校验失败: %v", name, err)
+				continue
+			}
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// pyzbarDecoder 通过常驻的辅助进程(默认为 lumina_qrcode.py)使用 pyzbar 识别二维码，多个识别线程共用一个进程并依次识别
+type pyzbarDecoder struct {
+	helper *DecoderHelper
+	err    error
+}
+
+func newPyzbarDecoder(opts DecoderOptions) FrameDecoder {
+	command := opts.Helper
+	if len(command) == 0 {
+		var err error
+		command, err = DefaultHelperCommand()
+		if err != nil {
+			return &pyzbarDecoder{err: err}
+		}
+	}
+	return &pyzbarDecoder{helper: NewDecoderHelper(command, opts.Log)}
+}
+
+func (d *pyzbarDecoder) Name() string {
+	return DecoderPyzbar
+}
+
+func (d *pyzbarDecoder) Decode(img image.Image, validate FrameValidator, payload string) ([]byte, error) {
+	if d.err != nil {
+		return nil, fmt.Errorf("pyzbar 库: %v", d.err)
+	}
+	results, err := d.helper.Decode(img)
+	if err != nil {
+		return nil, fmt.Errorf("pyzbar 库: %v", err)
+	}
+	return DecodeCandidates("pyzbar 库", results, validate, payload)
+}
+
+func (d *pyzbarDecoder) Restarts() int {
+	if d.helper == nil {
+		return 0
+	}
+	return d.helper.Restarts()
+}
+
+func (d *pyzbarDecoder) Close() error {
+	if d.helper == nil {
+		return nil
+	}
+	return d.helper.Close()
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// FountainBlockSymbols 为喷泉码每个源块包含的最大源符号数
+const FountainBlockSymbols = 1024
+
+// splitMix64 为跨平台确定的伪随机数发生器，编码端与解码端由相同种子得到相同的邻居集合
+type splitMix64 uint64
+
+func (s *splitMix64) Next() uint64 {
+	*s += 0x9E3779B97F4A7C15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// Intn 返回 [0, n) 范围内的整数
+func (s *splitMix64) Intn(n int) int {
+	return int(s.Next() % uint64(n))
+}
+
+// RobustSolitonCDF 计算 K 个源符号的鲁棒孤波分布的累积分布函数
+func RobustSolitonCDF(k int) []float64 {
+	const c = 0.1
+	const delta = 0.5
+	rho := make([]float64, k+1)
+	tau := make([]float64, k+1)
+	rho[1] = 1.0 / float64(k)
+	for d := 2; d <= k; d++ {
+		rho[d] = 1.0 / float64(d*(d-1))
+	}
+	r := c * math.Log(float64(k)/delta) * math.Sqrt(float64(k))
+	spike := int(float64(k) / r)
+	if spike < 1 {
+		spike = 1
+	}
+	if spike > k {
+		spike = k
+	}
+	for d := 1; d < spike; d++ {
+		tau[d] = r / float64(d*k)
+	}
+	tau[spike] = r * math.Log(r/delta) / float64(k)
+	if tau[spike] < 0 {
+		tau[spike] = 0
+	}
+	sum := 0.0
+	for d := 1; d <= k; d++ {
+		sum += rho[d] + tau[d]
+	}
+	cdf := make([]float64, k+1)
+	acc := 0.0
+	for d := 1; d <= k; d++ {
+		acc += (rho[d] + tau[d]) / sum
+		cdf[d] = acc
+	}
+	cdf[k] = 1
+	return cdf
+}
+
+// FountainNeighbors 返回编码符号 esi 所组合的源符号下标，重复出现的下标在异或时相互抵消
+// 前 K 个符号为系统符号(即源符号本身)，之后的符号按鲁棒孤波分布选取度数和邻居，
+// 再额外混入 dense 个随机邻居，保证少量冗余符号也能覆盖到每个源符号
+func FountainNeighbors(fileID [4]byte, block int, esi int, k int, dense int, cdf []float64) []int {
+	if esi < k {
+		return []int{esi}
+	}
+	seed := splitMix64(uint64(binary.BigEndian.Uint32(fileID[:]))<<32 ^ uint64(block)<<20 ^ uint64(esi))
+	p := float64(seed.Next()>>11) / (1 << 53)
+	degree := 1
+	for degree < k && cdf[degree] < p {
+		degree++
+	}
+	// 部分 Fisher-Yates 洗牌以选出不重复的邻居
+	chosen := make(map[int]int, degree)
+	neighbors := make([]int, degree)
+	for i := 0; i < degree; i++ {
+		j := i + seed.Intn(k-i)
+		vj, ok := chosen[j]
+		if !ok {
+			vj = j
+		}
+		vi, ok := chosen[i]
+		if !ok {
+			vi = i
+		}
+		chosen[j] = vi
+		neighbors[i] = vj
+	}
+	for i := 0; i < dense; i++ {
+		neighbors = append(neighbors, seed.Intn(k))
+	}
+	return neighbors
+}
+
+// FountainLayout 描述喷泉码下源块与编码符号的划分
+type FountainLayout struct {
+	Slice        int
+	SourceCount  int // 源符号总数
+	BlockSymbols int // 每个源块的源符号数(最后一个块可能更少)
+	Blocks       int
+	Ratio        float64
+}
+
+func NewFountainLayout(size int64, slice int, blockSymbols int, ratio float64) FountainLayout {
+	sourceCount := int((size + int64(slice) - 1) / int64(slice))
+	blocks := (sourceCount + blockSymbols - 1) / blockSymbols
+	return FountainLayout{
+		Slice:        slice,
+		SourceCount:  sourceCount,
+		BlockSymbols: blockSymbols,
+		Blocks:       blocks,
+		Ratio:        ratio,
+	}
+}
+
+// BlockK 返回第 block 个源块的源符号数
+func (l FountainLayout) BlockK(block int) int {
+	if block == l.Blocks-1 {
+		return l.SourceCount - block*l.BlockSymbols
+	}
+	return l.BlockSymbols
+}
+
+// BlockSymbolCount 返回第 block 个源块发出的编码符号数
+func (l FountainLayout) BlockSymbolCount(block int) int {
+	return int(math.Ceil(float64(l.BlockK(block)) * (1 + l.Ratio)))
+}
+
+// DenseDegree 返回第 block 个源块冗余符号额外混入的随机邻居数，使每个源符号平均被约 8 个冗余符号覆盖
+func (l FountainLayout) DenseDegree(block int) int {
+	k := l.BlockK(block)
+	repair := l.BlockSymbolCount(block) - k
+	if repair <= 0 {
+		return 0
+	}
+	dense := (8*k + repair - 1) / repair
+	if dense > k/2 {
+		dense = k / 2
+	}
+	return dense
+}
+
+// Count 返回编码符号总数
+func (l FountainLayout) Count() int {
+	if l.Blocks == 0 {
+		return 0
+	}
+	return (l.Blocks-1)*l.BlockSymbolCount(0) + l.BlockSymbolCount(l.Blocks-1)
+}
+
+// Locate 将全局帧序号转换为源块序号与块内符号序号
+func (l FountainLayout) Locate(seq int) (int, int) {
+	full := l.BlockSymbolCount(0)
+	block := seq / full
+	if block >= l.Blocks {
+		block = l.Blocks - 1
+	}
+	return block, seq - block*full
+}
+
+// FountainSource 按源块逐个生成喷泉码编码符号
+type FountainSource struct {
+	data         *StreamData
+	fileID       [4]byte
+	slice        int
+	blockSymbols int
+	ratio        float64
+	full         int // 完整源块发出的编码符号数
+	cdf          map[int][]float64
+}
+
+func NewFountainSource(data *StreamData, fileID [4]byte, slice int, blockSymbols int, ratio float64) *FountainSource {
+	blockSize := int64(blockSymbols) * int64(slice)
+	return &FountainSource{
+		data:         data,
+		fileID:       fileID,
+		slice:        slice,
+		blockSymbols: blockSymbols,
+		ratio:        ratio,
+		full:         NewFountainLayout(2*blockSize, slice, blockSymbols, ratio).BlockSymbolCount(0),
+		cdf:          make(map[int][]float64),
+	}
+}
+
+// layout 返回生成第 seq 个编码符号所在源块时使用的划分
+// 编码数据流读到末尾前，之后还有数据的源块都是完整的，按之后还有一个源块计算，与解码时按实际长度计算的划分相同
+func (f *FountainSource) layout(seq int) FountainLayout {
+	end := int64(seq/f.full+1) * int64(f.blockSymbols) * int64(f.slice)
+	if f.data.Has(end) {
+		return NewFountainLayout(end+1, f.slice, f.blockSymbols, f.ratio)
+	}
+	return NewFountainLayout(f.data.Size(), f.slice, f.blockSymbols, f.ratio)
+}
+
+func (f *FountainSource) Has(seq int) bool {
+	return seq < f.layout(seq).Count()
+}
+
+func (f *FountainSource) Frame(seq int) (FrameHeader, []byte) {
+	layout := f.layout(seq)
+	block, esi := layout.Locate(seq)
+	k := layout.BlockK(block)
+	if _, ok := f.cdf[k]; !ok {
+		f.cdf[k] = RobustSolitonCDF(k)
+	}
+	symbol := make([]byte, f.slice)
+	for _, n := range FountainNeighbors(f.fileID, block, esi, k, layout.DenseDegree(block), f.cdf[k]) {
+		start := int64(block*f.blockSymbols+n) * int64(f.slice)
+		for i, b := range f.data.Slice(start, f.slice) {
+			symbol[i] ^= b
+		}
+	}
+	return FrameHeader{Kind: FrameKindData, FileID: f.fileID, Seq: uint32(seq)}, symbol
+}
+
+// fountainBlock 为单个源块的增量高斯消元状态
+type fountainBlock struct {
+	k      int
+	rank   int
+	done   bool
+	pivots []int // 列 -> 行下标，-1 表示尚无主元
+	coefs  [][]uint64
+	datas  [][]byte
+}
+
+func newFountainBlock(k int) *fountainBlock {
+	pivots := make([]int, k)
+	for i := range pivots {
+		pivots[i] = -1
+	}
+	return &fountainBlock{k: k, pivots: pivots}
+}
+
+// insert 加入一个编码符号，返回该符号是否提升了秩
+func (b *fountainBlock) insert(neighbors []int, data []byte) bool {
+	coef := make([]uint64, (b.k+63)/64)
+	for _, n := range neighbors {
+		coef[n/64] ^= 1 << (uint(n) % 64)
+	}
+	data = append([]byte(nil), data...)
+	for {
+		col := lowestBit(coef)
+		if col < 0 {
+			return false
+		}
+		row := b.pivots[col]
+		if row < 0 {
+			b.pivots[col] = len(b.coefs)
+			b.coefs = append(b.coefs, coef)
+			b.datas = append(b.datas, data)
+			b.rank++
+			return true
+		}
+		xorWords(coef, b.coefs[row])
+		xorBytes(data, b.datas[row])
+	}
+}
+
+// solve 回代求解，返回每个源符号的数据，无法求出的源符号为 nil
+func (b *fountainBlock) solve() [][]byte {
+	solved := make([][]byte, b.k)
+	for col := b.k - 1; col >= 0; col-- {
+		row := b.pivots[col]
+		if row < 0 {
+			continue
+		}
+		coef := b.coefs[row]
+		data := b.datas[row]
+		ok := true
+		coef[col/64] &^= 1 << (uint(col) % 64)
+		for c := lowestBit(coef); c >= 0; c = lowestBit(coef) {
+			if solved[c] == nil {
+				ok = false
+				break
+			}
+			xorBytes(data, solved[c])
+			coef[c/64] &^= 1 << (uint(c) % 64)
+		}
+		if ok {
+			solved[col] = data
+		}
+	}
+	return solved
+}
+
+func lowestBit(words []uint64) int {
+	for i, w := range words {
+		if w != 0 {
+			return i*64 + bits.TrailingZeros64(w)
+		}
+	}
+	return -1
+}
+
+func xorWords(dst, src []uint64) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// FountainWriter 收集喷泉码符号，每个源块集齐足够的线性无关符号后立即解出并写入输出文件
+type FountainWriter struct {
+	file    *os.File
+	fileID  [4]byte
+	size    int64
+	layout  FountainLayout
+	cdf     map[int][]float64
+	blocks  map[int]*fountainBlock
+	solved  []bool
+	placed  *placedFrames
+	dup     int
+	foreign int
+}
+
+func NewFountainWriter(file *os.File, fileID [4]byte, slice int, size int64, blockSymbols int, ratio float64) *FountainWriter {
+	layout := NewFountainLayout(size, slice, blockSymbols, ratio)
+	return &FountainWriter{
+		file:   file,
+		fileID: fileID,
+		size:   size,
+		layout: layout,
+		cdf:    make(map[int][]float64),
+		blocks: make(map[int]*fountainBlock),
+		solved: make([]bool, layout.SourceCount),
+		placed: newPlacedFrames(),
+	}
+}
+
+func (w *FountainWriter) Write(h FrameHeader, payload []byte) error {
+	if h.FileID != w.fileID {
+		w.foreign++
+		return errors.New("帧不属于当前文件")
+	}
+	if h.Kind != FrameKindData {
+		return ErrNotFrame
+	}
+	if int(h.Seq) >= w.layout.Count() {
+		return fmt.Errorf("帧序号超出范围: %d", h.Seq)
+	}
+	if len(payload) != w.layout.Slice {
+		return fmt.Errorf("符号长度不匹配: %d", len(payload))
+	}
+	block, esi := w.layout.Locate(int(h.Seq))
+	k := w.layout.BlockK(block)
+	b, ok := w.blocks[block]
+	if !ok {
+		b = newFountainBlock(k)
+		w.blocks[block] = b
+	}
+	if b.done {
+		w.dup++
+		return nil
+	}
+	if _, ok := w.cdf[k]; !ok {
+		w.cdf[k] = RobustSolitonCDF(k)
+	}
+	if !b.insert(FountainNeighbors(w.fileID, block, esi, k, w.layout.DenseDegree(block), w.cdf[k]), payload) {
+		w.dup++
+		return nil
+	}
+	if b.rank == b.k {
+		if err := w.flush(block, b); err != nil {
+			return err
+		}
+		b.done = true
+		b.coefs = nil
+		b.datas = nil
+	}
+	return nil
+}
+
+// Redundant 判断编码符号在源块未能解出时是否可能不会写入输出文件，需要在 Write 之前调用
+// 冗余符号(块内序号不小于源符号数)只参与消元；系统符号所在列已有其他符号作为主元时，同样不一定能直接求出
+func (w *FountainWriter) Redundant(h FrameHeader) bool {
+	block, esi := w.layout.Locate(int(h.Seq))
+	if esi >= w.layout.BlockK(block) {
+		return true
+	}
+	b, ok := w.blocks[block]
+	return ok && !b.done && b.pivots[esi] >= 0
+}
+
+// flush 将源块中已求出的源符号写入输出文件
+func (w *FountainWriter) flush(block int, b *fountainBlock) error {
+	for i, data := range b.solve() {
+		if data == nil {
+			continue
+		}
+		g := block*w.layout.BlockSymbols + i
+		offset := int64(g) * int64(w.layout.Slice)
+		if offset+int64(len(data)) > w.size {
+			data = data[:w.size-offset]
+		}
+		if _, err := w.file.WriteAt(data, offset); err != nil {
+			return err
+		}
+		w.solved[g] = true
+	}
+	w.placed.advance(w.solved)
+	return nil
+}
+
+// Finish 对未能完全解出的源块尽量恢复部分源符号，并截断输出文件
+func (w *FountainWriter) Finish() error {
+	for block, b := range w.blocks {
+		if b.done {
+			continue
+		}
+		if err := w.flush(block, b); err != nil {
+			w.placed.finish()
+			return err
+		}
+	}
+	err := w.file.Truncate(w.size)
+	w.placed.finish()
+	return err
+}
+
+// Missing 返回未能恢复的源符号序号
+func (w *FountainWriter) Missing() []int {
+	missing := make([]int, 0)
+	for seq, ok := range w.solved {
+		if !ok {
+			missing = append(missing, seq)
+		}
+	}
+	return missing
+}
+
+func (w *FountainWriter) Duplicates() int {
+	return w.dup
+}
+
+func (w *FountainWriter) Foreign() int {
+	return w.foreign
+}
+
+func (w *FountainWriter) Placed() io.Reader {
+	return &PlacedReader{file: w.file, placed: w.placed, slice: w.layout.Slice, size: w.size}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestFountainDecode(t *testing.T) {
+	fileID := [4]byte{3, 1, 4, 1}
+	const slice, blockSymbols, ratio = 16, 64, 0.5
+	data := testData(slice*blockSymbols*2 + slice*20 + 5) // 两个完整源块与一个较小的源块
+	layout := NewFountainLayout(int64(len(data)), slice, blockSymbols, ratio)
+	tests := []struct {
+		name     string
+		drop     func(block int, esi int) bool
+		complete bool
+	}{
+		{"no loss", func(block, esi int) bool { return false }, true},
+		{"systematic only", func(block, esi int) bool { return esi >= layout.BlockK(block) }, true},
+		{"every fifth", func(block, esi int) bool { return esi%5 == 2 }, true},
+		{"systematic burst", func(block, esi int) bool { return block < 2 && esi >= 8 && esi < 24 }, true},
+		{"last block burst", func(block, esi int) bool { return block == 2 && esi >= 3 && esi < 8 }, true},
+		{"whole block", func(block, esi int) bool { return block == 1 }, false},
+		{"too few symbols", func(block, esi int) bool { return block == 2 && esi%2 == 0 }, false},
+	}
+	src := NewFountainSource(NewStreamData(bytes.NewReader(data), slice*blockSymbols), fileID, slice, blockSymbols, ratio)
+	frames := collectFrames(t, src)
+	if len(frames) != layout.Count() {
+		t.Fatalf("编码符号数 %d, 期望 %d", len(frames), layout.Count())
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tempOutput(t)
+			w := NewFountainWriter(file, fileID, slice, int64(len(data)), blockSymbols, ratio)
+			for _, f := range frames {
+				if tt.drop(layout.Locate(int(f.header.Seq))) {
+					continue
+				}
+				if err := w.Write(f.header, f.payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Write(FrameHeader{Kind: FrameKindData, FileID: [4]byte{}, Seq: 0}, frames[0].payload); err == nil {
+				t.Error("写入不属于此文件的符号没有返回错误")
+			}
+			if err := w.Write(FrameHeader{Kind: FrameKindData, FileID: fileID, Seq: 0}, frames[0].payload[1:]); err == nil {
+				t.Error("写入长度不匹配的符号没有返回错误")
+			}
+			if err := w.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			missing := w.Missing()
+			if tt.complete != (len(missing) == 0) {
+				t.Fatalf("缺失源符号 %v", missing)
+			}
+			out, err := os.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != len(data) {
+				t.Fatalf("输出长度 %d, 期望 %d", len(out), len(data))
+			}
+			isMissing := make(map[int]bool)
+			for _, seq := range missing {
+				isMissing[seq] = true
+			}
+			// 已恢复的源符号必须正确，不能因部分消元写入错误的数据
+			for seq := 0; seq < layout.SourceCount; seq++ {
+				end := (seq + 1) * slice
+				if end > len(data) {
+					end = len(data)
+				}
+				if !isMissing[seq] && !bytes.Equal(out[seq*slice:end], data[seq*slice:end]) {
+					t.Errorf("第 %d 个源符号数据不一致", seq)
+				}
+			}
+		})
+	}
+}
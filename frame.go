@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FrameVersion 为当前编码器写出的帧格式版本，0 表示不带帧头的旧格式，1 表示不带 CRC 的帧
+const FrameVersion = 2
+
+// 数据帧: 帧类型(1) + 文件Hash前缀(4) + 段索引(2) + 帧序号(4) + 数据长度(2) + 数据 + CRC32C(4)
+// CRC32C 覆盖帧头与数据，版本 1 的帧没有 CRC
+const (
+	FrameKindData   = 'L'
+	FrameKindParity = 'P'
+	FrameHeaderLen  = 13
+	FrameCRCLen     = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrNotFrame      = errors.New("不是数据帧")
+	ErrFrameChecksum = errors.New("帧 CRC 校验失败")
+	ErrFramesMissing = errors.New("有数据帧缺失，无法继续还原")
+)
+
+// FrameValidator 在二维码解码链中校验解码结果，返回错误时解码链会尝试下一个解码器
+type FrameValidator func(data []byte) error
+
+// NewFrameValidator 返回校验指定版本数据帧的函数
+// 不是数据帧的内容只有能解析为索引数据时才放行，其他内容(例如帧类型字节损坏的数据帧)按校验失败处理，由识别链尝试下一个识别方式
+func NewFrameValidator(version int) FrameValidator {
+	return func(data []byte) error {
+		_, _, err := UnmarshalFrame(data, version)
+		if err == ErrNotFrame {
+			if IsIndexFrame(data) {
+				return nil
+			}
+			return ErrFrameChecksum
+		}
+		return err
+	}
+}
+
+// IsIndexFrame 判断识别结果是否为索引帧(JSON 格式的索引数据)，流式编码时除最后一段外索引帧没有 Hash，只有文件标识
+func IsIndexFrame(data []byte) bool {
+	var indexData IndexData
+	if err := json.Unmarshal(data, &indexData); err != nil {
+		return false
+	}
+	return indexData.Hash != "" || indexData.FileID != ""
+}
+
+type FrameHeader struct {
+	Kind    byte
+	FileID  [4]byte
+	Segment uint16
+	Seq     uint32
+	Length  uint16
+}
+
+// FileIDFromHash 取文件 SHA256 的前 4 字节作为帧头中的文件标识
+func FileIDFromHash(hash string) [4]byte {
+	var id [4]byte
+	b, err := hex.DecodeString(hash)
+	if err == nil {
+		copy(id[:], b)
+	}
+	return id
+}
+
+// NewFileID 生成随机的文件标识，流式编码时文件 Hash 在读完输入后才能确定，文件标识以十六进制写入索引
+func NewFileID() ([4]byte, error) {
+	var id [4]byte
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// MarshalFrame 将帧头与数据拼接为一个完整的数据帧
+func MarshalFrame(h FrameHeader, payload []byte) []byte {
+	h.Length = uint16(len(payload))
+	if h.Kind == 0 {
+		h.Kind = FrameKindData
+	}
+	buf := make([]byte, FrameHeaderLen+len(payload)+FrameCRCLen)
+	buf[0] = h.Kind
+	copy(buf[1:5], h.FileID[:])
+	binary.BigEndian.PutUint16(buf[5:7], h.Segment)
+	binary.BigEndian.PutUint32(buf[7:11], h.Seq)
+	binary.BigEndian.PutUint16(buf[11:13], h.Length)
+	copy(buf[FrameHeaderLen:], payload)
+	crc := crc32.Checksum(buf[:FrameHeaderLen+len(payload)], crcTable)
+	binary.BigEndian.PutUint32(buf[FrameHeaderLen+len(payload):], crc)
+	return buf
+}
+
+// UnmarshalFrame 解析指定版本的数据帧，索引帧(JSON)返回 ErrNotFrame，CRC 不匹配返回 ErrFrameChecksum
+func UnmarshalFrame(data []byte, version int) (FrameHeader, []byte, error) {
+	var h FrameHeader
+	if len(data) < FrameHeaderLen || (data[0] != FrameKindData && data[0] != FrameKindParity) {
+		return h, nil, ErrNotFrame
+	}
+	if version >= 2 {
+		if len(data) < FrameHeaderLen+FrameCRCLen {
+			return h, nil, ErrFrameChecksum
+		}
+		body := data[:len(data)-FrameCRCLen]
+		if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(body):]) {
+			return h, nil, ErrFrameChecksum
+		}
+		data = body
+	}
+	h.Kind = data[0]
+	copy(h.FileID[:], data[1:5])
+	h.Segment = binary.BigEndian.Uint16(data[5:7])
+	h.Seq = binary.BigEndian.Uint32(data[7:11])
+	h.Length = binary.BigEndian.Uint16(data[11:13])
+	payload := data[FrameHeaderLen:]
+	if int(h.Length) != len(payload) {
+		return h, nil, fmt.Errorf("数据长度不匹配: 帧头 %d, 实际 %d", h.Length, len(payload))
+	}
+	return h, payload, nil
+}
+
+// FrameSource 按全局帧序号顺序生成数据帧，Segment 字段由调用方填写
+// 编码数据流读到末尾前帧数未知，Has 判断帧序号是否存在
+type FrameSource interface {
+	Has(seq int) bool
+	Frame(seq int) (FrameHeader, []byte)
+}
+
+// FrameSink 接收解码得到的数据帧并还原输出文件
+type FrameSink interface {
+	Write(h FrameHeader, payload []byte) error
+	Finish() error
+	Missing() []int
+	Duplicates() int
+	Foreign() int
+	// Placed 返回按顺序读取输出文件中已写入数据的读取者，用于边解码边解密、解压
+	Placed() io.Reader
+}
+
+// PlainSource 将文件按固定长度切片，每个切片为一个数据帧
+type PlainSource struct {
+	data   *StreamData
+	slice  int
+	fileID [4]byte
+}
+
+func NewPlainSource(data *StreamData, slice int, fileID [4]byte) *PlainSource {
+	return &PlainSource{data: data, slice: slice, fileID: fileID}
+}
+
+func (p *PlainSource) Has(seq int) bool {
+	return p.data.Has(int64(seq) * int64(p.slice))
+}
+
+func (p *PlainSource) Frame(seq int) (FrameHeader, []byte) {
+	return FrameHeader{Kind: FrameKindData, FileID: p.fileID, Seq: uint32(seq)}, p.data.Slice(int64(seq)*int64(p.slice), p.slice)
+}
+
+// placedFrames 记录从第一帧起连续写入输出文件的帧数，读取者等待后续的帧写入
+type placedFrames struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	count    int
+	finished bool
+}
+
+func newPlacedFrames() *placedFrames {
+	p := &placedFrames{}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// advance 在帧写入输出文件后调用，placed 为每一帧是否已写入
+func (p *placedFrames) advance(placed []bool) {
+	p.mutex.Lock()
+	for p.count < len(placed) && placed[p.count] {
+		p.count++
+	}
+	p.mutex.Unlock()
+	p.cond.Broadcast()
+}
+
+// finish 在接收器结束后调用，之后不会再有帧写入
+func (p *placedFrames) finish() {
+	p.mutex.Lock()
+	p.finished = true
+	p.mutex.Unlock()
+	p.cond.Broadcast()
+}
+
+// wait 等待至少 n 帧连续写入或接收器结束，返回连续写入的帧数
+func (p *placedFrames) wait(n int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.count < n && !p.finished {
+		p.cond.Wait()
+	}
+	return p.count
+}
+
+// PlacedReader 按顺序读取输出文件中从开头起连续写入的数据，后续的帧尚未写入时等待
+// 接收器结束后仍有帧缺失时返回 ErrFramesMissing
+type PlacedReader struct {
+	file   *os.File
+	placed *placedFrames
+	slice  int
+	size   int64
+	off    int64
+}
+
+func (r *PlacedReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	need := int(r.off/int64(r.slice)) + 1
+	count := r.placed.wait(need)
+	if count < need {
+		return 0, ErrFramesMissing
+	}
+	end := int64(count) * int64(r.slice)
+	if end > r.size {
+		end = r.size
+	}
+	if int64(len(p)) > end-r.off {
+		p = p[:end-r.off]
+	}
+	n, err := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// FrameWriter 按帧序号将数据写入输出文件的对应位置，重复帧会被覆盖，乱序帧会被放回原位
+type FrameWriter struct {
+	file     *os.File
+	fileID   [4]byte
+	slice    int
+	size     int64
+	received []bool
+	placed   *placedFrames
+	dup      int
+	foreign  int
+}
+
+func NewFrameWriter(file *os.File, fileID [4]byte, slice int, size int64) *FrameWriter {
+	frames := int((size + int64(slice) - 1) / int64(slice))
+	return &FrameWriter{
+		file:     file,
+		fileID:   fileID,
+		slice:    slice,
+		size:     size,
+		received: make([]bool, frames),
+		placed:   newPlacedFrames(),
+	}
+}
+
+// Write 写入一个已解析的数据帧
+func (w *FrameWriter) Write(h FrameHeader, payload []byte) error {
+	if h.FileID != w.fileID {
+		w.foreign++
+		return errors.New("帧不属于当前文件")
+	}
+	if h.Kind != FrameKindData {
+		return ErrNotFrame
+	}
+	if int(h.Seq) >= len(w.received) {
+		return fmt.Errorf("帧序号超出范围: %d", h.Seq)
+	}
+	offset := int64(h.Seq) * int64(w.slice)
+	if offset+int64(len(payload)) > w.size {
+		return fmt.Errorf("帧数据超出文件长度: 帧序号 %d", h.Seq)
+	}
+	if w.received[h.Seq] {
+		w.dup++
+		return nil
+	}
+	if _, err := w.file.WriteAt(payload, offset); err != nil {
+		return err
+	}
+	w.received[h.Seq] = true
+	w.placed.advance(w.received)
+	return nil
+}
+
+// Finish 将输出文件截断到原始长度
+func (w *FrameWriter) Finish() error {
+	err := w.file.Truncate(w.size)
+	w.placed.finish()
+	return err
+}
+
+func (w *FrameWriter) Placed() io.Reader {
+	return &PlacedReader{file: w.file, placed: w.placed, slice: w.slice, size: w.size}
+}
+
+// Missing 返回未收到的帧序号
+func (w *FrameWriter) Missing() []int {
+	missing := make([]int, 0)
+	for seq, ok := range w.received {
+		if !ok {
+			missing = append(missing, seq)
+		}
+	}
+	return missing
+}
+
+func (w *FrameWriter) Duplicates() int {
+	return w.dup
+}
+
+func (w *FrameWriter) Foreign() int {
+	return w.foreign
+}
+
+// FormatRanges 将有序的帧序号列表压缩为 "1-3, 7" 形式的字符串
+func FormatRanges(seqs []int) string {
+	parts := make([]string, 0)
+	for i := 0; i < len(seqs); {
+		j := i
+		for j+1 < len(seqs) && seqs[j+1] == seqs[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(seqs[i]))
+		} else {
+			parts = append(parts, strconv.Itoa(seqs[i])+"-"+strconv.Itoa(seqs[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	fileID := [4]byte{1, 2, 3, 4}
+	tests := []struct {
+		name    string
+		header  FrameHeader
+		payload []byte
+	}{
+		{"data", FrameHeader{Kind: FrameKindData, FileID: fileID, Segment: 3, Seq: 42}, []byte("lumina")},
+		{"parity", FrameHeader{Kind: FrameKindParity, FileID: fileID, Segment: 0, Seq: 7}, bytes.Repeat([]byte{0xff}, 350)},
+		{"empty", FrameHeader{Kind: FrameKindData, FileID: fileID, Seq: 0}, []byte{}},
+		{"default kind", FrameHeader{FileID: fileID, Segment: 65535, Seq: 1<<32 - 1}, []byte{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := MarshalFrame(tt.header, tt.payload)
+			h, payload, err := UnmarshalFrame(data, FrameVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.header
+			if want.Kind == 0 {
+				want.Kind = FrameKindData
+			}
+			want.Length = uint16(len(tt.payload))
+			if h != want {
+				t.Errorf("帧头 %+v, 期望 %+v", h, want)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("数据 %x, 期望 %x", payload, tt.payload)
+			}
+			// 版本 1 的帧没有 CRC
+			h, payload, err = UnmarshalFrame(data[:len(data)-FrameCRCLen], 1)
+			if err != nil || h != want || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("版本 1: %+v %x %v", h, payload, err)
+			}
+		})
+	}
+}
+
+func TestFrameCorruption(t *testing.T) {
+	frame := MarshalFrame(FrameHeader{Kind: FrameKindData, FileID: [4]byte{9, 9, 9, 9}, Seq: 5}, []byte("payload"))
+	corrupt := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte(nil), frame...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"payload bit", corrupt(func(b []byte) []byte { b[FrameHeaderLen] ^= 1; return b }), ErrFrameChecksum},
+		{"seq", corrupt(func(b []byte) []byte { b[10] ^= 0x80; return b }), ErrFrameChecksum},
+		{"crc", corrupt(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), ErrFrameChecksum},
+		{"truncated", corrupt(func(b []byte) []byte { return b[:len(b)-1] }), ErrFrameChecksum},
+		{"header only", corrupt(func(b []byte) []byte { return b[:FrameHeaderLen] }), ErrFrameChecksum},
+		{"too short", corrupt(func(b []byte) []byte { return b[:FrameHeaderLen-1] }), ErrNotFrame},
+		{"kind", corrupt(func(b []byte) []byte { b[0] = 'X'; return b }), ErrNotFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := UnmarshalFrame(tt.data, FrameVersion); err != tt.want {
+				t.Errorf("错误 %v, 期望 %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrameValidator(t *testing.T) {
+	index, err := json.Marshal(IndexData{Hash: "00", Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, err := json.Marshal(IndexData{FileID: "01020304", Trailing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := MarshalFrame(FrameHeader{FileID: [4]byte{1, 2, 3, 4}, Seq: 1}, []byte("abc"))
+	badKind := append([]byte(nil), frame...)
+	badKind[0] = 'l'
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"data frame", frame, true},
+		{"index", index, true},
+		{"partial index", partial, true},
+		// 帧类型字节损坏的数据帧不能当作索引帧放行
+		{"corrupted kind", badKind, false},
+		{"other json", []byte(`{"foo":1}`), false},
+		{"garbage", []byte("not a frame at all"), false},
+	}
+	validate := NewFrameValidator(FrameVersion)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validate(tt.data); (err == nil) != tt.ok {
+				t.Errorf("校验结果 %v, 期望通过 %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// tempOutput 在测试的临时目录中创建输出文件
+func tempOutput(t *testing.T) *os.File {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestFrameWriterPlaced(t *testing.T) {
+	fileID := [4]byte{1, 1, 2, 3}
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	const slice = 16
+	frames := (len(data) + slice - 1) / slice
+	tests := []struct {
+		name  string
+		order []int
+		drop  int
+	}{
+		{"in order", []int{0, 1, 2, 3, 4, 5, 6}, -1},
+		{"reversed", []int{6, 5, 4, 3, 2, 1, 0}, -1},
+		{"shuffled with duplicates", []int{3, 0, 6, 3, 1, 5, 2, 0, 4}, -1},
+		{"missing middle", []int{0, 1, 2, 4, 5, 6}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewFrameWriter(tempOutput(t), fileID, slice, int64(len(data)))
+			// 读取者与写入同时进行，只能读到从开头起连续写入的数据
+			type result struct {
+				data []byte
+				err  error
+			}
+			done := make(chan result)
+			go func() {
+				b, err := io.ReadAll(w.Placed())
+				done <- result{b, err}
+			}()
+			for _, seq := range tt.order {
+				end := (seq + 1) * slice
+				if end > len(data) {
+					end = len(data)
+				}
+				if err := w.Write(FrameHeader{Kind: FrameKindData, FileID: fileID, Seq: uint32(seq)}, data[seq*slice:end]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Write(FrameHeader{Kind: FrameKindData, FileID: [4]byte{}, Seq: 0}, data[:slice]); err == nil {
+				t.Error("写入不属于此文件的帧没有返回错误")
+			}
+			if err := w.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			r := <-done
+			if tt.drop < 0 {
+				if r.err != nil || !bytes.Equal(r.data, data) {
+					t.Errorf("读取结果 %q %v", r.data, r.err)
+				}
+				if len(w.Missing()) != 0 {
+					t.Errorf("缺失帧 %v", w.Missing())
+				}
+			} else {
+				if r.err != ErrFramesMissing || !bytes.Equal(r.data, data[:tt.drop*slice]) {
+					t.Errorf("读取结果 %q %v, 期望读到缺失帧之前的数据后返回 ErrFramesMissing", r.data, r.err)
+				}
+				if m := w.Missing(); len(m) != 1 || m[0] != tt.drop {
+					t.Errorf("缺失帧 %v, 期望 [%d]", m, tt.drop)
+				}
+			}
+			if w.Foreign() != 1 {
+				t.Errorf("不属于此文件的帧数 %d", w.Foreign())
+			}
+			if len(tt.order) > frames && w.Duplicates() != len(tt.order)-frames {
+				t.Errorf("重复帧数 %d", w.Duplicates())
+			}
+		})
+	}
+}
+
+// sourceFrame 为从帧来源中取出的一个帧
+type sourceFrame struct {
+	header  FrameHeader
+	payload []byte
+}
+
+// collectFrames 按序号取出帧来源中的全部帧，每帧都经过一次编码与解码
+func collectFrames(t *testing.T, src FrameSource) []sourceFrame {
+	t.Helper()
+	frames := make([]sourceFrame, 0)
+	for seq := 0; src.Has(seq); seq++ {
+		h, payload, err := UnmarshalFrame(MarshalFrame(src.Frame(seq)), FrameVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, sourceFrame{h, payload})
+	}
+	return frames
+}
+
+// testData 生成确定性的测试数据
+func testData(n int) []byte {
+	data := make([]byte, n)
+	s := splitMix64(n)
+	for i := range data {
+		data[i] = byte(s.Next())
+	}
+	return data
+}
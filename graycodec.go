@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// 帧编码方式，写入 IndexData 以便解码时还原，为空表示二维码
+const (
+	CodecQR    = "qr"
+	CodecGray4 = "gray4"
+	CodecGray8 = "gray8"
+)
+
+var ErrGrayCalibration = errors.New("校准条识别失败")
+
+// ParseCodec 检查帧编码方式，空字符串视为二维码
+func ParseCodec(name string) (string, error) {
+	switch name {
+	case "", CodecQR:
+		return CodecQR, nil
+	case CodecGray4, "4":
+		return CodecGray4, nil
+	case CodecGray8, "8":
+		return CodecGray8, nil
+	case CodecBlock:
+		return CodecBlock, nil
+	}
+	return "", fmt.Errorf("不支持的帧编码方式: %s", name)
+}
+
+// GrayLayout 描述多级灰度符号: Side x Side 个正方形模块，每个模块有 Levels 个灰度等级
+// 第一行与最后一行为校准条，按 0, 1, ..., Levels-1 循环排列各个灰度等级，其余模块按行优先顺序存放数据
+type GrayLayout struct {
+	Levels int
+	Side   int
+}
+
+// GrayLevels 返回帧编码方式对应的灰度等级数
+func GrayLevels(codec string) int {
+	if codec == CodecGray8 {
+		return 8
+	}
+	return 4
+}
+
+// NewGrayLayout 返回能容纳 frameLen 字节且边长不小于 minSide 个模块的最小符号
+func NewGrayLayout(levels int, frameLen int, minSide int) GrayLayout {
+	l := GrayLayout{Levels: levels}
+	modules := (frameLen*8 + l.Bits() - 1) / l.Bits()
+	side := 2
+	for side*(side-2) < modules {
+		side++
+	}
+	if side < minSide {
+		side = minSide
+	}
+	l.Side = side
+	return l
+}
+
+// Bits 返回每个模块承载的比特数
+func (l GrayLayout) Bits() int {
+	return int(math.Log2(float64(l.Levels)))
+}
+
+// Capacity 返回符号可以容纳的字节数
+func (l GrayLayout) Capacity() int {
+	return l.Side * (l.Side - 2) * l.Bits() / 8
+}
+
+// levelValue 返回灰度等级对应的像素值
+func (l GrayLayout) levelValue(level int) uint8 {
+	return uint8(level * 255 / (l.Levels - 1))
+}
+
+// grayCode 与 grayDecode 在等级与比特之间使用格雷码，相邻等级的误判只影响一个比特
+func grayCode(v int) int {
+	return v ^ (v >> 1)
+}
+
+func grayDecode(g int) int {
+	v := 0
+	for ; g != 0; g >>= 1 {
+		v ^= g
+	}
+	return v
+}
+
+// GrayEncode 将帧数据绘制为多级灰度符号，moduleSize 为每个模块的像素大小
+func GrayEncode(data []byte, l GrayLayout, moduleSize int) (*image.Gray, error) {
+	if len(data) > l.Capacity() {
+		return nil, fmt.Errorf("帧数据长度 %d 超出符号容量 %d", len(data), l.Capacity())
+	}
+	levels := make([]int, l.Side*l.Side)
+	for x := 0; x < l.Side; x++ {
+		levels[x] = x % l.Levels
+		levels[(l.Side-1)*l.Side+x] = x % l.Levels
+	}
+	bits := l.Bits()
+	var acc, n uint
+	pos := l.Side
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		n += 8
+		for n >= uint(bits) {
+			n -= uint(bits)
+			levels[pos] = grayDecode(int(acc>>n) & (l.Levels - 1))
+			pos++
+		}
+	}
+	if n > 0 {
+		levels[pos] = grayDecode(int(acc<<(uint(bits)-n)) & (l.Levels - 1))
+	}
+	img := image.NewGray(image.Rect(0, 0, l.Side*moduleSize, l.Side*moduleSize))
+	for y := 0; y < l.Side; y++ {
+		for x := 0; x < l.Side; x++ {
+			v := l.levelValue(levels[y*l.Side+x])
+			for py := y * moduleSize; py < (y+1)*moduleSize; py++ {
+				row := img.Pix[py*img.Stride:]
+				for px := x * moduleSize; px < (x+1)*moduleSize; px++ {
+					row[px] = v
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+// sampleModule 返回模块中心区域的平均亮度，符号按比例铺满整个图像，可以容忍视频被缩放
+func sampleModule(img image.Image, l GrayLayout, x int, y int) float64 {
+	b := img.Bounds()
+	mw := float64(b.Dx()) / float64(l.Side)
+	mh := float64(b.Dy()) / float64(l.Side)
+	cx := b.Min.X + int((float64(x)+0.5)*mw)
+	cy := b.Min.Y + int((float64(y)+0.5)*mh)
+	rx := int(mw / 4)
+	ry := int(mh / 4)
+	var sum float64
+	count := 0
+	for py := cy - ry; py <= cy+ry; py++ {
+		for px := cx - rx; px <= cx+rx; px++ {
+			sum += float64(color.GrayModel.Convert(img.At(px, py)).(color.Gray).Y)
+			count++
+		}
+	}
+	return sum / float64(count)
+}
+
+// GrayThresholds 根据校准条计算相邻灰度等级之间的判决门限
+func GrayThresholds(img image.Image, l GrayLayout) ([]float64, error) {
+	sums := make([]float64, l.Levels)
+	counts := make([]int, l.Levels)
+	for _, y := range []int{0, l.Side - 1} {
+		for x := 0; x < l.Side; x++ {
+			sums[x%l.Levels] += sampleModule(img, l, x, y)
+			counts[x%l.Levels]++
+		}
+	}
+	thresholds := make([]float64, l.Levels-1)
+	for level := 0; level < l.Levels-1; level++ {
+		if counts[level] == 0 || counts[level+1] == 0 {
+			return nil, ErrGrayCalibration
+		}
+		low := sums[level] / float64(counts[level])
+		high := sums[level+1] / float64(counts[level+1])
+		if high <= low {
+			return nil, ErrGrayCalibration
+		}
+		thresholds[level] = (low + high) / 2
+	}
+	return thresholds, nil
+}
+
+// GrayDecode 读取多级灰度符号中的帧数据，按帧头中的长度截取
+func GrayDecode(img image.Image, l GrayLayout) ([]byte, error) {
+	thresholds, err := GrayThresholds(img, l)
+	if err != nil {
+		return nil, err
+	}
+	bits := l.Bits()
+	data := make([]byte, 0, l.Capacity())
+	var acc, n uint
+	for y := 1; y < l.Side-1; y++ {
+		for x := 0; x < l.Side; x++ {
+			v := sampleModule(img, l, x, y)
+			level := 0
+			for level < len(thresholds) && v > thresholds[level] {
+				level++
+			}
+			acc = acc<<uint(bits) | uint(grayCode(level))
+			n += uint(bits)
+			if n >= 8 {
+				n -= 8
+				data = append(data, byte(acc>>n))
+			}
+		}
+	}
+	if len(data) < FrameHeaderLen {
+		return nil, ErrNotFrame
+	}
+	total := FrameHeaderLen + int(binary.BigEndian.Uint16(data[11:13])) + FrameCRCLen
+	if total > len(data) {
+		return nil, fmt.Errorf("帧长度超出符号容量: %d", total)
+	}
+	return data[:total], nil
+}
+
+// GrayModuleSize 由二维码大小参数确定灰度符号的模块像素大小，负数表示每个模块的像素数
+func GrayModuleSize(qrcodeSize int) int {
+	if qrcodeSize < 0 {
+		return -qrcodeSize
+	}
+	return 8
+}
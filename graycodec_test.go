@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// scaleImage 按最近邻缩放图像
+func scaleImage(img *image.Gray, w int, h int) *image.Gray {
+	b := img.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Pix[y*dst.Stride+x] = img.GrayAt(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h).Y
+		}
+	}
+	return dst
+}
+
+// addNoise 为每个像素加上确定性的噪声，幅度不超过 amount
+func addNoise(img *image.Gray, amount int) *image.Gray {
+	dst := image.NewGray(img.Bounds())
+	s := splitMix64(amount)
+	for i, v := range img.Pix {
+		n := int(v) + s.Intn(2*amount+1) - amount
+		if n < 0 {
+			n = 0
+		} else if n > 255 {
+			n = 255
+		}
+		dst.Pix[i] = uint8(n)
+	}
+	return dst
+}
+
+func TestGrayCodecRoundTrip(t *testing.T) {
+	const moduleSize = 6
+	frame := MarshalFrame(FrameHeader{Kind: FrameKindData, FileID: [4]byte{1, 6, 1, 8}, Seq: 3}, testData(301))
+	// setModule 将第 y 行第 x 个模块涂成指定的像素值
+	setModule := func(img *image.Gray, x, y int, v uint8) {
+		for py := y * moduleSize; py < (y+1)*moduleSize; py++ {
+			for px := x * moduleSize; px < (x+1)*moduleSize; px++ {
+				img.Pix[py*img.Stride+px] = v
+			}
+		}
+	}
+	tests := []struct {
+		name      string
+		codec     string
+		transform func(img *image.Gray, l GrayLayout) *image.Gray
+		err       error
+	}{
+		{"gray4", CodecGray4, nil, nil},
+		{"gray8", CodecGray8, nil, nil},
+		{"gray4 scaled", CodecGray4, func(img *image.Gray, l GrayLayout) *image.Gray {
+			return scaleImage(img, img.Bounds().Dx()*5/3, img.Bounds().Dy()*5/3)
+		}, nil},
+		{"gray8 noise", CodecGray8, func(img *image.Gray, l GrayLayout) *image.Gray { return addNoise(img, 12) }, nil},
+		{"gray4 noise", CodecGray4, func(img *image.Gray, l GrayLayout) *image.Gray { return addNoise(img, 35) }, nil},
+		// 灰度符号本身没有纠错，误判的模块由帧的 CRC 发现
+		{"flipped module", CodecGray4, func(img *image.Gray, l GrayLayout) *image.Gray {
+			v := img.GrayAt(5*moduleSize, 4*moduleSize).Y
+			setModule(img, 5, 4, 255-v)
+			return img
+		}, ErrFrameChecksum},
+		{"calibration lost", CodecGray8, func(img *image.Gray, l GrayLayout) *image.Gray {
+			for x := 0; x < l.Side; x++ {
+				setModule(img, x, 0, 0)
+				setModule(img, x, l.Side-1, 0)
+			}
+			return img
+		}, ErrGrayCalibration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, err := ParseCodec(tt.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := NewGrayLayout(GrayLevels(codec), len(frame), 0)
+			img, err := GrayEncode(frame, l, moduleSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.transform != nil {
+				img = tt.transform(img, l)
+			}
+			got, err := GrayDecode(img, l)
+			if err == nil {
+				_, _, err = UnmarshalFrame(got, FrameVersion)
+			}
+			if err != tt.err {
+				t.Fatalf("错误 %v, 期望 %v", err, tt.err)
+			}
+			if tt.err == nil && !bytes.Equal(got, frame) {
+				t.Fatal("解码的帧数据不一致")
+			}
+		})
+	}
+}
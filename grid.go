@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"github.com/makiuchi-d/gozxing"
+	qrmulti "github.com/makiuchi-d/gozxing/multi/qrcode"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// GridMax 为每行或每列最多放置的二维码数量
+const GridMax = 8
+
+// ParseGrid 解析 "列x行" 形式的网格布局，空字符串视为 1x1
+func ParseGrid(s string) (int, int, error) {
+	if s == "" {
+		return 1, 1, nil
+	}
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("无效的网格布局: %s", s)
+	}
+	cols, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("无效的网格布局: %s", s)
+	}
+	rows, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("无效的网格布局: %s", s)
+	}
+	if cols < 1 || rows < 1 || cols > GridMax || rows > GridMax {
+		return 0, 0, fmt.Errorf("网格布局的行列数需要在 1-%d 之间: %s", GridMax, s)
+	}
+	return cols, rows, nil
+}
+
+// FrameCanvas 将一个或多个符号排列到视频帧中
+type FrameCanvas interface {
+	Compose(tiles []image.Image) image.Image
+	Center(img image.Image) image.Image
+}
+
+// GridCanvas 描述每个视频帧中二维码的网格布局，每个二维码居中放置在大小相同的格子中
+type GridCanvas struct {
+	Cols int
+	Rows int
+	Cell int
+}
+
+// NewGridCanvas 根据数据二维码与索引二维码的大小确定格子大小，保证索引二维码也能完整放入画布
+func NewGridCanvas(cols int, rows int, tile image.Rectangle, index image.Rectangle) *GridCanvas {
+	cell := tile.Dx()
+	if tile.Dy() > cell {
+		cell = tile.Dy()
+	}
+	if c := (index.Dx() + cols - 1) / cols; c > cell {
+		cell = c
+	}
+	if c := (index.Dy() + rows - 1) / rows; c > cell {
+		cell = c
+	}
+	return &GridCanvas{Cols: cols, Rows: rows, Cell: cell}
+}
+
+func (g *GridCanvas) blank() *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Cols*g.Cell, g.Rows*g.Cell))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	return canvas
+}
+
+// place 将 img 居中绘制到 cell 区域中
+func place(canvas *image.RGBA, cell image.Rectangle, img image.Image) {
+	b := img.Bounds()
+	// 偏移取偶数，使二维码模块与 4:2:0 色度子采样的 2x2 块对齐
+	offset := image.Pt(cell.Min.X+(cell.Dx()-b.Dx())/4*2, cell.Min.Y+(cell.Dy()-b.Dy())/4*2)
+	draw.Draw(canvas, image.Rectangle{Min: offset, Max: offset.Add(b.Size())}, img, b.Min, draw.Src)
+}
+
+// Compose 按行优先顺序将多个二维码放入网格，不足的格子留白
+func (g *GridCanvas) Compose(tiles []image.Image) image.Image {
+	canvas := g.blank()
+	for t, tile := range tiles {
+		x, y := t%g.Cols, t/g.Cols
+		place(canvas, image.Rect(x*g.Cell, y*g.Cell, (x+1)*g.Cell, (y+1)*g.Cell), tile)
+	}
+	return canvas
+}
+
+// Center 将单个二维码(索引二维码)居中放入画布
+func (g *GridCanvas) Center(img image.Image) image.Image {
+	canvas := g.blank()
+	place(canvas, canvas.Bounds(), img)
+	return canvas
+}
+
+// CenterCanvas 将图像居中放入 width x height 的白色画布，用于索引二维码与灰度符号、块编码符号大小一致
+func CenterCanvas(img image.Image, width int, height int) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	place(canvas, canvas.Bounds(), img)
+	return canvas
+}
+
+// GridCells 将视频帧按网格切分为各个格子
+func GridCells(img image.Image, cols int, rows int) []image.Image {
+	b := img.Bounds()
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	cells := make([]image.Image, 0, cols*rows)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			r := image.Rect(b.Min.X+b.Dx()*x/cols, b.Min.Y+b.Dy()*y/rows, b.Min.X+b.Dx()*(x+1)/cols, b.Min.Y+b.Dy()*(y+1)/rows)
+			if ok {
+				cells = append(cells, sub.SubImage(r))
+				continue
+			}
+			cell := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+			draw.Draw(cell, cell.Bounds(), img, r.Min, draw.Src)
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// IsBlankCell 判断格子是否为留白(最后一帧中没有放置二维码的格子)
+func IsBlankCell(img image.Image) bool {
+	b := img.Bounds()
+	stepX := b.Dx()/64 + 1
+	stepY := b.Dy()/64 + 1
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if (r+g+bl)/3 < 0x8000 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// QrDecodeMulti 使用 gozxing 的多二维码识别器识别整个视频帧，只返回通过校验的结果
+func QrDecodeMulti(img image.Image, validate FrameValidator, payload string) [][]byte {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return nil
+	}
+	results, err := qrmulti.NewQRCodeMultiReader().DecodeMultiple(bmp, payloadDecodeHints(payload))
+	if err != nil {
+		return nil
+	}
+	symbols := make([][]byte, 0, len(results))
+	for _, result := range results {
+		data, err := DecodePayloadText(result.GetText(), payload)
+		if err != nil {
+			continue
+		}
+		if validate != nil && validate(data) != nil {
+			continue
+		}
+		symbols = append(symbols, data)
+	}
+	return symbols
+}
+
+// DecodeGridFrame 识别视频帧中的所有二维码
+// 识别链以 gozxing 开始时先用多二维码识别器识别整帧，未能识别全部二维码时再按网格逐格识别，多二维码识别器只支持 QR 码，其他制式直接逐格识别
+// 逐格识别只使用识别链中的第一个识别方式，返回识别结果、需要交给后备识别的 QR 码与无法识别的格子数
+func DecodeGridFrame(img image.Image, i int, cols int, rows int, resizeTimes float64, validate FrameValidator, payload string, symbol string, chain *DecoderChain) ([][]byte, []image.Image, int) {
+	cells := GridCells(img, cols, rows)
+	tiles := 0
+	for _, cell := range cells {
+		if !IsBlankCell(cell) {
+			tiles++
+		}
+	}
+	var symbols [][]byte
+	if symbol == SymbolQR && chain.First() == DecoderGozxing {
+		symbols = QrDecodeMulti(ResizeImage(img, resizeTimes), validate, payload)
+		if len(symbols) == tiles {
+			return symbols, nil, 0
+		}
+		symbols = symbols[:0]
+	}
+	var failed []image.Image
+	unreadable := 0
+	for t, cell := range cells {
+		if IsBlankCell(cell) {
+			continue
+		}
+		resized := ResizeImage(cell, resizeTimes)
+		if symbol == SymbolQR {
+			data, err := chain.DecodeFast(resized, validate, payload)
+			if err != nil {
+				if !chain.HasRest() {
+					fmt.Fprintln(chain.Log(), de, "第", i, "帧第", t, "个二维码无法识别:", err)
+					unreadable++
+					continue
+				}
+				failed = append(failed, resized)
+				continue
+			}
+			symbols = append(symbols, data)
+			continue
+		}
+		data := SymbolDecode(resized, i, symbol, validate, payload, chain.Log())
+		if data == nil {
+			fmt.Fprintln(chain.Log(), de, "第", i, "帧第", t, "个二维码无法识别")
+			unreadable++
+			continue
+		}
+		symbols = append(symbols, data)
+	}
+	return symbols, failed, unreadable
+}
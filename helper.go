@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// helperMaxResults 与 helperMaxResultLen 限制单个响应的大小，防止错误的响应导致分配过多内存
+	helperMaxResults   = 64
+	helperMaxResultLen = 1 << 20
+	// helperExitTimeout 为关闭标准输入后等待辅助进程退出的时间
+	helperExitTimeout = 5 * time.Second
+	// helperMaxRestarts 为通信失败后重启辅助进程的最大次数
+	helperMaxRestarts = 1
+)
+
+// DefaultHelperCommand 返回默认的辅助进程命令: 使用 Python 运行程序目录下的 lumina_qrcode.py
+func DefaultHelperCommand() ([]string, error) {
+	f, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("获取当前程序的执行文件路径失败: %v", err)
+	}
+	script := filepath.Join(filepath.Dir(f), "lumina_qrcode.py")
+	if !FileExists(script) {
+		return nil, errors.New("Python脚本不存在，跳过检测")
+	}
+	// 检测操作系统
+	pyName := "python3"
+	if runtime.GOOS == "windows" {
+		pyName = "python"
+	}
+	return []string{pyName, script}, nil
+}
+
+// ParseHelperCommand 按 shell 的规则分隔辅助进程命令，空字符串表示使用默认命令
+// 空白分隔参数，单引号内的内容原样保留，双引号内可以用反斜杠转义双引号与反斜杠；
+// 引号外的反斜杠转义下一个字符，Windows 上引号外的反斜杠为路径分隔符，原样保留
+func ParseHelperCommand(s string) ([]string, error) {
+	args := make([]string, 0)
+	var arg strings.Builder
+	inArg := false
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteByte(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+				arg.WriteByte(s[i])
+			} else {
+				arg.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\' && i+1 < len(s) && runtime.GOOS != "windows":
+			i++
+			arg.WriteByte(s[i])
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("辅助进程命令中的引号不匹配: %s", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// DecoderHelper 为常驻的外部识别进程，一个进程依次识别所有视频帧，第一次使用时启动
+// 请求: 大端序的 uint32 宽、uint32 高与逐行排列的 8 位灰度像素
+// 响应: 大端序的 uint32 结果个数，每个结果为 uint32 长度与二维码中的原始字节，没有识别到二维码时结果个数为 0
+// 通信出错时重启一次进程并重新发送该请求，进程启动失败或重启后再次出错时不再重启，之后的请求直接返回该错误
+type DecoderHelper struct {
+	command  []string
+	log      io.Writer
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	err      error
+	restarts int
+}
+
+// NewDecoderHelper 创建辅助进程，log 为启动与重启提示的输出位置
+func NewDecoderHelper(command []string, log io.Writer) *DecoderHelper {
+	return &DecoderHelper{command: command, log: log}
+}
+
+func (h *DecoderHelper) start() error {
+	if len(h.command) == 0 {
+		return errors.New("辅助进程命令为空")
+	}
+	cmd := exec.Command(h.command[0], h.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("无法创建辅助进程标准输入管道: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("无法创建辅助进程标准输出管道: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("无法启动辅助进程: %v", err)
+	}
+	fmt.Fprintln(h.log, de, "已启动识别辅助进程:", strings.Join(h.command, " "))
+	h.cmd, h.stdin, h.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// Decode 将图像转换为灰度后发送给辅助进程，返回识别出的所有结果
+func (h *DecoderHelper) Decode(img image.Image) ([][]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.err != nil {
+		return nil, h.err
+	}
+	if h.cmd == nil {
+		if err := h.start(); err != nil {
+			h.err = err
+			return nil, err
+		}
+	}
+	results, err := h.exchange(img)
+	if err != nil && h.restarts < helperMaxRestarts {
+		h.restarts++
+		fmt.Fprintln(h.log, de, "识别辅助进程通信失败，正在重启:", err)
+		h.stop()
+		if err := h.start(); err != nil {
+			h.err = err
+			return nil, err
+		}
+		results, err = h.exchange(img)
+	}
+	if err != nil {
+		h.err = fmt.Errorf("辅助进程通信失败: %v", err)
+		h.stop()
+		return nil, h.err
+	}
+	return results, nil
+}
+
+// Restarts 返回辅助进程因通信失败重启的次数
+func (h *DecoderHelper) Restarts() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.restarts
+}
+
+func (h *DecoderHelper) exchange(img image.Image) ([][]byte, error) {
+	b := img.Bounds()
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(header[4:8], uint32(b.Dy()))
+	if _, err := h.stdin.Write(append(header, GrayBytes(img)...)); err != nil {
+		return nil, err
+	}
+	var count uint32
+	if err := binary.Read(h.stdout, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if count > helperMaxResults {
+		return nil, fmt.Errorf("结果个数过多: %d", count)
+	}
+	results := make([][]byte, 0, count)
+	for k := uint32(0); k < count; k++ {
+		var n uint32
+		if err := binary.Read(h.stdout, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		if n > helperMaxResultLen {
+			return nil, fmt.Errorf("结果长度过大: %d", n)
+		}
+		result := make([]byte, n)
+		if _, err := io.ReadFull(h.stdout, result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// stop 关闭标准输入让辅助进程退出，超时后强制结束
+func (h *DecoderHelper) stop() error {
+	if h.cmd == nil {
+		return nil
+	}
+	_ = h.stdin.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(helperExitTimeout):
+		_ = h.cmd.Process.Kill()
+		err = <-done
+	}
+	h.cmd = nil
+	return err
+}
+
+// Close 结束辅助进程
+func (h *DecoderHelper) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.err == nil {
+		h.err = errors.New("辅助进程已关闭")
+	}
+	return h.stop()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// helperTestEnv 指定测试程序作为识别辅助进程运行时的行为
+const helperTestEnv = "LUMINA_TEST_HELPER"
+
+// TestHelperProcess 不是真正的测试，由 DecoderHelper 以子进程方式启动，按辅助进程协议回复请求:
+// echo 返回图像尺寸与像素两个结果，纯白图像返回 0 个结果；crash 收到请求后直接退出；
+// crash-once 在第一次启动时退出，重启后与 echo 相同；oversize 返回过多的结果个数；truncated 返回不完整的结果
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv(helperTestEnv)
+	if mode == "" {
+		return
+	}
+	if mode == "crash-once" {
+		marker := os.Getenv(helperTestEnv + "_MARKER")
+		if !FileExists(marker) {
+			_ = os.WriteFile(marker, nil, 0644)
+			mode = "crash"
+		} else {
+			mode = "echo"
+		}
+	}
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			os.Exit(0)
+		}
+		pixels := make([]byte, binary.BigEndian.Uint32(header[0:4])*binary.BigEndian.Uint32(header[4:8]))
+		if _, err := io.ReadFull(r, pixels); err != nil {
+			os.Exit(1)
+		}
+		switch mode {
+		case "crash":
+			os.Exit(1)
+		case "oversize":
+			_ = binary.Write(w, binary.BigEndian, uint32(helperMaxResults+1))
+		case "truncated":
+			_ = binary.Write(w, binary.BigEndian, uint32(1))
+			_ = binary.Write(w, binary.BigEndian, uint32(10))
+			_, _ = w.WriteString("abc")
+			_ = w.Flush()
+			os.Exit(0)
+		default:
+			if bytes.Count(pixels, []byte{0xff}) == len(pixels) {
+				_ = binary.Write(w, binary.BigEndian, uint32(0))
+				break
+			}
+			_ = binary.Write(w, binary.BigEndian, uint32(2))
+			for _, result := range [][]byte{header, pixels} {
+				_ = binary.Write(w, binary.BigEndian, uint32(len(result)))
+				_, _ = w.Write(result)
+			}
+		}
+		_ = w.Flush()
+	}
+}
+
+func TestDecoderHelper(t *testing.T) {
+	command := []string{os.Args[0], "-test.run=^TestHelperProcess$"}
+	img := image.NewGray(image.Rect(0, 0, 5, 3))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 16)
+	}
+	white := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	tests := []struct {
+		mode     string
+		err      bool
+		restarts int
+	}{
+		{"echo", false, 0},
+		{"crash-once", false, 1},
+		{"crash", true, 1},
+		{"oversize", true, 1},
+		{"truncated", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv(helperTestEnv, tt.mode)
+			t.Setenv(helperTestEnv+"_MARKER", filepath.Join(t.TempDir(), "started"))
+			h := NewDecoderHelper(command, io.Discard)
+			defer h.Close()
+			for round := 0; round < 2; round++ {
+				results, err := h.Decode(img)
+				if tt.err {
+					if err == nil {
+						t.Fatal("辅助进程出错时没有返回错误")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != 2 || !bytes.Equal(results[0], []byte{0, 0, 0, 5, 0, 0, 0, 3}) || !bytes.Equal(results[1], img.Pix) {
+					t.Fatalf("识别结果 %x", results)
+				}
+				results, err = h.Decode(white)
+				if err != nil || len(results) != 0 {
+					t.Fatalf("纯白图像的识别结果 %x %v", results, err)
+				}
+			}
+			if h.Restarts() != tt.restarts {
+				t.Errorf("重启次数 %d, 期望 %d", h.Restarts(), tt.restarts)
+			}
+		})
+	}
+}
+
+func TestParseHelperCommand(t *testing.T) {
+	tests := []struct {
+		s    string
+		args []string
+		err  bool
+	}{
+		{"", []string{}, false},
+		{"python3 lumina_qrcode.py", []string{"python3", "lumina_qrcode.py"}, false},
+		{"  python3\t-u  script.py \n", []string{"python3", "-u", "script.py"}, false},
+		{`"C:/Program Files/py.exe" 'a b' c`, []string{"C:/Program Files/py.exe", "a b", "c"}, false},
+		{`'it''s' "" x`, []string{"its", "", "x"}, false},
+		{`"say \"hi\" \\ \n"`, []string{`say "hi" \ \n`}, false},
+		{`'a\"b'`, []string{`a\"b`}, false},
+		{`a"b c"d`, []string{"ab cd"}, false},
+		{`"unterminated`, nil, true},
+		{`'open`, nil, true},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			s    string
+			args []string
+			err  bool
+		}{`a\ b \"c`, []string{"a b", `"c`}, false})
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			args, err := ParseHelperCommand(tt.s)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("解析为 %q, 期望返回错误", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(args) != len(tt.args) {
+				t.Fatalf("解析为 %q, 期望 %q", args, tt.args)
+			}
+			for i := range args {
+				if args[i] != tt.args[i] {
+					t.Fatalf("解析为 %q, 期望 %q", args, tt.args)
+				}
+			}
+		})
+	}
+}
@@ -1,24 +1,78 @@
-import base64
+import struct
 import sys
 
 from PIL import Image
 from pyzbar import pyzbar
 
+# 常驻的识别辅助进程，由 lumina 启动，一个进程依次识别所有视频帧
+# 请求: 大端序的 uint32 宽、uint32 高与逐行排列的 8 位灰度像素
+# 响应: 大端序的 uint32 结果个数，每个结果为 uint32 长度与二维码中的原始字节，没有识别到二维码时结果个数为 0
+# 提示信息输出到标准错误，标准输入关闭时退出
 
-if __name__ == "__main__":
-    image = Image.open(sys.argv[1])
-    gray_image = image.convert('L')
-    width, height = gray_image.size
+
+def binary_candidates(data):
+    # zbar 会猜测字节模式的字符集并转换为 UTF-8，这里尝试还原出所有可能的原始字节
+    candidates = [data]
+    try:
+        text = data.decode("utf-8")
+    except UnicodeDecodeError:
+        return candidates
+    for encoding in ("latin-1", "shift_jis", "gb18030"):
+        try:
+            raw = text.encode(encoding)
+        except UnicodeEncodeError:
+            continue
+        if raw not in candidates:
+            candidates.append(raw)
+    return candidates
+
+
+def read_exact(stream, n):
+    data = b""
+    while len(data) < n:
+        chunk = stream.read(n - len(data))
+        if not chunk:
+            return None
+        data += chunk
+    return data
+
+
+def decode(width, height, pixels):
+    if width == 0 or height == 0:
+        return []
+    gray_image = Image.frombytes("L", (width, height), pixels)
     updated_image = gray_image.resize((width * 4, height * 4))
     barcodes = pyzbar.decode(updated_image, symbols=[pyzbar.ZBarSymbol.QRCODE])
     if len(barcodes) > 1:
-        print("检测到多个二维码，数据可能损坏")
-    if len(barcodes) == 0:
-        print("未检测到二维码，数据可能损坏")
+        sys.stderr.write("检测到多个二维码，数据可能损坏\n")
+    results = []
     for barcode in barcodes:
+        for candidate in binary_candidates(barcode.data):
+            if candidate not in results:
+                results.append(candidate)
+    return results
+
+
+def serve(stdin, stdout):
+    while True:
+        header = read_exact(stdin, 8)
+        if header is None:
+            return
+        width, height = struct.unpack(">II", header)
+        pixels = read_exact(stdin, width * height)
+        if pixels is None:
+            return
         try:
-            base64.b64decode(barcode.data)
-            sys.stdout.write(barcode.data.decode())
-            sys.stdout.flush()
-        except:
-            continue
+            results = decode(width, height, pixels)
+        except Exception as e:
+            sys.stderr.write("识别失败: %s\n" % e)
+            results = []
+        stdout.write(struct.pack(">I", len(results)))
+        for result in results:
+            stdout.write(struct.pack(">I", len(result)))
+            stdout.write(result)
+        stdout.flush()
+
+
+if __name__ == "__main__":
+    serve(sys.stdin.buffer, sys.stdout.buffer)
@@ -2,22 +2,19 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/cheggaaa/pb/v3"
-	"github.com/liyue201/goqr"
-	"github.com/makiuchi-d/gozxing"
-	qrdecode1 "github.com/makiuchi-d/gozxing/qrcode"
 	"github.com/nfnt/resize"
 	qrencode "github.com/skip2/go-qrcode"
+	"golang.org/x/term"
 	"image"
-	"image/color"
-	"image/png"
 	"io"
 	"math"
 	"os"
@@ -28,6 +25,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,6 +39,45 @@ type IndexData struct {
 	Len     int    `json:"len"`
 	Resize  int    `json:"resize"`
 	Summary string `json:"summary"`
+	Version int    `json:"version,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Slice   int    `json:"slice,omitempty"`
+	// 喷泉码冗余比例与每个源块的源符号数，0 表示未使用喷泉码
+	Fountain  float64 `json:"fountain,omitempty"`
+	FountainK int     `json:"fountain_k,omitempty"`
+	// 每组数据帧数与校验帧数，0 表示未使用校验帧
+	ParityN int `json:"parity_n,omitempty"`
+	ParityK int `json:"parity_k,omitempty"`
+	// 加密算法与密钥派生参数，nil 表示未加密
+	Crypt *CryptParams `json:"crypt,omitempty"`
+	// 压缩算法与压缩前的长度，为空表示未压缩
+	Compress string `json:"compress,omitempty"`
+	RawSize  int64  `json:"raw_size,omitempty"`
+	// 数据帧在二维码中的编码方式，为空表示 Base64
+	Payload string `json:"payload,omitempty"`
+	// 数据帧使用的二维码制式，为空表示 QR 码
+	Symbol string `json:"symbol,omitempty"`
+	// 每个视频帧中二维码网格的列数与行数，0 表示每帧一个二维码
+	GridCols int `json:"grid_cols,omitempty"`
+	GridRows int `json:"grid_rows,omitempty"`
+	// 彩色模式: R、G、B 通道各放置一组独立的二维码
+	Color bool `json:"color,omitempty"`
+	// 帧编码方式与灰度符号的边长(模块数)，为空表示二维码
+	Codec    string `json:"codec,omitempty"`
+	GraySide int    `json:"gray_side,omitempty"`
+	// 块编码符号的列数、行数(单元格)与每个码字的纠错字节数
+	BlockCols int `json:"block_cols,omitempty"`
+	BlockRows int `json:"block_rows,omitempty"`
+	BlockECC  int `json:"block_ecc,omitempty"`
+	// 固定分辨率画布的布局，为空表示视频分辨率由符号大小决定
+	Canvas *CanvasLayout `json:"canvas,omitempty"`
+	// 数据帧帧头中的文件标识(十六进制)，为空表示取文件 Hash 的前 4 字节
+	FileID string `json:"file_id,omitempty"`
+	// 索引帧位于每段的最后一帧，只有最后一段的索引包含 Hash、长度与签名，其余分段按文件标识归入该文件
+	Trailing bool `json:"trailing,omitempty"`
+	// 签名者公钥与 Ed25519 签名，为空表示未签名
+	Signer    string `json:"signer,omitempty"`
+	Signature string `json:"sig,omitempty"`
 }
 
 type IndexReadData struct {
@@ -51,6 +88,31 @@ type IndexReadData struct {
 	Len        int
 	Resize     int
 	Summary    string
+	Version    int
+	Size       int64
+	Slice      int
+	Fountain   float64
+	FountainK  int
+	ParityN    int
+	ParityK    int
+	Crypt      *CryptParams
+	Compress   string
+	RawSize    int64
+	Payload    string
+	Symbol     string
+	GridCols   int
+	GridRows   int
+	Color      bool
+	Codec      string
+	GraySide   int
+	BlockCols  int
+	BlockRows  int
+	BlockECC   int
+	Canvas     *CanvasLayout
+	FileID     string
+	Trailing   bool
+	Signature  string
+	signed     []byte
 	Path       []string
 }
 
@@ -90,27 +152,67 @@ func CalculateFileHash(filePath string) (string, error) {
 	return hashString, nil
 }
 
+// ResizeImage 按倍数缩放图像，倍数为 1 时直接返回原图
+// 灰度图像按整数倍缩小时取块内平均值，其他倍数使用最近邻插值(整数倍放大即复制像素)
 func ResizeImage(img image.Image, x float64) image.Image {
-	width := uint(float64(img.Bounds().Dx()) * x)
-	height := uint(float64(img.Bounds().Dy()) * x)
-	resizedImg := resize.Resize(width, height, img, resize.Lanczos3)
-	return resizedImg
+	if x == 1 {
+		return img
+	}
+	b := img.Bounds()
+	width := int(float64(b.Dx()) * x)
+	height := int(float64(b.Dy()) * x)
+	if width <= 0 || height <= 0 {
+		return img
+	}
+	src, ok := img.(*image.Gray)
+	if !ok {
+		return resize.Resize(uint(width), uint(height), img, resize.NearestNeighbor)
+	}
+	dst := image.NewGray(image.Rect(0, 0, width, height))
+	if n := math.Round(1 / x); n >= 2 && math.Abs(1/x-n) < 1e-9 {
+		k := int(n)
+		for y := 0; y < height; y++ {
+			row := dst.Pix[y*dst.Stride:]
+			for dx := 0; dx < width; dx++ {
+				sum := 0
+				for sy := 0; sy < k; sy++ {
+					i := src.PixOffset(b.Min.X+dx*k, b.Min.Y+y*k+sy)
+					for _, v := range src.Pix[i : i+k] {
+						sum += int(v)
+					}
+				}
+				row[dx] = uint8(sum / (k * k))
+			}
+		}
+		return dst
+	}
+	cols := make([]int, width)
+	for dx := range cols {
+		cols[dx] = dx * b.Dx() / width
+	}
+	for y := 0; y < height; y++ {
+		line := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y*b.Dy()/height):]
+		row := dst.Pix[y*dst.Stride:]
+		for dx, sx := range cols {
+			row[dx] = line[sx]
+		}
+	}
+	return dst
 }
 
 func RawDataToImage(rawData []byte, width, height int) image.Image {
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			offset := ((y * width) + x) * 3
-			r := rawData[offset]
-			g := rawData[offset+1]
-			b := rawData[offset+2]
-			img.Set(x, y, color.RGBA{R: r, G: g, B: b, A: 255})
-		}
+	for k, i := 0, 0; k < width*height*3; k, i = k+3, i+4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = rawData[k], rawData[k+1], rawData[k+2], 0xff
 	}
 	return img
 }
 
+// GrayDataToImage 将 FFmpeg 输出的 gray 数据直接作为灰度图像的像素，不复制数据
+func GrayDataToImage(rawData []byte, width, height int) *image.Gray {
+	return &image.Gray{Pix: rawData[:width*height], Stride: width, Rect: image.Rect(0, 0, width, height)}
+}
+
 func FileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
 	if err == nil {
@@ -119,6 +221,11 @@ func FileExists(filePath string) bool {
 	return false
 }
 
+// StdinIsTerminal 判断标准输入是否为终端，不是终端时不能交互询问
+func StdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
 func GetUserInput() string {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Print("请输入内容: ")
@@ -130,6 +237,33 @@ func GetUserInput() string {
 	return strings.TrimSpace(input)
 }
 
+// IndexContent 对索引数据签名并返回写入索引二维码的内容，索引二维码始终使用 Base64
+func IndexContent(indexData IndexData, signingKey ed25519.PrivateKey) (string, error) {
+	if signingKey != nil {
+		if err := SignIndex(&indexData, signingKey); err != nil {
+			return "", fmt.Errorf("无法签名索引数据: %v", err)
+		}
+	}
+	jsonIndexData, err := json.Marshal(indexData)
+	if err != nil {
+		return "", fmt.Errorf("JSON 编码错误: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(jsonIndexData), nil
+}
+
+// BuildIndexImage 对索引数据签名并生成索引二维码
+func BuildIndexImage(indexData IndexData, signingKey ed25519.PrivateKey, qrcodeErrorCorrection int, qrcodeSize int) (image.Image, error) {
+	base64IndexData, err := IndexContent(indexData, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	qt, err := qrencode.New(base64IndexData, qrencode.RecoveryLevel(qrcodeErrorCorrection))
+	if err != nil {
+		return nil, fmt.Errorf("索引数据过长，可减少接收者数量或降低纠错等级: %v", err)
+	}
+	return qt.Image(qrcodeSize), nil
+}
+
 func AddIndexToFileName(path string, index int) string {
 	filename := filepath.Base(path)
 	extension := filepath.Ext(filename)
@@ -213,187 +347,113 @@ func GenerateFileDxDictionary(root string, ex string) (map[int]string, error) {
 	return sortedFileDict, nil
 }
 
-func QrDecodeInput() []byte {
-	var data []byte
-	fmt.Println(de, "错误: 使用程序提供的任何库都无法识别二维码")
-	fmt.Println(de, "二维码图片已保存到运行目录下的 output_lumina.png 文件")
-	fmt.Println(de, "请使用微信/QQ等二维码扫描工具进行扫码，并将扫描到的结果(Base64编码)粘贴到程序并回车")
-	result := GetUserInput()
-	if result == "" {
-		fmt.Println(de, "错误: 用户输入为空")
-		return nil
-	}
-	data, err := base64.StdEncoding.DecodeString(result)
-	if err != nil {
-		fmt.Println(de, "用户输入的字符串无法进行 Base64 解码:", err)
-		return nil
-	}
-	return data
-}
-
-func QrDecodePy(resizedImg image.Image, isInput bool) []byte {
-	var data []byte
-	fmt.Println(de, "使用 golang 库无法识别二维码，尝试使用 pyzbar 库识别二维码")
-	fmt.Println(de, "创建二维码图片文件 output_lumina.png")
-	file, err := os.Create("output_lumina.png")
-	if err != nil {
-		fmt.Println(de, "无法生成错误二维码图片:", err)
-		if isInput {
-			return QrDecodeInput()
-		} else {
-			return nil
-		}
-	}
-	err = png.Encode(file, resizedImg)
-	if err != nil {
-		fmt.Println(de, "无法编码错误二维码图片:", err)
-		if isInput {
-			return QrDecodeInput()
-		} else {
-			return nil
-		}
-	}
-	file.Close()
-	fmt.Println(de, "已将未能识别的二维码图片保存到 output_lumina.png")
-	f, err := os.Executable()
-	if err != nil {
-		fmt.Println("获取当前程序的执行文件路径失败:", err)
-		if isInput {
-			return QrDecodeInput()
-		} else {
-			return nil
-		}
-	}
-	scriptArgs := []string{filepath.Join(filepath.Dir(f), "lumina_qrcode.py"), filepath.Join(filepath.Dir(f), "output_lumina.png")}
-	if FileExists(filepath.Join(filepath.Dir(f), "lumina_qrcode.py")) == false {
-		fmt.Println(de, "Python脚本不存在，跳过检测")
-		if isInput {
-			return QrDecodeInput()
-		} else {
-			return nil
+// DecodeSymbol 按索引中记录的帧编码方式与二维码制式快速识别单个符号，QR 码只使用识别链中的第一个识别方式
+// 多级灰度符号按比例采样，块编码符号由定位图案确定位置，都不需要缩放
+func DecodeSymbol(img image.Image, i int, s IndexReadData, resizeTimes float64, validate FrameValidator, chain *DecoderChain) ([]byte, error) {
+	switch {
+	case s.Codec == CodecBlock:
+		data, _, err := BlockDecode(img, BlockLayout{Cols: s.BlockCols, Rows: s.BlockRows, ECC: s.BlockECC, FrameLen: FrameHeaderLen + s.Slice + FrameCRCLen})
+		if err != nil {
+			return nil, err
 		}
-	}
-	// 检测操作系统
-	pyName := "python"
-	if runtime.GOOS == "windows" {
-		pyName = "python"
-	} else {
-		pyName = "python3"
-	}
-	fmt.Println(de, "开始检测")
-	cmd := exec.Command(pyName, scriptArgs...)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	err = cmd.Run()
-	if err != nil {
-		fmt.Println(de, "Python脚本执行失败:", err)
-		if isInput {
-			return QrDecodeInput()
-		} else {
-			return nil
+		return checkFrame(CodecBlock, data, validate)
+	case s.Codec != CodecQR:
+		data, err := GrayDecode(img, GrayLayout{Levels: GrayLevels(s.Codec), Side: s.GraySide})
+		if err != nil {
+			return nil, err
 		}
-	}
-	result := stdout.String()
-	data, err = base64.StdEncoding.DecodeString(result)
-	if err != nil {
-		fmt.Println(de, "Base64解码失败:", err)
-		if isInput {
-			return QrDecodeInput()
-		} else {
-			return nil
+		return checkFrame(s.Codec, data, validate)
+	case s.Symbol != SymbolQR:
+		data := SymbolDecode(ResizeImage(img, resizeTimes), i, s.Symbol, validate, s.Payload, chain.Log())
+		if data == nil {
+			return nil, errors.New("无法识别二维码")
 		}
+		return data, nil
 	}
-	return data
+	return chain.DecodeFast(ResizeImage(img, resizeTimes), validate, s.Payload)
 }
 
-func QrDecode2(resizedImg image.Image, isInput bool) []byte {
-	var data []byte
-	qrCodes, err := goqr.Recognize(resizedImg)
-	if err != nil {
-		fmt.Printf(de+" goqr 识别失败，使用 pyzbar 库识别: %v\n", err)
-		return QrDecodePy(resizedImg, isInput)
-	}
-	if len(qrCodes) <= 0 {
-		fmt.Printf(de+" goqr 识别失败，使用 pyzbar 库识别: %v\n", err)
-		return QrDecodePy(resizedImg, isInput)
-	}
-	data, err = base64.StdEncoding.DecodeString(string(qrCodes[0].Payload))
-	if err != nil {
-		fmt.Println(de+" Base64解码失败，使用 pyzbar 库识别:", err)
-		return QrDecodePy(resizedImg, isInput)
-	}
-	return data
+// HasFallback 判断识别失败的符号能否交给识别链中其余的识别方式，只有 QR 码可以
+func (s IndexReadData) HasFallback() bool {
+	return s.Codec == CodecQR && s.Symbol == SymbolQR
 }
 
-func QrDecode(resizedImg image.Image, i int, isInput bool) []byte {
-	var data []byte
-	bmp, err := gozxing.NewBinaryBitmapFromImage(resizedImg)
-	if err != nil {
-		fmt.Println(de, "第", i, "帧识别二维码出现错误")
-		fmt.Println(de, "gozxing库: qrcode转bmp失败，尝试使用 goqr 库进行识别:", err)
-		return QrDecode2(resizedImg, isInput)
-	}
-	result, err := qrdecode1.NewQRCodeReader().Decode(bmp, nil)
-	if err != nil {
-		fmt.Println(de, "第", i, "帧识别二维码出现错误")
-		fmt.Println(de, "gozxing 库: 检测二维码失败，尝试使用 goqr 库检测二维码:", err)
-		return QrDecode2(resizedImg, isInput)
+// Found 返回已找到的分段视频个数，流式编码的分段按文件标识归入，可能有分段缺失
+func (s IndexReadData) Found() int {
+	found := 0
+	for _, path := range s.Path {
+		if path != "" {
+			found++
+		}
 	}
-	data, err = base64.StdEncoding.DecodeString(result.GetText())
-	if err != nil {
-		fmt.Println(de, "第", i, "帧识别二维码出现错误")
-		fmt.Println(de, "gozxing 库: Base64解码失败，尝试使用 goqr 库检测二维码:", err)
-		return QrDecode2(resizedImg, isInput)
+	return found
+}
+
+// FrameFileID 返回数据帧帧头中的文件标识，流式编码的文件标识为随机值并写入索引，之前的版本取文件 Hash 的前 4 字节
+func (s IndexReadData) FrameFileID(hash string) [4]byte {
+	if s.FileID != "" {
+		return FileIDFromHash(s.FileID)
 	}
-	return data
+	return FileIDFromHash(hash)
 }
 
-func Encode(fileDir string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeSize int, outputFPS int, segmentSeconds int, encodeFFmpegMode string, encodeSummary string) {
+func Encode(fileDir string, outputPath string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeSize int, outputFPS int, segmentSeconds int, encodeFFmpegMode string, encodeSummary string, fountainRatio float64, parityN int, parityK int, password string, recipients [][]byte, signingKey ed25519.PrivateKey, compression string, payload string, gridCols int, gridRows int, colorMode bool, pixFmt string, codec string, symbol string, canvasWidth int, canvasHeight int, quietZone int, threads int, framePipe string) {
 	// 当没有检测到fileDir时，自动匹配路径
 	if fileDir == "" {
 		fileDir = "."
 	}
 
-	fileDict, err := GenerateFileDictionary(fileDir)
-	if err != nil {
-		fmt.Println(en, "无法生成文件列表:", err)
-		return
-	}
+	// "-" 表示从标准输入读取，不需要选择文件
 	filePathList := make([]string, 0)
-	for {
-		if len(fileDict) == 0 {
-			fmt.Println(en, "当前目录下没有文件，请将需要编码的文件放到当前目录下")
+	if fileDir == StdioPath {
+		filePathList = append(filePathList, StdioPath)
+	} else {
+		fileDict, err := GenerateFileDictionary(fileDir)
+		if err != nil {
+			fmt.Println(en, "无法生成文件列表:", err)
 			return
 		}
-		fmt.Println(en, "请选择需要编码的文件，输入索引并回车来选择")
-		fmt.Println(en, "如果需要编码当前目录下的所有文件，请直接输入回车")
-		for index := 0; index < len(fileDict); index++ {
-			fmt.Println("Encode:", strconv.Itoa(index)+":", fileDict[index])
-		}
-		result := GetUserInput()
-		if result == "" {
-			fmt.Println(en, "注意：开始编码当前目录下的所有文件")
-			for _, filePath := range fileDict {
-				filePathList = append(filePathList, filePath)
+		for {
+			if len(fileDict) == 0 {
+				fmt.Println(en, "当前目录下没有文件，请将需要编码的文件放到当前目录下")
+				return
 			}
-			break
-		} else {
-			index, err := strconv.Atoi(result)
-			if err != nil {
-				fmt.Println(en, "输入索引不是数字，请重新输入")
-				continue
+			fmt.Println(en, "请选择需要编码的文件，输入索引并回车来选择")
+			fmt.Println(en, "如果需要编码当前目录下的所有文件，请直接输入回车")
+			for index := 0; index < len(fileDict); index++ {
+				fmt.Println("Encode:", strconv.Itoa(index)+":", fileDict[index])
 			}
-			if index < 0 || index >= len(fileDict) {
-				fmt.Println(en, "输入索引超出范围，请重新输入")
-				continue
+			result := GetUserInput()
+			if result == "" {
+				fmt.Println(en, "注意：开始编码当前目录下的所有文件")
+				for _, filePath := range fileDict {
+					filePathList = append(filePathList, filePath)
+				}
+				break
+			} else {
+				index, err := strconv.Atoi(result)
+				if err != nil {
+					fmt.Println(en, "输入索引不是数字，请重新输入")
+					continue
+				}
+				if index < 0 || index >= len(fileDict) {
+					fmt.Println(en, "输入索引超出范围，请重新输入")
+					continue
+				}
+				filePathList = append(filePathList, fileDict[index])
+				break
 			}
-			filePathList = append(filePathList, fileDict[index])
-			break
 		}
 	}
+	if outputPath != "" && len(filePathList) > 1 {
+		fmt.Println(en, "指定 -o 时只能编码一个文件")
+		return
+	}
 
-	// 输入摘要
-	if encodeSummary == "" {
+	// 输入摘要，标准输入用于读取数据时不询问
+	if encodeSummary == "" && fileDir == StdioPath {
+		fmt.Println(en, "注意：从标准输入读取数据时不询问摘要，解码时摘要将为空")
+	} else if encodeSummary == "" {
 		fmt.Println(en, "请输入对这些文本的摘要概括，不超过50个字符，回车以继续")
 		encodeSummary = GetUserInput()
 		if encodeSummary == "" {
@@ -401,23 +461,59 @@ func Encode(fileDir string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeS
 		}
 	}
 
+	// closeInput 关闭正在编码的文件，编码中途出错返回时由 defer 调用，正常编码完成时在每次循环末尾调用
+	var closeInput func()
+	defer func() {
+		if closeInput != nil {
+			closeInput()
+		}
+	}()
+	// abortFFmpeg 结束正在编码的 ffmpeg 子进程并删除不完整的视频，编码中途出错返回时由 defer 调用，分段正常完成后置空
+	var abortFFmpeg func()
+	defer func() {
+		if abortFFmpeg != nil {
+			abortFFmpeg()
+		}
+	}()
+
 	// 遍历需要处理的文件列表
 	for fileIndexNum, filePath := range filePathList {
 		fmt.Println(en, "开始编码第", fileIndexNum, "个文件，路径:", filePath)
-		fileData, err := os.ReadFile(filePath)
-		if err != nil {
-			fmt.Println(en, "无法打开文件:", err)
-			return
+		// 输入只读取一遍，标准输入与普通文件相同，数据帧边读取边生成
+		fileName := filepath.Base(filePath)
+		var inputFile *os.File
+		var err error
+		if filePath == StdioPath {
+			fileName = StdinName
+		} else {
+			inputFile, err = os.Open(filePath)
+			if err != nil {
+				fmt.Println(en, "无法打开文件:", err)
+				return
+			}
+			closeInput = func() {
+				inputFile.Close()
+			}
 		}
-		// 计算文件Hash
-		InputFileHash, err := CalculateFileHash(filePath)
-		if err != nil {
-			fmt.Println(en, "无法计算输入文件Hash:", err)
-			return
+		var input *bufio.Reader
+		if inputFile != nil {
+			input = bufio.NewReaderSize(inputFile, compressSampleLen)
+		} else {
+			input = bufio.NewReaderSize(os.Stdin, compressSampleLen)
 		}
 
-		outputFilePath := AddOutputToFileName(filePath) // 输出文件路径
-		if _, err := os.Stat(filepath.Dir(outputFilePath)); err == nil {
+		outputFilePath := AddOutputToFileName(filepath.Join(filepath.Dir(filePath), fileName)) // 输出文件路径
+		if outputPath != "" {
+			outputFilePath = outputPath
+			err = os.MkdirAll(filepath.Dir(outputFilePath), 0755)
+			if err != nil {
+				fmt.Println(en, "创建目录时出错:", err)
+				return
+			}
+		} else if _, err := os.Stat(filepath.Dir(outputFilePath)); err == nil && filePath == StdioPath {
+			fmt.Println(en, "输出目录", filepath.Dir(outputFilePath), "已存在，请删除或使用 -o 指定输出路径")
+			return
+		} else if err == nil {
 			for {
 				fmt.Println(en, "检测到输出目录已生成，是否删除并重新生成？ [Y/n]")
 				result := GetUserInput()
@@ -437,22 +533,109 @@ func Encode(fileDir string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeS
 				}
 			}
 		}
-		err = os.Mkdir(filepath.Dir(outputFilePath), 0755)
+		if outputPath == "" {
+			err = os.Mkdir(filepath.Dir(outputFilePath), 0755)
+			if err != nil {
+				fmt.Println(en, "创建目录时出错:", err)
+				return
+			}
+		}
+
+		// 压缩: auto 模式只检查文件开头的采样
+		sample, err := input.Peek(compressSampleLen)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			fmt.Println(en, "无法读取文件:", err)
+			return
+		}
+		fileCompression := ChooseCompression(compression, fileName, sample)
+		if compression == CompressAuto && fileCompression == CompressNone {
+			fmt.Println(en, "检测到文件已被压缩，跳过压缩")
+		}
+		if fileCompression != CompressNone {
+			fmt.Println(en, "使用", fileCompression, "压缩文件数据")
+		}
+
+		// 加密
+		var cryptParams *CryptParams
+		var cryptKey []byte
+		if password != "" || len(recipients) > 0 {
+			cryptParams, err = NewCryptParams()
+			if err != nil {
+				fmt.Println(en, "无法生成加密参数:", err)
+				return
+			}
+			if len(recipients) > 0 {
+				fmt.Println(en, "使用", len(recipients), "个接收者公钥加密文件数据")
+				cryptKey, err = cryptParams.SetRecipients(recipients)
+			} else {
+				fmt.Println(en, "使用密码加密文件数据")
+				cryptKey, err = cryptParams.SetPassword(password)
+			}
+			if err != nil {
+				fmt.Println(en, "无法生成加密密钥:", err)
+				return
+			}
+		}
+
+		// 读取输入时同时计算 Hash 并压缩、加密，读完输入后才能确定 Hash 与长度
+		fileID, err := NewFileID()
 		if err != nil {
-			fmt.Println(en, "创建目录时出错:", err)
+			fmt.Println(en, "无法生成文件标识:", err)
 			return
 		}
+		encodeStream := NewEncodeStream(input, fileCompression, cryptParams, cryptKey, SealedMeta{Name: fileName, Summary: encodeSummary})
+		closeInput = func() {
+			encodeStream.Close()
+			if inputFile != nil {
+				inputFile.Close()
+			}
+		}
+
+		// 网格布局与彩色模式: 每个视频帧放置多个二维码
+		tiles := gridCols * gridRows
+		symbolsPerFrame := tiles
+		if colorMode {
+			symbolsPerFrame *= ColorChannels
+		}
+
+		// 编码数据流每次读取约一个分段的数据量，窗口按数据帧对齐，喷泉码按源块对齐，使用校验帧时按帧组对齐
+		streamAlign := int64(dataSliceLen)
+		if fountainRatio > 0 {
+			streamAlign *= FountainBlockSymbols
+		}
+		if parityK > 0 {
+			streamAlign *= int64(parityN)
+		}
+		streamWindow := int64(segmentSeconds) * int64(outputFPS) * int64(symbolsPerFrame) * int64(dataSliceLen)
+		streamWindow = (streamWindow + streamAlign - 1) / streamAlign * streamAlign
+		streamData := NewStreamData(encodeStream, streamWindow)
+
+		// 构建数据帧来源
+		var frameSource FrameSource
+		fountainK := 0
+		if fountainRatio > 0 {
+			fountainK = FountainBlockSymbols
+			frameSource = NewFountainSource(streamData, fileID, dataSliceLen, fountainK, fountainRatio)
+		} else {
+			frameSource = NewPlainSource(streamData, dataSliceLen, fileID)
+		}
+		if parityK > 0 {
+			frameSource = NewParitySource(frameSource, fileID, dataSliceLen, parityN, parityK)
+		}
 
-		outputFileTagPath := AddTagToFileName(outputFilePath)                      // 输出{index}文件路径
-		fileLength := len(fileData)                                                // 输入文件长度
-		allFrameNum := int(math.Ceil(float64(fileLength) / float64(dataSliceLen))) // 生成总帧数
-		segmentLength := segmentSeconds * outputFPS                                // 段帧数
-		allSeconds := int(math.Ceil(float64(allFrameNum) / float64(outputFPS)))    // 总时长(秒)
-		isSegments := false                                                        // 是否分段
-		if allFrameNum > segmentLength {
-			isSegments = true
+		// 网格布局与彩色模式: 按 -d 与纠错等级下最大的数据二维码确定格子大小
+		var tileBounds image.Rectangle
+		if symbolsPerFrame > 1 && canvasWidth == 0 {
+			tile, err := SymbolWorstCase(dataSliceLen, symbol, payload, qrcodeErrorCorrection, qrcodeSize)
+			if err != nil {
+				fmt.Println(en, "无法生成二维码(每帧数据长度过大，可减小 -d 或降低纠错等级):", err)
+				return
+			}
+			tileBounds = tile.Bounds()
 		}
-		segmentsNum := int(math.Ceil(float64(allFrameNum) / float64(segmentLength)))
+
+		outputFileTagPath := AddTagToFileName(outputFilePath)         // 输出{index}文件路径
+		segmentLength := segmentSeconds * outputFPS * symbolsPerFrame // 段帧数(二维码数)
 
 		allStartTime := time.Now()
 
@@ -461,139 +644,469 @@ func Encode(fileDir string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeS
 		fmt.Println(en, "  ---------------------------")
 		fmt.Println(en, "  输入文件:", filePath)
 		fmt.Println(en, "  输出文件:", outputFileTagPath)
-		fmt.Println(en, "  输入文件长度:", fileLength)
 		fmt.Println(en, "  每帧数据长度:", dataSliceLen)
+		fmt.Println(en, "  压缩算法:", fileCompression)
+		fmt.Println(en, "  数据帧编码:", payload)
+		fmt.Println(en, "  二维码制式:", symbol)
+		fmt.Println(en, "  是否加密:", cryptParams != nil)
+		fmt.Println(en, "  喷泉码冗余比例:", fountainRatio)
+		fmt.Println(en, "  每组数据帧数/校验帧数:", strconv.Itoa(parityN)+"/"+strconv.Itoa(parityK))
 		fmt.Println(en, "  纠错等级:", qrcodeErrorCorrection)
 		fmt.Println(en, "  二维码大小:", qrcodeSize)
 		fmt.Println(en, "  输出帧率:", outputFPS)
-		fmt.Println(en, "  是否分段:", isSegments)
-		fmt.Println(en, "  分段数量:", segmentsNum)
-		fmt.Println(en, "  生成总帧数:", allFrameNum)
-		fmt.Println(en, "  段最大帧数:", segmentLength)
-		fmt.Println(en, "  总时长: ", allSeconds, "s")
+		fmt.Println(en, "  网格布局:", strconv.Itoa(gridCols)+"x"+strconv.Itoa(gridRows))
+		fmt.Println(en, "  彩色模式:", colorMode)
+		fmt.Println(en, "  帧编码方式:", codec)
+		if canvasWidth > 0 {
+			fmt.Println(en, "  固定分辨率:", strconv.Itoa(canvasWidth)+"x"+strconv.Itoa(canvasHeight))
+		}
+		fmt.Println(en, "  渲染线程数:", Threads(threads))
+		fmt.Println(en, "  视频帧写入方式:", framePipe)
+		fmt.Println(en, "  段最大帧数:", segmentLength/symbolsPerFrame)
 		fmt.Println(en, "  段最大时间:", segmentSeconds, "s")
 		fmt.Println(en, "  FFmpeg 预设:", encodeFFmpegMode)
-		fmt.Println(en, "  输入文件Hash(SHA256):", InputFileHash)
 		fmt.Println(en, "  ---------------------------")
 
-		// 分段操作
-		for segmentsIndex := 0; segmentsIndex < segmentsNum; segmentsIndex++ {
-			var fileSegmentData []byte
-			var outputFileIndexPath string
-			if (segmentsIndex+1)*dataSliceLen*segmentLength <= fileLength {
-				fileSegmentData = fileData[segmentsIndex*dataSliceLen*segmentLength : (segmentsIndex+1)*dataSliceLen*segmentLength]
-			} else {
-				fileSegmentData = fileData[segmentsIndex*dataSliceLen*segmentLength : fileLength]
-			}
-			if segmentsIndex == 0 && segmentsNum == 1 {
-				outputFileIndexPath = outputFilePath
-			} else {
-				outputFileIndexPath = AddIndexToFileName(outputFilePath, segmentsIndex)
+		// 索引数据模板，每段修改分段序号，最后一段写入 Hash、长度与分段数
+		indexTemplate := IndexData{
+			Name:      fileName,
+			Resize:    qrcodeSize,
+			Summary:   encodeSummary,
+			Version:   FrameVersion,
+			Slice:     dataSliceLen,
+			Fountain:  fountainRatio,
+			FountainK: fountainK,
+			ParityN:   parityN,
+			ParityK:   parityK,
+			Crypt:     cryptParams,
+			FileID:    hex.EncodeToString(fileID[:]),
+			Trailing:  true,
+		}
+		if payload != PayloadBase64 {
+			indexTemplate.Payload = payload
+		}
+		if symbol != SymbolQR {
+			indexTemplate.Symbol = symbol
+		}
+		if tiles > 1 {
+			indexTemplate.GridCols = gridCols
+			indexTemplate.GridRows = gridRows
+		}
+		indexTemplate.Color = colorMode
+		if fileCompression != CompressNone {
+			indexTemplate.Compress = fileCompression
+		}
+		// 加密时文件名与摘要只写入加密的数据流
+		if cryptParams != nil && cryptParams.Sealed {
+			indexTemplate.Name = ""
+			indexTemplate.Summary = ""
+		}
+		// worstCaseIndex 返回用于确定索引帧大小的索引数据，Hash、长度与分段数在读完输入前未知，按最长的取值计算
+		worstCaseIndex := func() IndexData {
+			indexData := indexTemplate
+			indexData.Hash = strings.Repeat("0", sha256.Size*2)
+			indexData.Index = math.MaxUint16
+			indexData.Len = math.MaxUint16 + 1
+			indexData.Size = math.MaxInt64
+			if fileCompression != CompressNone {
+				indexData.RawSize = math.MaxInt64
 			}
+			return indexData
+		}
 
-			ffmpegCmd := []string{
-				"-y",
-				"-f", "image2pipe",
-				"-vcodec", "png",
-				"-r", fmt.Sprintf("%d", outputFPS),
-				"-i", "-",
-				"-c:v", "libx264",
-				"-preset", encodeFFmpegMode,
-				"-crf", "18",
-				outputFileIndexPath,
+		// 多级灰度符号: 符号需要能容纳最长的数据帧，且不小于索引二维码
+		var grayLayout GrayLayout
+		grayModuleSize := GrayModuleSize(qrcodeSize)
+		// 块编码符号: 单元格与宏块对齐，同样需要能容纳最长的数据帧且不小于索引二维码
+		var blockLayout BlockLayout
+		blockCellSize := BlockCellSize(qrcodeSize)
+		if codec == CodecBlock {
+			blockLayout = NewBlockLayout(FrameHeaderLen+dataSliceLen+FrameCRCLen, BlockECCLevels[qrcodeErrorCorrection], blockCellSize, 0, 0)
+			indexTemplate.Codec = codec
+			for {
+				indexTemplate.BlockCols = blockLayout.Cols
+				indexTemplate.BlockRows = blockLayout.Rows
+				indexTemplate.BlockECC = blockLayout.ECC
+				indexImage, err := BuildIndexImage(worstCaseIndex(), signingKey, qrcodeErrorCorrection, qrcodeSize)
+				if err != nil {
+					fmt.Println(en, "无法生成索引二维码:", err)
+					return
+				}
+				b := indexImage.Bounds()
+				if blockLayout.Cols*blockCellSize >= b.Dx() && blockLayout.Rows*blockCellSize >= b.Dy() {
+					break
+				}
+				blockLayout = NewBlockLayout(blockLayout.FrameLen, blockLayout.ECC, blockCellSize, b.Dx(), b.Dy())
 			}
+			fmt.Println(en, "块编码符号:", blockLayout.Cols, "x", blockLayout.Rows, "个单元格，每单元格", blockCellSize, "像素，", blockLayout.Blocks(), "个 RS 码字，每个码字", blockLayout.ECC, "个纠错字节")
+		} else if codec != CodecQR {
+			grayLayout = NewGrayLayout(GrayLevels(codec), FrameHeaderLen+dataSliceLen+FrameCRCLen, 0)
+			indexTemplate.Codec = codec
+			for {
+				indexTemplate.GraySide = grayLayout.Side
+				indexImage, err := BuildIndexImage(worstCaseIndex(), signingKey, qrcodeErrorCorrection, qrcodeSize)
+				if err != nil {
+					fmt.Println(en, "无法生成索引二维码:", err)
+					return
+				}
+				b := indexImage.Bounds()
+				minSide := (b.Dx() + grayModuleSize - 1) / grayModuleSize
+				if minSide <= grayLayout.Side {
+					break
+				}
+				grayLayout.Side = minSide
+			}
+			fmt.Println(en, "灰度符号边长:", grayLayout.Side, "个模块，每模块", grayModuleSize, "像素，容量", grayLayout.Capacity(), "字节")
+		}
 
-			ffmpegProcess := exec.Command("ffmpeg", ffmpegCmd...)
-			stdin, err := ffmpegProcess.StdinPipe()
+		// 固定分辨率画布: 所有视频帧大小相同，QR 码使用同一版本与模块大小
+		var fixedCanvas *CanvasLayout
+		if canvasWidth > 0 {
+			fixedCanvas = &CanvasLayout{Width: canvasWidth, Height: canvasHeight, Cols: gridCols, Rows: gridRows, QuietZone: quietZone}
+			indexTemplate.Canvas = fixedCanvas
+			worstIndex := worstCaseIndex()
+			if codec == CodecQR && symbol == SymbolQR {
+				// 版本需要同时容纳最长的数据帧与索引数据，数据帧按 -d 与纠错等级下的最坏情况计算
+				version, err := WorstCaseQRVersion(dataSliceLen, payload, qrcodeErrorCorrection)
+				if err != nil {
+					fmt.Println(en, "无法生成二维码(每帧数据长度过大，可减小 -d 或降低纠错等级):", err)
+					return
+				}
+				for {
+					if err := fixedCanvas.SetVersion(version); err != nil {
+						fmt.Println(en, err)
+						return
+					}
+					content, err := IndexContent(worstIndex, signingKey)
+					if err != nil {
+						fmt.Println(en, "无法生成索引二维码:", err)
+						return
+					}
+					q, err := qrencode.New(content, qrencode.RecoveryLevel(qrcodeErrorCorrection))
+					if err != nil {
+						fmt.Println(en, "无法生成索引二维码:", err)
+						return
+					}
+					if q.VersionNumber <= version {
+						break
+					}
+					version = q.VersionNumber
+				}
+				fmt.Println(en, "固定分辨率画布:", canvasWidth, "x", canvasHeight, "，二维码版本", fixedCanvas.Version, "，每模块", fixedCanvas.Module, "像素")
+			} else {
+				var symbolBounds image.Rectangle
+				if codec == CodecBlock {
+					symbolBounds = image.Rect(0, 0, blockLayout.Cols*blockCellSize, blockLayout.Rows*blockCellSize)
+					fixedCanvas.SetSymbol(symbolBounds)
+				} else if codec != CodecQR {
+					symbolBounds = image.Rect(0, 0, grayLayout.Side*grayModuleSize, grayLayout.Side*grayModuleSize)
+					fixedCanvas.SetSymbol(symbolBounds)
+				} else {
+					// Data Matrix 与 Aztec 码的大小随内容变化，按最大的符号检查能否放入格子，解码时裁剪整个格子
+					tile, err := SymbolWorstCase(dataSliceLen, symbol, payload, qrcodeErrorCorrection, qrcodeSize)
+					if err != nil {
+						fmt.Println(en, "无法生成二维码(每帧数据长度过大，可减小 -d 或降低纠错等级):", err)
+						return
+					}
+					symbolBounds = tile.Bounds()
+				}
+				if err := fixedCanvas.Fits(symbolBounds); err != nil {
+					fmt.Println(en, err)
+					return
+				}
+				fmt.Println(en, "固定分辨率画布:", canvasWidth, "x", canvasHeight)
+			}
+			indexImage, err := BuildIndexImage(worstIndex, signingKey, qrcodeErrorCorrection, qrcodeSize)
 			if err != nil {
-				fmt.Println(en, "无法创建 ffmpeg 的标准输入管道:", err)
+				fmt.Println(en, "无法生成索引二维码:", err)
 				return
 			}
-			err = ffmpegProcess.Start()
-			if err != nil {
-				fmt.Println(en, "无法启动 ffmpeg 子进程:", err)
+			if b := indexImage.Bounds(); fixedCanvas.Version == 0 && (b.Dx() > canvasWidth || b.Dy() > canvasHeight) {
+				fmt.Println(en, "索引二维码大小", b.Dx(), "x", b.Dy(), "超出画布分辨率，请增大分辨率或减小 -s")
 				return
 			}
+		}
 
-			i := 1
+		// symbolLimit 为数据二维码的最大大小(格子或原始帧大小)，超出时缩小模块重新绘制，为空表示不限制
+		var symbolLimit image.Rectangle
+		if fixedCanvas != nil {
+			cw, ch := fixedCanvas.minCell()
+			symbolLimit = image.Rect(0, 0, cw, ch)
+		} else if symbolsPerFrame > 1 {
+			symbolLimit = tileBounds
+		}
 
-			// 构建索引二维码
-			indexData := IndexData{
-				Hash:    InputFileHash,
-				Name:    filepath.Base(filePath),
-				Index:   segmentsIndex,
-				Len:     segmentsNum,
-				Resize:  qrcodeSize,
-				Summary: encodeSummary,
+		// renderSymbol 按帧编码方式与二维码制式生成单个数据帧的符号，会被多个工作协程并发调用
+		renderSymbol := func(frame []byte) (image.Image, error) {
+			if codec == CodecBlock {
+				img, err := BlockEncode(frame, blockLayout, blockCellSize)
+				if err != nil {
+					return nil, fmt.Errorf("无法生成块编码符号: %v", err)
+				}
+				return img, nil
 			}
-			jsonIndexData, err := json.Marshal(indexData)
-			if err != nil {
-				fmt.Println("JSON 编码错误:", err)
-				return
+			if codec != CodecQR {
+				img, err := GrayEncode(frame, grayLayout, grayModuleSize)
+				if err != nil {
+					return nil, fmt.Errorf("无法生成灰度符号: %v", err)
+				}
+				return img, nil
 			}
-			base64IndexData := base64.StdEncoding.EncodeToString(jsonIndexData)
-			qt, _ := qrencode.New(base64IndexData, qrencode.RecoveryLevel(qrcodeErrorCorrection))
-			qrImaget := qt.Image(qrcodeSize)
-			imageBuffert := new(bytes.Buffer)
-			errt := png.Encode(imageBuffert, qrImaget)
-			if errt != nil {
-				return
+			if fixedCanvas != nil && fixedCanvas.Version > 0 {
+				img, err := fixedCanvas.QRImage(EncodePayload(frame, payload), qrcodeErrorCorrection)
+				if err != nil {
+					return nil, fmt.Errorf("无法生成二维码: %v", err)
+				}
+				return img, nil
 			}
-			imageDatat := imageBuffert.Bytes()
-			_, err = stdin.Write(imageDatat)
+			img, err := SymbolEncodeWithin(frame, symbol, payload, qrcodeErrorCorrection, qrcodeSize, symbolLimit)
 			if err != nil {
-				fmt.Println(en, "无法写入帧数据到 ffmpeg:", err)
-				return
+				return nil, fmt.Errorf("无法生成二维码(每帧数据长度过大，可减小 -d 或降低纠错等级): %v", err)
 			}
-			imageBuffert = nil
-			imageDatat = nil
-
-			fmt.Println(en, "开始编码第", segmentsIndex+1, "段视频，总共有", segmentsNum, "段视频，生成路径:", outputFileIndexPath)
-
-			// 启动进度条
-			bar := pb.StartNew(len(fileSegmentData))
-
-			fileNowLength := 0
-			for {
-				if len(fileSegmentData) == 0 {
-					break
-				}
-				var data []byte
-				if len(fileSegmentData) >= dataSliceLen {
-					data = fileSegmentData[:dataSliceLen]
-					fileSegmentData = fileSegmentData[dataSliceLen:]
-				} else {
-					data = fileSegmentData
-					fileSegmentData = nil
-				}
+			return img, nil
+		}
 
-				i++
-				fileNowLength += len(data)
-				base64Data := base64.StdEncoding.EncodeToString(data)
+		// 数据帧使用的画布，网格布局的格子需要能容纳最大的索引二维码，所有分段使用同一画布
+		var canvas FrameCanvas
+		if fixedCanvas != nil {
+			canvas = fixedCanvas
+		} else if symbolsPerFrame > 1 {
+			indexImage, err := BuildIndexImage(worstCaseIndex(), signingKey, qrcodeErrorCorrection, qrcodeSize)
+			if err != nil {
+				fmt.Println(en, "无法生成索引二维码:", err)
+				return
+			}
+			canvas = NewGridCanvas(gridCols, gridRows, tileBounds, indexImage.Bounds())
+		}
 
-				bar.SetCurrent(int64(fileNowLength))
-				if i%1000 == 0 {
-					fmt.Printf("\nEncode: 构建帧 %d, 已构建数据 %d, 总数据 %d\n", i, fileNowLength, fileLength)
+		// buildIndexFrame 构建索引帧，key 为 nil 时不签名
+		buildIndexFrame := func(indexData IndexData, key ed25519.PrivateKey) (image.Image, error) {
+			var qrImaget image.Image
+			var err error
+			if fixedCanvas != nil && fixedCanvas.Version > 0 {
+				var content string
+				content, err = IndexContent(indexData, key)
+				if err == nil {
+					qrImaget, err = fixedCanvas.QRImage(content, qrcodeErrorCorrection)
 				}
+			} else {
+				qrImaget, err = BuildIndexImage(indexData, key, qrcodeErrorCorrection, qrcodeSize)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if canvas != nil {
+				qrImaget = canvas.Center(qrImaget)
+			} else if codec == CodecBlock {
+				// 索引二维码居中放入与块编码符号大小相同的画布
+				qrImaget = CenterCanvas(qrImaget, blockLayout.Cols*blockCellSize, blockLayout.Rows*blockCellSize)
+			} else if codec != CodecQR {
+				// 索引二维码居中放入与灰度符号大小相同的画布
+				qrImaget = CenterCanvas(qrImaget, grayLayout.Side*grayModuleSize, grayLayout.Side*grayModuleSize)
+			}
+			return qrImaget, nil
+		}
 
-				q, _ := qrencode.New(base64Data, qrencode.RecoveryLevel(qrcodeErrorCorrection))
-				qrImage := q.Image(qrcodeSize)
-				imageBuffer := new(bytes.Buffer)
-				err := png.Encode(imageBuffer, qrImage)
-				if err != nil {
-					return
+		// 原始帧需要固定大小: 按最长的索引数据计算索引帧；每帧一个符号时数据帧可能大于索引帧，按 -d 与纠错等级下最大的符号计算
+		pipe := &FramePipe{Mode: framePipe, Color: colorMode}
+		if framePipe == PipeRaw {
+			indexFrame, err := buildIndexFrame(worstCaseIndex(), signingKey)
+			if err != nil {
+				fmt.Println(en, "无法生成索引二维码:", err)
+				return
+			}
+			pipe.Fit(indexFrame.Bounds())
+			if symbolsPerFrame == 1 && fixedCanvas == nil {
+				var tile image.Image
+				if codec == CodecQR {
+					tile, err = SymbolWorstCase(dataSliceLen, symbol, payload, qrcodeErrorCorrection, qrcodeSize)
+				} else {
+					// 灰度符号与块编码符号大小固定
+					tile, err = renderSymbol(MarshalFrame(FrameHeader{}, make([]byte, dataSliceLen)))
 				}
-				imageData := imageBuffer.Bytes()
-
-				_, err = stdin.Write(imageData)
 				if err != nil {
-					fmt.Println(en, "无法写入帧数据到 ffmpeg:", err)
+					fmt.Println(en, err)
 					return
 				}
-				imageBuffer = nil
-				imageData = nil
+				pipe.Fit(tile.Bounds())
+				symbolLimit = image.Rect(0, 0, pipe.Width, pipe.Height)
 			}
-			bar.Finish()
+			fmt.Println(en, "原始帧大小:", pipe.Width, "x", pipe.Height)
+		}
+		renderFrames := 0
+		var renderDuration time.Duration
+
+		// 分段操作: 数据帧边读取输入边生成，每段最后写入索引帧
+		// 读完输入后才能确定 Hash 与长度，只有最后一段的索引帧包含 Hash、长度与签名，其余分段的索引帧只用于按文件标识归入该文件
+		var InputFileHash string
+		var fileLength, streamSize int64
+		segmentsNum := 0
+		nextSeq := 0
+		for segmentsIndex := 0; segmentsNum == 0; segmentsIndex++ {
+			if segmentsIndex > math.MaxUint16 {
+				fmt.Println(en, "分段数量超出上限", math.MaxUint16+1, "，请增大 -l")
+				return
+			}
+			// 分段数量在读完输入后才能确定，只有一段时再去掉文件名中的分段序号
+			outputFileIndexPath := AddIndexToFileName(outputFilePath, segmentsIndex)
+			segmentStart := nextSeq
+			segmentEnd := segmentStart + segmentLength
+
+			ffmpegCmd := append([]string{"-y"}, pipe.InputArgs(outputFPS)...)
+			ffmpegCmd = append(ffmpegCmd,
+				"-c:v", "libx264",
+				"-preset", encodeFFmpegMode,
+				"-crf", "18",
+			)
+			if pixFmt != "" {
+				ffmpegCmd = append(ffmpegCmd, "-pix_fmt", pixFmt)
+			}
+			ffmpegCmd = append(ffmpegCmd, outputFileIndexPath)
+
+			ffmpegProcess := exec.Command("ffmpeg", ffmpegCmd...)
+			stdin, err := ffmpegProcess.StdinPipe()
+			if err != nil {
+				fmt.Println(en, "无法创建 ffmpeg 的标准输入管道:", err)
+				return
+			}
+			err = ffmpegProcess.Start()
+			if err != nil {
+				fmt.Println(en, "无法启动 ffmpeg 子进程:", err)
+				return
+			}
+			abortFFmpeg = func() {
+				stdin.Close()
+				_ = ffmpegProcess.Process.Kill()
+				_ = ffmpegProcess.Wait()
+				_ = os.Remove(outputFileIndexPath)
+			}
+
+			i := 0
+
+			fmt.Println(en, "开始编码第", segmentsIndex+1, "段视频，生成路径:", outputFileIndexPath)
+
+			// 启动进度条，最后一段的帧数在读完输入后才能确定
+			bar := pb.StartNew(segmentLength)
+
+			// 调度协程按顺序读取帧源，每次取出一个视频帧中的所有数据帧，工作协程并发生成符号并编码为写入 ffmpeg 的数据
+			next := func() [][]byte {
+				end := nextSeq + symbolsPerFrame
+				if end > segmentEnd {
+					end = segmentEnd
+				}
+				frames := make([][]byte, 0, end-nextSeq)
+				for ; nextSeq < end && frameSource.Has(nextSeq); nextSeq++ {
+					frameHeader, data := frameSource.Frame(nextSeq)
+					frameHeader.Segment = uint16(segmentsIndex)
+					frames = append(frames, MarshalFrame(frameHeader, data))
+				}
+				if len(frames) == 0 {
+					return nil
+				}
+				return frames
+			}
+			render := func(frames [][]byte) ([]byte, error) {
+				tileImages := make([]image.Image, 0, len(frames))
+				for _, frame := range frames {
+					tile, err := renderSymbol(frame)
+					if err != nil {
+						return nil, err
+					}
+					tileImages = append(tileImages, tile)
+				}
+				qrImage := tileImages[0]
+				if symbolsPerFrame > 1 {
+					// 彩色模式下依次填满 R、G、B 通道，最后一帧不足的格子留白
+					if colorMode {
+						planes := make([]image.Image, 0, ColorChannels)
+						for start := 0; start < len(tileImages); start += tiles {
+							end := start + tiles
+							if end > len(tileImages) {
+								end = len(tileImages)
+							}
+							planes = append(planes, canvas.Compose(tileImages[start:end]))
+						}
+						var err error
+						qrImage, err = MergeChannels(planes)
+						if err != nil {
+							return nil, fmt.Errorf("无法合成彩色帧: %v", err)
+						}
+					} else {
+						qrImage = canvas.Compose(tileImages)
+					}
+				} else if fixedCanvas != nil {
+					qrImage = fixedCanvas.Center(qrImage)
+				}
+				return pipe.Encode(qrImage)
+			}
+			written := segmentStart
+			segmentFrames := 0
+			segmentStartTime := time.Now()
+			err = RenderPipeline(threads, next, render, func(imageData []byte, frames int) error {
+				if _, err := stdin.Write(imageData); err != nil {
+					return fmt.Errorf("无法写入帧数据到 ffmpeg: %v", err)
+				}
+				segmentFrames++
+				for ; frames > 0; frames-- {
+					i++
+					written++
+					if i%1000 == 0 {
+						fmt.Printf("\nEncode: 构建帧 %d, 已构建帧 %d\n", i, written)
+					}
+				}
+				bar.SetCurrent(int64(written - segmentStart))
+				return nil
+			})
+			if err != nil {
+				fmt.Println(en, err)
+				return
+			}
+			if err := streamData.Err(); err != nil {
+				fmt.Println(en, "读取编码数据失败:", err)
+				return
+			}
+			bar.SetTotal(int64(written - segmentStart))
+			bar.Finish()
+
+			// 构建索引帧，读完输入时为最后一段，写入 Hash、长度与签名
+			indexData := indexTemplate
+			indexData.Index = segmentsIndex
+			var indexKey ed25519.PrivateKey
+			if !frameSource.Has(nextSeq) {
+				if err := streamData.Err(); err != nil {
+					fmt.Println(en, "读取编码数据失败:", err)
+					return
+				}
+				segmentsNum = segmentsIndex + 1
+				InputFileHash, fileLength = encodeStream.Sum()
+				streamSize = streamData.Size()
+				indexData.Hash = InputFileHash
+				if cryptParams != nil && cryptParams.Sealed {
+					indexData.Hash = encodeStream.StreamSum()
+				}
+				indexData.Len = segmentsNum
+				indexData.Size = streamSize
+				if fileCompression != CompressNone {
+					indexData.RawSize = fileLength
+				}
+				indexKey = signingKey
+			}
+			qrImaget, err := buildIndexFrame(indexData, indexKey)
+			if err != nil {
+				fmt.Println(en, "无法生成索引二维码:", err)
+				return
+			}
+			imageDatat, err := pipe.Encode(qrImaget)
+			if err != nil {
+				fmt.Println(en, err)
+				return
+			}
+			_, err = stdin.Write(imageDatat)
+			if err != nil {
+				fmt.Println(en, "无法写入帧数据到 ffmpeg:", err)
+				return
+			}
+			imageDatat = nil
 
 			// 关闭 ffmpeg 的标准输入管道，等待子进程完成
 			stdin.Close()
@@ -601,7 +1114,23 @@ func Encode(fileDir string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeS
 				fmt.Println(en, "ffmpeg 子进程执行失败:", err)
 				return
 			}
+			abortFFmpeg = nil
+			// 渲染速度包含 ffmpeg 编码的时间，用于比较不同的视频帧写入方式
+			segmentDuration := time.Since(segmentStartTime)
+			renderFrames += segmentFrames
+			renderDuration += segmentDuration
+			fmt.Printf(en+" 第 %d 段视频渲染速度: %.2f 帧/秒\n", segmentsIndex+1, float64(segmentFrames)/segmentDuration.Seconds())
+		}
+		if segmentsNum == 1 {
+			if err := os.Rename(AddIndexToFileName(outputFilePath, 0), outputFilePath); err != nil {
+				fmt.Println(en, "无法重命名输出文件:", err)
+				return
+			}
 		}
+		allFrameNum := nextSeq                                                    // 生成总帧数(二维码数)
+		videoFrameNum := renderFrames                                             // 视频总帧数
+		allSeconds := int(math.Ceil(float64(videoFrameNum) / float64(outputFPS))) // 总时长(秒)
+		isSegments := segmentsNum > 1                                             // 是否分段
 
 		fmt.Println(en, "完成")
 		fmt.Println(en, "使用配置：")
@@ -610,136 +1139,179 @@ func Encode(fileDir string, qrcodeErrorCorrection int, dataSliceLen int, qrcodeS
 		fmt.Println(en, "  输出文件:", outputFileTagPath)
 		fmt.Println(en, "  输入文件长度:", fileLength)
 		fmt.Println(en, "  每帧数据长度:", dataSliceLen)
+		fmt.Println(en, "  压缩算法:", fileCompression)
+		fmt.Println(en, "  数据帧编码:", payload)
+		fmt.Println(en, "  二维码制式:", symbol)
+		fmt.Println(en, "  编码数据长度:", streamSize)
+		fmt.Println(en, "  是否加密:", cryptParams != nil)
+		fmt.Println(en, "  喷泉码冗余比例:", fountainRatio)
+		fmt.Println(en, "  每组数据帧数/校验帧数:", strconv.Itoa(parityN)+"/"+strconv.Itoa(parityK))
 		fmt.Println(en, "  纠错等级:", qrcodeErrorCorrection)
 		fmt.Println(en, "  二维码大小:", qrcodeSize)
 		fmt.Println(en, "  输出帧率:", outputFPS)
 		fmt.Println(en, "  是否分段:", isSegments)
 		fmt.Println(en, "  分段数量:", segmentsNum)
+		fmt.Println(en, "  网格布局:", strconv.Itoa(gridCols)+"x"+strconv.Itoa(gridRows))
+		fmt.Println(en, "  彩色模式:", colorMode)
+		fmt.Println(en, "  帧编码方式:", codec)
+		if canvasWidth > 0 {
+			fmt.Println(en, "  固定分辨率:", strconv.Itoa(canvasWidth)+"x"+strconv.Itoa(canvasHeight))
+		}
+		fmt.Println(en, "  渲染线程数:", Threads(threads))
+		fmt.Println(en, "  视频帧写入方式:", framePipe)
+		fmt.Printf(en+"   平均渲染速度: %.2f 帧/秒\n", float64(renderFrames)/renderDuration.Seconds())
 		fmt.Println(en, "  生成总帧数:", allFrameNum)
-		fmt.Println(en, "  段最大帧数:", segmentLength)
+		fmt.Println(en, "  视频总帧数:", videoFrameNum)
+		fmt.Println(en, "  段最大帧数:", segmentLength/symbolsPerFrame)
 		fmt.Println(en, "  总时长: ", strconv.Itoa(allSeconds)+"s")
 		fmt.Println(en, "  段最大时间:", strconv.Itoa(segmentSeconds)+"s")
 		fmt.Println(en, "  FFmpeg 预设:", encodeFFmpegMode)
 		fmt.Println(en, "  输入文件Hash(SHA256):", InputFileHash)
+		if cryptParams != nil && cryptParams.Sealed {
+			fmt.Println(en, "  索引Hash(加密数据):", encodeStream.StreamSum())
+		}
 		fmt.Println(en, "  ---------------------------")
 		allEndTime := time.Now()
 		allDuration := allEndTime.Sub(allStartTime)
 		fmt.Printf(en+" 总共耗时%f秒\n", allDuration.Seconds())
+
+		// 编码完成后立即关闭文件，不等到所有文件编码完成
+		closeInput()
+		closeInput = nil
 	}
 }
 
-func Decode(videoFileDir string, videoResizeTimes float64) {
+// DecodeAllHashes 作为 --hash 的值时解码所有检测到的文件
+const DecodeAllHashes = "all"
+
+func Decode(videoFileDir string, outputPath string, selectHash string, videoResizeTimes float64, password string, identityPath string, trustedKeys []ed25519.PublicKey, requireSignature bool, threads int, readers int, decoders []string, helper []string) {
+	// 输出到标准输出时，所有提示信息改为输出到标准错误，避免混入数据
+	logOut := io.Writer(os.Stdout)
+	if outputPath == StdioPath {
+		logOut = os.Stderr
+	}
+	// 所有文件共用一个识别链，辅助进程只启动一次；每个文件开始解码时清空统计，统计中不包含索引二维码
+	chain, err := NewDecoderChain(decoders, DecoderOptions{Helper: helper, Log: logOut})
+	if err != nil {
+		fmt.Fprintln(logOut, de, "识别方式错误:", err)
+		return
+	}
+	defer chain.Close()
 	// 当没有检测到videoFileDir时，自动匹配
 	if videoFileDir == "" {
-		fmt.Println(de, "自动使用程序所在目录作为输入目录")
+		fmt.Fprintln(logOut, de, "自动使用程序所在目录作为输入目录")
 		fd, err := os.Executable()
 		if err != nil {
-			fmt.Println(de, "获取程序所在目录失败:", err)
+			fmt.Fprintln(logOut, de, "获取程序所在目录失败:", err)
 			return
 		}
 		videoFileDir = filepath.Dir(fd)
 	}
 
 	// 检查输入文件夹是否存在
-	if _, err := os.Stat(videoFileDir); os.IsNotExist(err) {
-		fmt.Println(de, "输入文件夹不存在:", err)
+	inputInfo, err := os.Stat(videoFileDir)
+	if err != nil {
+		fmt.Fprintln(logOut, de, "输入文件夹不存在:", err)
 		return
 	}
+	// 输入为视频文件时检测同目录下的所有视频，只解码该视频所属的文件
+	inputVideo := ""
+	if !inputInfo.IsDir() {
+		inputVideo = filepath.Clean(videoFileDir)
+		videoFileDir = filepath.Dir(videoFileDir)
+	}
 
 	fileDict, err := GenerateFileDxDictionary(videoFileDir, ".mp4")
 	if err != nil {
-		fmt.Println(de, "无法生成视频列表:", err)
+		fmt.Fprintln(logOut, de, "无法生成视频列表:", err)
 		return
 	}
 
 	indexReadData := make(map[string]IndexReadData)
+	partialPaths := make(map[string]map[int]string)
+
+	// readIndex 读取并识别视频中的一帧，返回其中的索引数据
+	readIndex := func(videoFilePath string, r FrameRange, fps float64, width int, height int) (IndexData, error) {
+		var indexData IndexData
+		img, err := ReadVideoFrame(videoFilePath, r, fps, width, height)
+		if err != nil {
+			return indexData, err
+		}
+		jsonByteData := chain.Decode(ResizeImage(img, 1), r.Start, nil, PayloadBase64)
+		if jsonByteData == nil {
+			return indexData, errors.New("没有检测到索引数据")
+		}
+		if err := json.Unmarshal(jsonByteData, &indexData); err != nil {
+			return indexData, fmt.Errorf("无法解析 JSON 数据: %v", err)
+		}
+		if indexData.Hash == "" && indexData.FileID == "" {
+			return indexData, errors.New("没有检测到索引数据")
+		}
+		return indexData, nil
+	}
 
 	// 遍历fileDict
 	for _, videoFilePath := range fileDict {
-		fmt.Println(de, "正在检测视频文件:", videoFilePath)
+		fmt.Fprintln(logOut, de, "正在检测视频文件:", videoFilePath)
 		cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=p=0", videoFilePath)
 		output, err := cmd.Output()
 		if err != nil {
-			fmt.Println(de, "FFprobe 启动失败，请检查文件是否存在:", err)
+			fmt.Fprintln(logOut, de, "FFprobe 启动失败，请检查文件是否存在:", err)
 			continue
 		}
 		result := strings.Split(string(output), ",")
 		if len(result) != 2 {
-			fmt.Println(de, "无法读取视频宽高，请检查视频文件是否正确")
+			fmt.Fprintln(logOut, de, "无法读取视频宽高，请检查视频文件是否正确")
 			continue
 		}
 		videoWidth, err := strconv.Atoi(strings.TrimSpace(result[0]))
 		if err != nil {
-			fmt.Println(de, "无法读取视频宽高，请检查视频文件是否正确:", err)
+			fmt.Fprintln(logOut, de, "无法读取视频宽高，请检查视频文件是否正确:", err)
 			continue
 		}
 		videoHeight, err := strconv.Atoi(strings.TrimSpace(result[1]))
 		if err != nil {
-			fmt.Println(de, "无法读取视频宽高，请检查视频文件是否正确:", err)
+			fmt.Fprintln(logOut, de, "无法读取视频宽高，请检查视频文件是否正确:", err)
 			continue
 		}
 		cmd = exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=nb_frames", "-of", "default=nokey=1:noprint_wrappers=1", videoFilePath)
 		output, err = cmd.Output()
 		if err != nil {
-			fmt.Println(de, "执行 ffprobe 命令时出错:", err)
+			fmt.Fprintln(logOut, de, "执行 ffprobe 命令时出错:", err)
 			continue
 		}
 		frameCount, err := strconv.Atoi(regexp.MustCompile(`\d+`).FindString(string(output)))
 		if err != nil {
-			fmt.Println(de, "解析视频帧数时出错:", err)
+			fmt.Fprintln(logOut, de, "解析视频帧数时出错:", err)
 			continue
 		}
-		ffmpegCmd := []string{
-			"ffmpeg",
-			"-i", videoFilePath,
-			"-f", "image2pipe",
-			"-pix_fmt", "rgb24",
-			"-vcodec", "rawvideo",
-			"-vframes", "1",
-			"-",
-		}
-		ffmpegProcess := exec.Command(ffmpegCmd[0], ffmpegCmd[1:]...)
-		ffmpegStdout, err := ffmpegProcess.StdoutPipe()
+		// 读取第一帧中的索引，流式编码的视频索引帧在每段的最后一帧
+		indexData, err := readIndex(videoFilePath, FrameRange{}, 0, videoWidth, videoHeight)
 		if err != nil {
-			fmt.Println("无法创建 FFmpeg 标准输出管道:", err)
-			continue
+			frames, fps, probeErr := ProbeVideo(videoFilePath)
+			if probeErr != nil {
+				fmt.Fprintln(logOut, de, "无法读取视频帧数与帧率:", probeErr)
+				continue
+			}
+			indexData, err = readIndex(videoFilePath, FrameRange{Start: frames - 1}, fps, videoWidth, videoHeight)
 		}
-		err = ffmpegProcess.Start()
 		if err != nil {
-			fmt.Println(de, "无法启动 FFmpeg 进程:", err)
+			fmt.Fprintln(logOut, de, "还原原始数据失败:", err)
 			continue
 		}
-		rawData := make([]byte, videoWidth*videoHeight*3)
-		readBytes := 0
-		exitFlag := false
-		for readBytes < len(rawData) {
-			n, err := ffmpegStdout.Read(rawData[readBytes:])
-			if err != nil {
-				exitFlag = true
-				break
+		// 流式编码时除最后一段外索引没有 Hash，读取完所有视频后按文件标识归入对应的文件
+		if indexData.Hash == "" {
+			if partialPaths[indexData.FileID] == nil {
+				partialPaths[indexData.FileID] = make(map[int]string)
 			}
-			readBytes += n
-		}
-		if exitFlag {
-			break
-		}
-		img := RawDataToImage(rawData, videoWidth, videoHeight)
-		resizedImg := ResizeImage(img, 1)
-		jsonByteData := QrDecode(resizedImg, 1, false)
-		if jsonByteData == nil {
-			fmt.Println(de, "还原原始数据失败: 没有检测到索引数据")
+			partialPaths[indexData.FileID][indexData.Index] = videoFilePath
 			continue
 		}
-		ffmpegStdout.Close()
-		err = ffmpegProcess.Wait()
+		// 验证签名，多个分段的签名内容必须一致
+		signature := VerifyIndex(indexData, trustedKeys)
+		signed, err := SignedMessage(indexData)
 		if err != nil {
-			fmt.Println(de, "FFmpeg 命令执行失败:", err)
-			continue
-		}
-		var indexData IndexData
-		err = json.Unmarshal(jsonByteData, &indexData)
-		if err != nil {
-			fmt.Println(de, "还原原始数据失败: 无法解析 JSON 数据:", err)
+			fmt.Fprintln(logOut, de, "还原原始数据失败: 无法生成签名内容:", err)
 			continue
 		}
 		// 将信息存储到 indexReadData 中
@@ -747,12 +1319,25 @@ func Decode(videoFileDir string, videoResizeTimes float64) {
 		if _, ok := indexReadData[indexData.Hash]; ok {
 			t = indexReadData[indexData.Hash].Path
 			t[indexData.Index] = videoFilePath
+			signature = MergeSignature(indexReadData[indexData.Hash].Signature, indexReadData[indexData.Hash].signed, signature, signed)
 		} else {
 			t[indexData.Index] = videoFilePath
 		}
 		if indexData.Summary == "" {
 			indexData.Summary = "无"
 		}
+		if indexData.Compress == "" {
+			indexData.Compress = CompressNone
+		}
+		if indexData.Payload == "" {
+			indexData.Payload = PayloadBase64
+		}
+		if indexData.Symbol == "" {
+			indexData.Symbol = SymbolQR
+		}
+		if indexData.Codec == "" {
+			indexData.Codec = CodecQR
+		}
 		indexReadData[indexData.Hash] = IndexReadData{
 			Width:      videoWidth,
 			Height:     videoHeight,
@@ -761,81 +1346,201 @@ func Decode(videoFileDir string, videoResizeTimes float64) {
 			Len:        indexData.Len,
 			Resize:     indexData.Resize,
 			Summary:    indexData.Summary,
+			Version:    indexData.Version,
+			Size:       indexData.Size,
+			Slice:      indexData.Slice,
+			Fountain:   indexData.Fountain,
+			FountainK:  indexData.FountainK,
+			ParityN:    indexData.ParityN,
+			ParityK:    indexData.ParityK,
+			Crypt:      indexData.Crypt,
+			Compress:   indexData.Compress,
+			RawSize:    indexData.RawSize,
+			Payload:    indexData.Payload,
+			Symbol:     indexData.Symbol,
+			GridCols:   indexData.GridCols,
+			GridRows:   indexData.GridRows,
+			Color:      indexData.Color,
+			Codec:      indexData.Codec,
+			GraySide:   indexData.GraySide,
+			BlockCols:  indexData.BlockCols,
+			BlockRows:  indexData.BlockRows,
+			BlockECC:   indexData.BlockECC,
+			Canvas:     indexData.Canvas,
+			FileID:     indexData.FileID,
+			Trailing:   indexData.Trailing,
+			Signature:  signature,
+			signed:     signed,
 			Path:       t,
 		}
 	}
-	fmt.Println(de, "所有编码视频已经读取完毕")
+	for _, data := range indexReadData {
+		if data.FileID == "" {
+			continue
+		}
+		for index, path := range partialPaths[data.FileID] {
+			if index >= 0 && index < len(data.Path) {
+				data.Path[index] = path
+			}
+		}
+	}
+	fmt.Fprintln(logOut, de, "所有编码视频已经读取完毕")
 	if len(indexReadData) == 0 {
-		fmt.Println(de, "错误：没有读取到任何有效的编码视频文件")
+		fmt.Fprintln(logOut, de, "错误：没有读取到任何有效的编码视频文件")
 		return
 	}
 
 	// 输出所有检测到的编码视频信息
-	fmt.Println(de, "检测到的编码视频信息:")
+	fmt.Fprintln(logOut, de, "检测到的编码视频信息:")
 	for hash, data := range indexReadData {
 		// 检查分段文件是否完整
 		isSegmentComplete := true
-		if len(indexReadData[hash].Path) != indexReadData[hash].Len {
+		if data.Found() != data.Len {
 			isSegmentComplete = false
 		}
-		fmt.Println(de, "  ---------------------------")
-		fmt.Println(de, "  Hash:", hash)
-		fmt.Println(de, "  名称:", data.Name)
-		fmt.Println(de, "  宽度:", data.Width)
-		fmt.Println(de, "  高度:", data.Height)
-		fmt.Println(de, "  缩放:", data.Resize)
-		fmt.Println(de, "  分段帧数:", data.frameCount)
-		fmt.Println(de, "  总帧数:", data.frameCount*data.Len)
-		fmt.Println(de, "  总分段个数:", data.Len)
-		fmt.Println(de, "  查找到的分段个数:", len(data.Path))
-		fmt.Println(de, "  分段文件是否完整:", isSegmentComplete)
-		fmt.Println(de, "  视频路径:")
+		fmt.Fprintln(logOut, de, "  ---------------------------")
+		fmt.Fprintln(logOut, de, "  Hash:", hash)
+		if data.Crypt != nil && data.Crypt.Sealed {
+			fmt.Fprintln(logOut, de, "  名称: 已加密")
+		} else {
+			fmt.Fprintln(logOut, de, "  名称:", data.Name)
+		}
+		fmt.Fprintln(logOut, de, "  宽度:", data.Width)
+		fmt.Fprintln(logOut, de, "  高度:", data.Height)
+		fmt.Fprintln(logOut, de, "  缩放:", data.Resize)
+		fmt.Fprintln(logOut, de, "  分段帧数:", data.frameCount)
+		fmt.Fprintln(logOut, de, "  总帧数:", data.frameCount*data.Len)
+		fmt.Fprintln(logOut, de, "  总分段个数:", data.Len)
+		fmt.Fprintln(logOut, de, "  查找到的分段个数:", data.Found())
+		fmt.Fprintln(logOut, de, "  分段文件是否完整:", isSegmentComplete)
+		fmt.Fprintln(logOut, de, "  视频路径:")
 		for _, path := range data.Path {
-			fmt.Println(de, "      ", path)
+			fmt.Fprintln(logOut, de, "      ", path)
 		}
-		fmt.Println(de, "  摘要:", data.Summary)
-		fmt.Println(de, "  ---------------------------")
+		fmt.Fprintln(logOut, de, "  摘要:", data.Summary)
+		fmt.Fprintln(logOut, de, "  签名:", data.Signature)
+		fmt.Fprintln(logOut, de, "  ---------------------------")
 	}
 
 	targetHashList := make([]string, 0)
-	for {
-		fmt.Println(de, "请根据上方信息输入你想要解码的文件的Hash值")
-		fmt.Println(de, "如果需要解码当前目录下的所有已编码的视频文件，请直接输入回车")
-		result := GetUserInput()
-		if result == "" {
-			// 解码所有文件
-			fmt.Println(de, "注意：开始解码当前目录下的所有已编码的视频文件")
+	if inputVideo != "" {
+		targetHash := ""
+		for hash, data := range indexReadData {
+			for _, path := range data.Path {
+				if filepath.Clean(path) == inputVideo {
+					targetHash = hash
+				}
+			}
+		}
+		if targetHash == "" {
+			fmt.Fprintln(logOut, de, "错误：", inputVideo, "不是有效的编码视频文件")
+			return
+		}
+		if indexReadData[targetHash].Found() != indexReadData[targetHash].Len {
+			fmt.Fprintln(logOut, de, "错误：检测到分段文件不完整，请检查是否有分段文件丢失")
+			return
+		}
+		if requireSignature && indexReadData[targetHash].Signature != SignatureTrusted {
+			fmt.Fprintln(logOut, de, "错误：", indexReadData[targetHash].Signature+"，已启用 --require-signature，拒绝解码")
+			return
+		}
+		fmt.Fprintln(logOut, de, "解码Hash为", targetHash, "的文件")
+		targetHashList = append(targetHashList, targetHash)
+	} else {
+		// selectAll 选择所有分段完整(启用 --require-signature 时还需要签名可信)的文件
+		selectAll := func() {
+			fmt.Fprintln(logOut, de, "注意：开始解码当前目录下的所有已编码的视频文件")
 			for hash := range indexReadData {
-				if len(indexReadData[hash].Path) != indexReadData[hash].Len {
-					fmt.Println(de, "错误：不能解码", hash, ": 检测到此Hash的分段文件不完整，请检查是否有分段文件丢失")
+				if indexReadData[hash].Found() != indexReadData[hash].Len {
+					fmt.Fprintln(logOut, de, "错误：不能解码", hash, ": 检测到此Hash的分段文件不完整，请检查是否有分段文件丢失")
 					continue
 				}
-				targetHashList = append(targetHashList, hash)
-			}
-			break
-		} else {
-			if _, ok := indexReadData[result]; ok {
-				fmt.Println(de, "解码Hash为", result, "的文件")
-				// 检查分段文件是否完整
-				if len(indexReadData[result].Path) != indexReadData[result].Len {
-					fmt.Println(de, "错误：检测到分段文件不完整，请检查是否有分段文件丢失")
-					fmt.Println(de, "错误：请重新输入要解码的文件Hash")
+				if requireSignature && indexReadData[hash].Signature != SignatureTrusted {
+					fmt.Fprintln(logOut, de, "错误：不能解码", hash, ":", indexReadData[hash].Signature+"，已启用 --require-signature")
 					continue
 				}
-				targetHashList = append(targetHashList, result)
+				targetHashList = append(targetHashList, hash)
+			}
+		}
+		if selectHash == DecodeAllHashes {
+			selectAll()
+		} else if selectHash != "" {
+			if _, ok := indexReadData[selectHash]; !ok {
+				fmt.Fprintln(logOut, de, "错误：没有检测到Hash为", selectHash, "的文件")
+				return
+			}
+			if indexReadData[selectHash].Found() != indexReadData[selectHash].Len {
+				fmt.Fprintln(logOut, de, "错误：检测到分段文件不完整，请检查是否有分段文件丢失")
+				return
+			}
+			if requireSignature && indexReadData[selectHash].Signature != SignatureTrusted {
+				fmt.Fprintln(logOut, de, "错误：", indexReadData[selectHash].Signature+"，已启用 --require-signature，拒绝解码")
+				return
+			}
+			fmt.Fprintln(logOut, de, "解码Hash为", selectHash, "的文件")
+			targetHashList = append(targetHashList, selectHash)
+		} else if !StdinIsTerminal() {
+			fmt.Fprintln(logOut, de, "错误：标准输入不是终端，无法选择要解码的文件，请通过 --hash 指定文件的Hash值，或使用 --hash "+DecodeAllHashes+" 解码所有文件")
+			return
+		}
+		for selectHash == "" {
+			fmt.Fprintln(logOut, de, "请根据上方信息输入你想要解码的文件的Hash值")
+			fmt.Fprintln(logOut, de, "如果需要解码当前目录下的所有已编码的视频文件，请直接输入回车")
+			result := GetUserInput()
+			if result == "" {
+				// 解码所有文件
+				selectAll()
 				break
 			} else {
-				fmt.Println(de, "通过输入的Hash没有检测到文件，请重新输入")
-				continue
+				if _, ok := indexReadData[result]; ok {
+					fmt.Fprintln(logOut, de, "解码Hash为", result, "的文件")
+					// 检查分段文件是否完整
+					if indexReadData[result].Found() != indexReadData[result].Len {
+						fmt.Fprintln(logOut, de, "错误：检测到分段文件不完整，请检查是否有分段文件丢失")
+						fmt.Fprintln(logOut, de, "错误：请重新输入要解码的文件Hash")
+						continue
+					}
+					if requireSignature && indexReadData[result].Signature != SignatureTrusted {
+						fmt.Fprintln(logOut, de, "错误：", indexReadData[result].Signature+"，已启用 --require-signature，拒绝解码")
+						fmt.Fprintln(logOut, de, "错误：请重新输入要解码的文件Hash")
+						continue
+					}
+					targetHashList = append(targetHashList, result)
+					break
+				} else {
+					fmt.Fprintln(logOut, de, "通过输入的Hash没有检测到文件，请重新输入")
+					continue
+				}
 			}
 		}
 	}
+	if outputPath != "" && len(targetHashList) > 1 {
+		fmt.Fprintln(logOut, de, "错误：指定 -o 时只能解码一个文件")
+		return
+	}
 
 	// 遍历解码所有Hash代表的文件
 	for targetHashIndex, targetHash := range targetHashList {
-		fmt.Println(de, "开始解码第", targetHashIndex+1, "个源文件，Hash:", targetHash)
-		// 设置输出路径
-		outputFilePath := filepath.Join(videoFileDir, "output_"+indexReadData[targetHash].Name)
+		fmt.Fprintln(logOut, de, "开始解码第", targetHashIndex+1, "个源文件，Hash:", targetHash)
+		// 设置输出路径，加密文件的文件名在还原数据后才能得到，先使用 Hash 作为文件名
+		outputName := indexReadData[targetHash].Name
+		if outputName == "" {
+			outputName = targetHash[:16]
+		}
+		outputFilePath := filepath.Join(videoFileDir, "output_"+outputName)
+		if outputPath == StdioPath {
+			// 数据帧乱序写入，先还原到临时文件，校验 Hash 后再输出到标准输出
+			tempFile, err := os.CreateTemp("", "lumina_output_*")
+			if err != nil {
+				fmt.Fprintln(logOut, de, "无法创建临时文件:", err)
+				return
+			}
+			tempFile.Close()
+			outputFilePath = tempFile.Name()
+			defer os.Remove(outputFilePath)
+		} else if outputPath != "" {
+			outputFilePath = outputPath
+		}
 
 		// 确认放大倍数
 		if videoResizeTimes == -1 {
@@ -845,144 +1550,513 @@ func Decode(videoFileDir string, videoResizeTimes float64) {
 		s := indexReadData[targetHash]
 		allStartTime := time.Now()
 
-		fmt.Println()
-		fmt.Println(de, "开始解码")
-		fmt.Println(de, "使用配置：")
-		fmt.Println(de, "  ---------------------------")
-		fmt.Println(de, "  Hash:", targetHash)
-		fmt.Println(de, "  视频宽度:", s.Width)
-		fmt.Println(de, "  视频高度:", s.Height)
-		fmt.Println(de, "  识别放大倍数:", videoResizeTimes)
-		fmt.Println(de, "  分段个数:", s.Len)
-		fmt.Println(de, "  分段帧数:", s.frameCount)
-		fmt.Println(de, "  总帧数:", s.frameCount*s.Len)
-		fmt.Println(de, "  输入视频路径:")
+		fmt.Fprintln(logOut)
+		fmt.Fprintln(logOut, de, "开始解码")
+		fmt.Fprintln(logOut, de, "使用配置：")
+		fmt.Fprintln(logOut, de, "  ---------------------------")
+		fmt.Fprintln(logOut, de, "  Hash:", targetHash)
+		fmt.Fprintln(logOut, de, "  视频宽度:", s.Width)
+		fmt.Fprintln(logOut, de, "  视频高度:", s.Height)
+		fmt.Fprintln(logOut, de, "  识别放大倍数:", videoResizeTimes)
+		fmt.Fprintln(logOut, de, "  分段个数:", s.Len)
+		fmt.Fprintln(logOut, de, "  分段帧数:", s.frameCount)
+		fmt.Fprintln(logOut, de, "  总帧数:", s.frameCount*s.Len)
+		fmt.Fprintln(logOut, de, "  是否加密:", s.Crypt != nil)
+		fmt.Fprintln(logOut, de, "  压缩算法:", s.Compress)
+		fmt.Fprintln(logOut, de, "  数据帧编码:", s.Payload)
+		fmt.Fprintln(logOut, de, "  二维码制式:", s.Symbol)
+		if s.GridCols*s.GridRows > 1 {
+			fmt.Fprintln(logOut, de, "  网格布局:", strconv.Itoa(s.GridCols)+"x"+strconv.Itoa(s.GridRows))
+		}
+		fmt.Fprintln(logOut, de, "  彩色模式:", s.Color)
+		fmt.Fprintln(logOut, de, "  帧编码方式:", s.Codec)
+		if s.Canvas != nil {
+			fmt.Fprintln(logOut, de, "  固定分辨率:", strconv.Itoa(s.Canvas.Width)+"x"+strconv.Itoa(s.Canvas.Height))
+		}
+		fmt.Fprintln(logOut, de, "  喷泉码冗余比例:", s.Fountain)
+		fmt.Fprintln(logOut, de, "  每组数据帧数/校验帧数:", strconv.Itoa(s.ParityN)+"/"+strconv.Itoa(s.ParityK))
+		fmt.Fprintln(logOut, de, "  输入视频路径:")
 		for _, path := range s.Path {
-			fmt.Println(de, "      ", path)
+			fmt.Fprintln(logOut, de, "      ", path)
+		}
+		fmt.Fprintln(logOut, de, "  输出文件路径:", outputFilePath)
+		fmt.Fprintln(logOut, de, "  摘要:", s.Summary)
+		fmt.Fprintln(logOut, de, "  签名:", s.Signature)
+		fmt.Fprintln(logOut, de, "  识别线程数:", Threads(threads))
+		fmt.Fprintln(logOut, de, "  读取进程数:", readers)
+		fmt.Fprintln(logOut, de, "  ---------------------------")
+
+		// 加密文件先解锁密钥，加密或压缩的帧数据写入临时文件，从开头起连续写入的部分边解码边解密、解压到输出文件
+		streamFilePath := outputFilePath
+		var cryptKey []byte
+		if s.Crypt != nil {
+			cryptKey, err = UnlockCrypt(s.Crypt, password, identityPath, logOut)
+			if err != nil {
+				fmt.Fprintln(logOut, de, "错误: 无法解锁加密文件", targetHash+":", err)
+				continue
+			}
+		}
+		if s.Crypt != nil || s.Compress != CompressNone {
+			streamFilePath = outputFilePath + ".lumina_stream"
 		}
-		fmt.Println(de, "  输出文件路径:", outputFilePath)
-		fmt.Println(de, "  摘要:", s.Summary)
-		fmt.Println(de, "  ---------------------------")
 
 		// 打开输出文件
-		fmt.Println(de, "创建输出文件")
-		outputFile, err := os.Create(outputFilePath)
+		fmt.Fprintln(logOut, de, "创建输出文件")
+		outputFile, err := os.Create(streamFilePath)
 		if err != nil {
-			fmt.Println(de, "无法创建输出文件:", err)
+			fmt.Fprintln(logOut, de, "无法创建输出文件:", err)
 			return
 		}
+		fileID := s.FrameFileID(targetHash)
+		frameWriter := NewFrameSink(outputFile, fileID, s, logOut)
+		// 无法识别的视频帧保存到输出文件所在目录下的待检查目录，解码不会等待用户输入
+		reviewParent := filepath.Dir(outputFilePath)
+		if outputPath == StdioPath {
+			reviewParent = videoFileDir
+		}
+		review := NewReviewDir(filepath.Join(reviewParent, ReviewDirName(targetHash)))
+		// 重新解码时清除上一次解码留下的待检查目录
+		if err := review.Remove(); err != nil {
+			fmt.Fprintln(logOut, de, "无法清除上一次解码的待检查目录:", err)
+			return
+		}
+		// 识别出的冗余帧可能不会写入输出文件，有数据帧缺失时 resolve 命令需要重新使用
+		redundant, _ := frameWriter.(RedundantSink)
+		// 边解码边还原，有数据帧缺失时接收器结束后还原失败，不完整的输出文件会被删除
+		var restoreResult *RestoreResult
+		var restoreErr error
+		var restoreDone chan struct{}
+		if streamFilePath != outputFilePath && frameWriter != nil {
+			fmt.Fprintln(logOut, de, "边解码边还原数据，是否加密:", s.Crypt != nil, "压缩算法:", s.Compress)
+			restoreDone = make(chan struct{})
+			go func() {
+				defer close(restoreDone)
+				restoreResult, restoreErr = RestoreStream(s.Crypt, cryptKey, s.Compress, s.RawSize, frameWriter.Placed(), outputFilePath)
+			}()
+		}
+		gridCols, gridRows := 1, 1
+		if s.GridCols*s.GridRows > 1 {
+			gridCols, gridRows = s.GridCols, s.GridRows
+		}
+		chain.ResetStats()
+		report := NewDecodeReport(chain)
+		// newValidator 返回数据帧校验函数与是否有识别结果未通过校验的标记，每个识别任务单独创建，可以并发使用
+		newValidator := func() (FrameValidator, *bool) {
+			rejected := new(bool)
+			if s.Version < 2 {
+				return nil, rejected
+			}
+			frameValidator := NewFrameValidator(s.Version)
+			return func(data []byte) error {
+				err := frameValidator(data)
+				if err != nil {
+					*rejected = true
+				}
+				return err
+			}, rejected
+		}
+		// 旧版本视频的数据帧没有帧头，只能按顺序写入，无法识别时停止解码，不能并发识别
+		decodeThreads := threads
+		if frameWriter == nil {
+			decodeThreads = 1
+		}
 
 		// 逐个打开视频文件进行解码
 		for index, videoFilePath := range s.Path {
-			fmt.Println(de, "正在解码第", index+1, "个视频，路径:", videoFilePath)
-
-			ffmpegCmd := []string{
-				"ffmpeg",
-				"-i", videoFilePath,
-				"-f", "image2pipe",
-				"-pix_fmt", "rgb24",
-				"-vcodec", "rawvideo",
-				"-",
-			}
-			ffmpegProcess := exec.Command(ffmpegCmd[0], ffmpegCmd[1:]...)
-			ffmpegStdout, err := ffmpegProcess.StdoutPipe()
-			if err != nil {
-				fmt.Println("无法创建 FFmpeg 标准输出管道:", err)
-				return
+			fmt.Fprintln(logOut, de, "正在解码第", index+1, "个视频，路径:", videoFilePath)
+
+			// 有帧头的视频按时间切分为多个区间，由多个 FFmpeg 进程并行读取，数据帧按帧头序号写入
+			// 流式编码的视频最后一帧为索引帧，需要读取帧数以跳过索引帧
+			ranges := []FrameRange{{}}
+			fps := 0.0
+			indexFrame := -1
+			if (readers > 1 && frameWriter != nil) || s.Trailing {
+				var frames int
+				frames, fps, err = ProbeVideo(videoFilePath)
+				if err != nil {
+					fmt.Fprintln(logOut, de, "无法读取视频帧数与帧率，使用单个读取进程:", err)
+				} else {
+					ranges = SplitFrames(frames, readers)
+					if s.Trailing {
+						indexFrame = frames - 1
+					}
+				}
 			}
-			err = ffmpegProcess.Start()
-			if err != nil {
-				fmt.Println(de, "无法启动 FFmpeg 进程:", err)
-				return
+			rangeThreads := decodeThreads
+			if len(ranges) > 1 {
+				fmt.Fprintln(logOut, de, "使用", len(ranges), "个读取进程并行解码")
+				rangeThreads = Threads(decodeThreads) / len(ranges)
+				if rangeThreads < 1 {
+					rangeThreads = 1
+				}
 			}
 
 			bar := pb.StartNew(s.frameCount)
-			i := 0
-			for {
-				rawData := make([]byte, s.Width*s.Height*3)
-				readBytes := 0
-				exitFlag := false
-				for readBytes < len(rawData) {
-					n, err := ffmpegStdout.Read(rawData[readBytes:])
-					if err != nil {
-						exitFlag = true
-						break
+			// 只有彩色模式需要 rgb24，其他模式读取 gray，像素数据直接作为灰度图像使用
+			pixFmt, frameSize := PixFmtGray, s.Width*s.Height
+			if s.Color {
+				pixFmt, frameSize = PixFmtRGB, s.Width*s.Height*3
+			}
+			// 帧缓冲区识别完成后放回池中复用，交给后备识别的图像可能引用缓冲区，这样的缓冲区不放回
+			framePool := sync.Pool{New: func() any { return make([]byte, frameSize) }}
+			decode := func(i int, rawData []byte) FrameResult {
+				if i == indexFrame {
+					framePool.Put(rawData)
+					return FrameResult{}
+				}
+				var img image.Image
+				if s.Color {
+					img = RawDataToImage(rawData, s.Width, s.Height)
+				} else {
+					img = GrayDataToImage(rawData, s.Width, s.Height)
+				}
+				validate, rejected := newValidator()
+				var r FrameResult
+				switch {
+				case frameWriter == nil:
+					data := chain.Decode(ResizeImage(img, videoResizeTimes), i, validate, s.Payload)
+					if data == nil {
+						r.Unreadable = 1
+					} else {
+						r.Symbols = [][]byte{data}
+					}
+				case s.Canvas != nil || s.Color || s.GridCols*s.GridRows > 1:
+					planes := []image.Image{img}
+					if s.Color {
+						planes = []image.Image{ChannelImage(img, 0), ChannelImage(img, 1), ChannelImage(img, 2)}
+					}
+					for _, plane := range planes {
+						var symbols [][]byte
+						var failed []image.Image
+						var unreadable int
+						if s.Canvas != nil {
+							symbols, failed, unreadable = DecodeCanvasFrame(plane, i, s, videoResizeTimes, validate, chain)
+						} else {
+							symbols, failed, unreadable = DecodeGridFrame(plane, i, gridCols, gridRows, videoResizeTimes, validate, s.Payload, s.Symbol, chain)
+						}
+						r.Symbols = append(r.Symbols, symbols...)
+						r.Fallback = append(r.Fallback, failed...)
+						r.Unreadable += unreadable
+					}
+				default:
+					data, err := DecodeSymbol(img, i, s, videoResizeTimes, validate, chain)
+					if err == nil {
+						r.Symbols = [][]byte{data}
+					} else if s.HasFallback() && chain.HasRest() {
+						r.Fallback = []image.Image{ResizeImage(img, videoResizeTimes)}
+					} else {
+						fmt.Fprintln(logOut, de, "第", i, "帧符号无法识别:", err)
+						r.Unreadable = 1
 					}
-					readBytes += n
 				}
-				if exitFlag {
-					break
+				r.Rejected = *rejected
+				if r.Unreadable > 0 {
+					// 保存整个视频帧，同一帧中可以识别的符号由 resolve 命令的扫描结果重复提供也不影响还原
+					if path, err := review.SaveFrame(index, i, img); err != nil {
+						fmt.Fprintln(logOut, de, "第", i, "帧无法保存到待检查目录:", err)
+					} else {
+						fmt.Fprintln(logOut, de, "第", i, "帧已保存到待检查目录:", path)
+					}
 				}
-				// 跳过索引信息
-				if i == 0 {
-					rawData = nil
-					i++
-					continue
+				if len(r.Fallback) == 0 {
+					framePool.Put(rawData)
 				}
-				img := RawDataToImage(rawData, s.Width, s.Height)
-				resizedImg := ResizeImage(img, videoResizeTimes)
-				data := QrDecode(resizedImg, i, true)
-				if data == nil {
-					fmt.Println(de, "还原原始数据失败: 无法识别二维码")
-					return
+				return r
+			}
+
+			// 多个读取区间的结果写入同一个输出文件与报告，写入时加锁；任一区间出错时其余区间随之停止
+			var writeMutex sync.Mutex
+			var slowMutex sync.Mutex
+			var rangeErr error
+			writeSymbol := func(i int, data []byte) error {
+				if frameWriter == nil {
+					if _, err := outputFile.Write(data); err != nil {
+						return fmt.Errorf("写入文件失败: %v", err)
+					}
+					return nil
+				}
+				h, payload, err := UnmarshalFrame(data, s.Version)
+				if err != nil {
+					if !IsIndexFrame(data) {
+						fmt.Fprintln(logOut, de, "第", i, "帧中的符号不是数据帧，跳过:", err)
+						report.AddUnreadable(videoFilePath, i)
+					}
+					return nil
+				}
+				if redundant != nil && h.FileID == fileID && redundant.Redundant(h) {
+					if err := review.Journal(data); err != nil {
+						return fmt.Errorf("写入待检查目录失败: %v", err)
+					}
+				}
+				if err := frameWriter.Write(h, payload); err != nil {
+					fmt.Fprintln(logOut, de, "第", i, "帧写入失败，跳过:", err)
+				}
+				return nil
+			}
+			write := func(i int, r FrameResult) error {
+				writeMutex.Lock()
+				defer writeMutex.Unlock()
+				if rangeErr != nil {
+					return rangeErr
+				}
+				if r.Unreadable > 0 {
+					if frameWriter == nil {
+						return errors.New("还原原始数据失败: 无法识别二维码，旧格式的视频不支持 resolve 命令")
+					}
+					fmt.Fprintln(logOut, de, "第", i, "帧有", r.Unreadable, "个符号无法识别，跳过")
+					report.AddUnreadable(videoFilePath, i)
+				}
+				if r.Rejected {
+					report.AddRejected(videoFilePath, i)
 				}
-				bar.SetCurrent(int64(i + 1))
+				for _, data := range r.Symbols {
+					if err := writeSymbol(i, data); err != nil {
+						return err
+					}
+				}
+				bar.Increment()
 				if i%1000 == 0 {
-					fmt.Printf("\nDecode: 写入帧 %d 总帧 %d\n", i, s.frameCount)
+					fmt.Fprintf(logOut, "\nDecode: 写入帧 %d 总帧 %d\n", i, s.frameCount)
+				}
+				return nil
+			}
+			// 快速识别失败的二维码交给识别链中其余的识别方式，结果可能晚于后续视频帧写入，帧头中的序号保证写入位置正确
+			// 多个读取区间的后备识别依次进行
+			slow := func(f FallbackSymbol) FallbackResult {
+				slowMutex.Lock()
+				defer slowMutex.Unlock()
+				validate, rejected := newValidator()
+				data := chain.DecodeRest(f.Image, f.Index, validate, s.Payload)
+				return FallbackResult{FallbackSymbol: f, Data: data, Rejected: *rejected}
+			}
+			writeFallback := func(r FallbackResult) error {
+				writeMutex.Lock()
+				defer writeMutex.Unlock()
+				if rangeErr != nil {
+					return rangeErr
+				}
+				if r.Rejected {
+					report.AddRejected(videoFilePath, r.Index)
 				}
-				_, err = outputFile.Write(data)
+				if r.Data == nil {
+					if path, err := review.SaveFrame(index, r.Index, r.Image); err != nil {
+						fmt.Fprintln(logOut, de, "第", r.Index, "帧中的二维码无法识别，无法保存到待检查目录:", err)
+					} else {
+						fmt.Fprintln(logOut, de, "第", r.Index, "帧中的二维码无法识别，已保存到待检查目录:", path)
+					}
+					report.AddUnreadable(videoFilePath, r.Index)
+					return nil
+				}
+				return writeSymbol(r.Index, r.Data)
+			}
+
+			// decodeRange 启动一个 FFmpeg 进程读取一个帧区间并识别
+			decodeRange := func(fr FrameRange) error {
+				ffmpegCmd := FrameReaderArgs(videoFilePath, fr, fps, pixFmt)
+				ffmpegProcess := exec.Command(ffmpegCmd[0], ffmpegCmd[1:]...)
+				ffmpegStdout, err := ffmpegProcess.StdoutPipe()
 				if err != nil {
-					fmt.Println(de, "写入文件失败:", err)
-					break
+					return fmt.Errorf("无法创建 FFmpeg 标准输出管道: %v", err)
+				}
+				err = ffmpegProcess.Start()
+				if err != nil {
+					return fmt.Errorf("无法启动 FFmpeg 进程: %v", err)
+				}
+				read := func() []byte {
+					rawData := framePool.Get().([]byte)
+					if _, err := io.ReadFull(ffmpegStdout, rawData); err != nil {
+						framePool.Put(rawData)
+						return nil
+					}
+					return rawData
+				}
+				start := fr.Start
+				if start == 0 && !s.Trailing {
+					// 跳过索引信息
+					if rawData := read(); rawData != nil {
+						framePool.Put(rawData)
+					}
+					bar.Increment()
+					start = 1
+				}
+				err = DecodePipeline(rangeThreads, start, read, decode, write, slow, writeFallback)
+				ffmpegStdout.Close()
+				waitErr := ffmpegProcess.Wait()
+				if err != nil {
+					return err
 				}
-				i++
+				if waitErr != nil {
+					return fmt.Errorf("FFmpeg 命令执行失败: %v", waitErr)
+				}
+				return nil
+			}
+			var wg sync.WaitGroup
+			for _, fr := range ranges {
+				wg.Add(1)
+				go func(fr FrameRange) {
+					defer wg.Done()
+					if err := decodeRange(fr); err != nil {
+						writeMutex.Lock()
+						if rangeErr == nil {
+							rangeErr = err
+						}
+						writeMutex.Unlock()
+					}
+				}(fr)
 			}
+			wg.Wait()
 			bar.Finish()
-			ffmpegStdout.Close()
-			err = ffmpegProcess.Wait()
+			if rangeErr != nil {
+				fmt.Fprintln(logOut, de, rangeErr)
+				return
+			}
+		}
+		missingFrames := make([]int, 0)
+		if frameWriter != nil {
+			err = frameWriter.Finish()
 			if err != nil {
-				fmt.Println(de, "FFmpeg 命令执行失败:", err)
+				fmt.Fprintln(logOut, de, "无法截断输出文件:", err)
 				return
 			}
+			missingFrames = frameWriter.Missing()
+		}
+		if restoreDone != nil {
+			<-restoreDone
 		}
 		outputFile.Close()
+		if err := review.Close(); err != nil {
+			fmt.Fprintln(logOut, de, "无法写入待检查目录:", err)
+		}
+
+		// 仍有数据帧缺失时保留帧数据文件并写入清单，手动扫描待检查目录中的视频帧后由 resolve 命令补全
+		if len(missingFrames) > 0 {
+			m := ReviewManifest{Hash: targetHash, Index: s, Stream: streamFilePath, Output: outputFilePath, Missing: missingFrames, RequireSignature: requireSignature, Rename: outputPath == ""}
+			if outputPath == StdioPath || streamFilePath != outputFilePath {
+				m.Stream = filepath.Join(review.Path, ReviewStreamName)
+				if err := MoveFile(streamFilePath, m.Stream); err != nil {
+					fmt.Fprintln(logOut, de, "无法将帧数据文件移动到待检查目录:", err)
+					return
+				}
+			}
+			if outputPath == StdioPath {
+				m.Output = ""
+			}
+			if m.Stream, err = filepath.Abs(m.Stream); err == nil && m.Output != "" {
+				m.Output, err = filepath.Abs(m.Output)
+			}
+			if err == nil {
+				err = review.WriteManifest(m)
+			}
+			if err != nil {
+				fmt.Fprintln(logOut, de, "无法写入待检查目录清单:", err)
+				return
+			}
+			fmt.Fprintln(logOut, de, "错误: 有", len(missingFrames), "个数据帧缺失，无法还原文件")
+			report.Print(logOut, missingFrames, s.Slice, s.Size)
+			fmt.Fprintln(logOut, de, "无法识别的视频帧已保存到待检查目录:", review.Path, "共", review.Saved(), "个")
+			fmt.Fprintln(logOut, de, "请使用其他二维码扫描工具扫描这些图片，每行一个结果保存到文件后执行:")
+			fmt.Fprintln(logOut, de, "  "+os.Args[0], "resolve -d", review.Path, "-r <结果文件>")
+			continue
+		}
+		if err := review.Remove(); err != nil {
+			fmt.Fprintln(logOut, de, "无法删除待检查目录:", err)
+		}
+
+		// 解密与解压
+		expectedHash := targetHash
+		if streamFilePath != outputFilePath {
+			result, err := restoreResult, restoreErr
+			if restoreDone == nil {
+				fmt.Fprintln(logOut, de, "开始还原数据，是否加密:", s.Crypt != nil, "压缩算法:", s.Compress)
+				result, err = RestoreFile(s.Crypt, cryptKey, s.Compress, s.RawSize, streamFilePath, outputFilePath)
+			}
+			_ = os.Remove(streamFilePath)
+			if err == nil {
+				expectedHash, err = result.ExpectedHash(targetHash)
+			}
+			if err != nil {
+				_ = os.Remove(outputFilePath)
+				fmt.Fprintln(logOut, de, "错误: 还原数据失败:", err)
+				continue
+			}
+			if result.Sealed != nil {
+				s.Name, s.Summary = result.Sealed.Name, result.Sealed.Summary
+				if outputPath == "" {
+					if outputFilePath, err = RenameSealedOutput(outputFilePath, s.Name); err != nil {
+						fmt.Fprintln(logOut, de, "无法按加密文件中的文件名重命名输出文件:", err)
+					}
+				}
+			}
+		}
 
 		// 计算Hash
 		OutputFileHash, err := CalculateFileHash(outputFilePath)
 		if err != nil {
-			fmt.Println(de, "无法计算输出文件Hash:", err)
+			fmt.Fprintln(logOut, de, "无法计算输出文件Hash:", err)
 			return
 		}
 
-		fmt.Println(de, "完成")
-		fmt.Println(de, "使用配置：")
-		fmt.Println(de, "  ---------------------------")
-		fmt.Println(de, "  视频宽度:", s.Width)
-		fmt.Println(de, "  视频高度:", s.Height)
-		fmt.Println(de, "  识别放大倍数:", videoResizeTimes)
-		fmt.Println(de, "  分段帧数:", s.frameCount)
-		fmt.Println(de, "  总帧数:", s.frameCount*s.Len)
-		fmt.Println(de, "  总分段个数:", s.Len)
-		fmt.Println(de, "  查找到的分段个数:", len(s.Path))
-		fmt.Println(de, "  分段文件是否完整:", true)
-		fmt.Println(de, "  输入视频路径:")
+		fmt.Fprintln(logOut, de, "完成")
+		fmt.Fprintln(logOut, de, "使用配置：")
+		fmt.Fprintln(logOut, de, "  ---------------------------")
+		fmt.Fprintln(logOut, de, "  视频宽度:", s.Width)
+		fmt.Fprintln(logOut, de, "  视频高度:", s.Height)
+		fmt.Fprintln(logOut, de, "  识别放大倍数:", videoResizeTimes)
+		fmt.Fprintln(logOut, de, "  分段帧数:", s.frameCount)
+		fmt.Fprintln(logOut, de, "  总帧数:", s.frameCount*s.Len)
+		fmt.Fprintln(logOut, de, "  总分段个数:", s.Len)
+		fmt.Fprintln(logOut, de, "  查找到的分段个数:", s.Found())
+		fmt.Fprintln(logOut, de, "  分段文件是否完整:", true)
+		fmt.Fprintln(logOut, de, "  输入视频路径:")
 		for _, path := range s.Path {
-			fmt.Println(de, "      ", path)
-		}
-		fmt.Println(de, "  输出文件路径:", outputFilePath)
-		fmt.Println(de, "  摘要:", s.Summary)
-		fmt.Println(de, "  输入文件Hash:", targetHash)
-		fmt.Println(de, "  输出文件Hash:", OutputFileHash)
-		if OutputFileHash != targetHash {
-			fmt.Println(de, "  错误：输出文件与输入文件不一致")
+			fmt.Fprintln(logOut, de, "      ", path)
+		}
+		fmt.Fprintln(logOut, de, "  输出文件路径:", outputFilePath)
+		fmt.Fprintln(logOut, de, "  摘要:", s.Summary)
+		fmt.Fprintln(logOut, de, "  输入文件Hash:", expectedHash)
+		fmt.Fprintln(logOut, de, "  输出文件Hash:", OutputFileHash)
+		fmt.Fprintln(logOut, de, "  签名:", s.Signature)
+		if frameWriter != nil {
+			fmt.Fprintln(logOut, de, "  重复帧数:", frameWriter.Duplicates())
+			fmt.Fprintln(logOut, de, "  不属于此文件的帧数:", frameWriter.Foreign())
+			fmt.Fprintln(logOut, de, "  丢失帧数:", len(missingFrames))
+		}
+		if OutputFileHash != expectedHash {
+			fmt.Fprintln(logOut, de, "  错误：输出文件与输入文件不一致")
+			if outputPath == StdioPath {
+				fmt.Fprintln(logOut, de, "  错误：不输出到标准输出")
+			}
+			// 签名只覆盖索引中的 Hash，内容不一致的文件不能以输出文件名留在磁盘上
+			if requireSignature {
+				fmt.Fprintln(logOut, de, "  ---------------------------")
+				if err := os.Remove(outputFilePath); err != nil && !os.IsNotExist(err) {
+					fmt.Fprintln(logOut, de, "错误: 无法删除未通过校验的输出文件:", err)
+				} else {
+					fmt.Fprintln(logOut, de, "错误: 已启用 --require-signature，已删除未通过校验的输出文件", outputFilePath)
+				}
+				return
+			}
 		} else {
-			fmt.Println(de, "  输出文件与输入文件一致")
+			fmt.Fprintln(logOut, de, "  输出文件与输入文件一致")
+			if s.Signature == SignatureTrusted {
+				fmt.Fprintln(logOut, de, "  输出文件来自受信任的签名者")
+			}
+		}
+		fmt.Fprintln(logOut, de, "  ---------------------------")
+		if frameWriter != nil {
+			report.Print(logOut, missingFrames, s.Slice, s.Size)
+		}
+		if outputPath == StdioPath && OutputFileHash == expectedHash {
+			err = CopyFileTo(os.Stdout, outputFilePath)
+			if err != nil {
+				fmt.Fprintln(logOut, de, "输出到标准输出失败:", err)
+				return
+			}
 		}
-		fmt.Println(de, "  ---------------------------")
 
 		allEndTime := time.Now()
 		allDuration := allEndTime.Sub(allStartTime)
-		fmt.Printf(de+" 总共耗时%f秒\n", allDuration.Seconds())
+		fmt.Fprintf(logOut, de+" 总共耗时%f秒\n", allDuration.Seconds())
 	}
 }
 
@@ -1002,11 +2076,11 @@ func AutoRun() {
 		}
 		if input == "1" {
 			clearScreen()
-			Encode("", 0, 350, -8, 24, 10800, "medium", "")
+			Encode("", "", 0, 350, -8, 24, 10800, "medium", "", 0, 20, 0, "", nil, nil, CompressNone, PayloadBase64, 1, 1, false, "", CodecQR, SymbolQR, 0, 0, CanvasQuietZone, 0, PipeRaw)
 			break
 		} else if input == "2" {
 			clearScreen()
-			Decode("", -1)
+			Decode("", "", "", -1, "", "", nil, false, 0, 1, nil, nil)
 			break
 		} else if input == "3" {
 			os.Exit(0)
@@ -1017,6 +2091,18 @@ func AutoRun() {
 	}
 }
 
+// stringsFlag 为可重复指定的字符串参数
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Usage = func() {
@@ -1025,34 +2111,118 @@ func main() {
 		fmt.Fprintln(os.Stdout, "\nCommands:")
 		fmt.Fprintln(os.Stdout, "encode\tEncode a file")
 		fmt.Fprintln(os.Stdout, " Options:")
-		fmt.Fprintln(os.Stdout, " -i\tThe input file to encode")
+		fmt.Fprintln(os.Stdout, " -i\tThe input file to encode, - for stdin")
+		fmt.Fprintln(os.Stdout, " -o\tThe output video path(default=\"\", output_<name>/<name>.mp4 next to the input)")
 		fmt.Fprintln(os.Stdout, " -q\tThe qrcode error correction level(default=0), 0-3")
 		fmt.Fprintln(os.Stdout, " -s\tThe qrcode size(default=-8), -16~1000")
-		fmt.Fprintln(os.Stdout, " -d\tThe data slice length(default=350), 50-1500")
+		fmt.Fprintln(os.Stdout, " -d\tThe data slice length(default=350), the max for -q 0/1/2/3: 2197/1729/1228/937(base64), 2847/2243/1595/1217(base45), 2936/2314/1646/1256(binary)")
 		fmt.Fprintln(os.Stdout, " -p\tThe output video fps setting(default=24), 1-60")
 		fmt.Fprintln(os.Stdout, " -l\tThe output video max segment length(seconds) setting(default=10800), 1-10^9")
 		fmt.Fprintln(os.Stdout, " -m\tFFmpeg mode(default=medium): ultrafast, superfast, veryfast, faster, fast, medium, slow, slower, veryslow, placebo")
 		fmt.Fprintln(os.Stdout, " -a\tAn summary you would like to add to this document(default=\"\")")
+		fmt.Fprintln(os.Stdout, " -r\tThe fountain code overhead ratio(default=0, disabled), 0-10")
+		fmt.Fprintln(os.Stdout, " -n\tThe data frames per Reed-Solomon parity group(default=20), 1-254")
+		fmt.Fprintln(os.Stdout, " -k\tThe parity frames appended to each group(default=0, disabled), 0-254, n+k<=255")
+		fmt.Fprintln(os.Stdout, " -e\tThe password to encrypt the file with(default=\"\", disabled), alias --password")
+		fmt.Fprintln(os.Stdout, " -R\tA recipient public key or a file of public keys to encrypt to, can be repeated")
+		fmt.Fprintln(os.Stdout, " -S\tThe signing key file to sign the index with(default=\"\", disabled)")
+		fmt.Fprintln(os.Stdout, " -z\tThe compression applied before encoding(default=none): none, zstd, gzip, xz, auto")
+		fmt.Fprintln(os.Stdout, " -b\tThe frame payload encoding in the qrcode(default=base64): base64, base45, binary")
+		fmt.Fprintln(os.Stdout, " -c\tColor mode, place three qrcodes in the R, G and B channels of each video frame")
+		fmt.Fprintln(os.Stdout, " -f\tThe output video pixel format(default=\"\", ffmpeg default, "+ColorPixelFormat+" in color mode)")
+		fmt.Fprintln(os.Stdout, " -C\tThe frame codec(default=qr): qr, gray4(2 bits per module), gray8(3 bits per module), block(macroblock aligned cells with inner Reed-Solomon code)")
+		fmt.Fprintln(os.Stdout, " --symbol\tThe 2D symbology of the data frames(default=qr): qr, datamatrix, aztec")
+		fmt.Fprintln(os.Stdout, " --resolution\tDraw every frame on a fixed canvas, width x height(default=\"\", disabled), e.g. 1920x1080")
+		fmt.Fprintln(os.Stdout, " --quiet-zone\tThe quiet zone around each qrcode on the fixed canvas in modules(default=4)")
+		fmt.Fprintln(os.Stdout, " --threads\tThe number of frame rendering threads(default=0, all CPU cores)")
+		fmt.Fprintln(os.Stdout, " --pipe\tHow frames are written to ffmpeg(default=raw): raw(uncompressed gray/rgb24 frames), png(compatibility fallback)")
+		fmt.Fprintln(os.Stdout, " -g\tThe grid of qrcodes in each video frame, columns x rows(default=1x1), alias --grid, e.g. 2x2, 3x3")
 		fmt.Fprintln(os.Stdout, "decode\tDecode a file")
 		fmt.Fprintln(os.Stdout, " Options:")
-		fmt.Fprintln(os.Stdout, " -i\tThe input file to decode")
+		fmt.Fprintln(os.Stdout, " -i\tThe input dir or video file to decode")
+		fmt.Fprintln(os.Stdout, " -o\tThe output file path(default=\"\", output_<name> in the input dir), - for stdout")
+		fmt.Fprintln(os.Stdout, " --hash\tThe hash of the file to decode, or all to decode every file(default=\"\", prompt)")
 		fmt.Fprintln(os.Stdout, " -x\tThe bigNx of the qrcode in the video(default=-1, adaptive), -1||0.0<x<=10.0")
+		fmt.Fprintln(os.Stdout, " -e\tThe password to decrypt the file with, alias --password, or set "+PasswordEnv+"(default: prompt)")
+		fmt.Fprintln(os.Stdout, " -I\tThe identity file to decrypt the file with, or set "+IdentityEnv)
+		fmt.Fprintln(os.Stdout, " -T\tA trusted signer public key or a file of public keys, can be repeated")
+		fmt.Fprintln(os.Stdout, " --require-signature\tRefuse to decode files without a valid signature from a trusted signer")
+		fmt.Fprintln(os.Stdout, " --threads\tThe number of frame decoding threads(default=0, all CPU cores)")
+		fmt.Fprintln(os.Stdout, " --readers\tThe number of ffmpeg readers decoding time ranges of each video in parallel(default=1)")
+		fmt.Fprintln(os.Stdout, " --decoders\tThe qrcode decoders tried in order(default="+DefaultDecoders+"): "+strings.Join(FrameDecoderNames(), ", ")+", the first one runs in the decoding threads")
+		fmt.Fprintln(os.Stdout, " --helper\tThe command of the persistent pyzbar helper process, quote arguments containing spaces(default=\"\", python3 lumina_qrcode.py next to the program)")
+		fmt.Fprintln(os.Stdout, "resolve\tPatch a decoded file with manually scanned results of the frames saved in its review dir")
+		fmt.Fprintln(os.Stdout, " Options:")
+		fmt.Fprintln(os.Stdout, " -d\tThe review dir written by decode, lumina_review_<hash> next to the output file")
+		fmt.Fprintln(os.Stdout, " -r\tThe file of scanned results, one qrcode per line(base64 of the raw bytes for binary payload)")
+		fmt.Fprintln(os.Stdout, " -o\tThe output file path(default=\"\", the output path of decode), - for stdout")
+		fmt.Fprintln(os.Stdout, " -e\tThe password to decrypt the file with, alias --password, or set "+PasswordEnv+"(default: prompt)")
+		fmt.Fprintln(os.Stdout, " -I\tThe identity file to decrypt the file with, or set "+IdentityEnv)
+		fmt.Fprintln(os.Stdout, "keygen\tGenerate a key pair for public-key encryption")
+		fmt.Fprintln(os.Stdout, " Options:")
+		fmt.Fprintln(os.Stdout, " -o\tThe identity file to write(default=\"\", stdout)")
+		fmt.Fprintln(os.Stdout, " -s\tGenerate an Ed25519 signing key pair instead")
 		fmt.Fprintln(os.Stdout, "help\tShow this help")
 		flag.PrintDefaults()
 	}
 	encodeFlag := flag.NewFlagSet("encode", flag.ExitOnError)
-	encodeInput := encodeFlag.String("i", "", "The input file to encode")
+	encodeInput := encodeFlag.String("i", "", "The input file to encode, - for stdin")
+	encodeOutput := encodeFlag.String("o", "", "The output video path(default=\"\", output_<name>/<name>.mp4 next to the input)")
 	encodeQrcodeErrorCorrection := encodeFlag.Int("q", 0, "The qrcode error correction level(default=0), 0-3")
 	encodeQrcodeSize := encodeFlag.Int("s", -8, "The qrcode size(default=-8), -16~1000")
-	encodeDataSliceLen := encodeFlag.Int("d", 350, "The data slice length(default=350), 50-1500")
+	encodeDataSliceLen := encodeFlag.Int("d", 350, "The data slice length(default=350), the max for -q 0/1/2/3: 2197/1729/1228/937(base64), 2847/2243/1595/1217(base45), 2936/2314/1646/1256(binary)")
 	encodeOutputFPS := encodeFlag.Int("p", 24, "The output video fps setting(default=24), 1-60")
 	encodeSegmentSeconds := encodeFlag.Int("l", 10800, "The output video max segment length(seconds) setting(default=10800), 1-10^9")
 	encodeFFmpegMode := encodeFlag.String("m", "medium", "FFmpeg mode(default=medium): ultrafast, superfast, veryfast, faster, fast, medium, slow, slower, veryslow, placebo")
 	encodeSummary := encodeFlag.String("a", "", "An summary you would like to add to this document(default=\"\")")
+	encodeFountainRatio := encodeFlag.Float64("r", 0, "The fountain code overhead ratio(default=0, disabled), 0-10")
+	encodeParityN := encodeFlag.Int("n", 20, "The data frames per Reed-Solomon parity group(default=20), 1-254")
+	encodeParityK := encodeFlag.Int("k", 0, "The parity frames appended to each group(default=0, disabled), 0-254, n+k<=255")
+	encodePassword := encodeFlag.String("e", "", "The password to encrypt the file with(default=\"\", disabled)")
+	encodeFlag.StringVar(encodePassword, "password", "", "Alias of -e")
+	var encodeRecipients stringsFlag
+	encodeFlag.Var(&encodeRecipients, "R", "A recipient public key or a file of public keys to encrypt to, can be repeated")
+	encodeSigningKey := encodeFlag.String("S", "", "The signing key file to sign the index with(default=\"\", disabled)")
+	encodeCompression := encodeFlag.String("z", CompressNone, "The compression applied before encoding(default=none): none, zstd, gzip, xz, auto")
+	encodePayload := encodeFlag.String("b", PayloadBase64, "The frame payload encoding in the qrcode(default=base64): base64, base45, binary")
+	encodeColor := encodeFlag.Bool("c", false, "Color mode, place three qrcodes in the R, G and B channels of each video frame")
+	encodePixFmt := encodeFlag.String("f", "", "The output video pixel format(default=\"\", ffmpeg default, "+ColorPixelFormat+" in color mode)")
+	encodeCodec := encodeFlag.String("C", CodecQR, "The frame codec(default=qr): qr, gray4(2 bits per module), gray8(3 bits per module), block(macroblock aligned cells with inner Reed-Solomon code)")
+	encodeSymbol := encodeFlag.String("symbol", SymbolQR, "The 2D symbology of the data frames(default=qr): qr, datamatrix, aztec")
+	encodeResolution := encodeFlag.String("resolution", "", "Draw every frame on a fixed canvas, width x height(default=\"\", disabled), e.g. 1920x1080")
+	encodeQuietZone := encodeFlag.Int("quiet-zone", CanvasQuietZone, "The quiet zone around each qrcode on the fixed canvas in modules(default=4)")
+	encodeThreads := encodeFlag.Int("threads", 0, "The number of frame rendering threads(default=0, all CPU cores)")
+	encodePipe := encodeFlag.String("pipe", PipeRaw, "How frames are written to ffmpeg(default=raw): raw(uncompressed gray/rgb24 frames), png(compatibility fallback)")
+	encodeGrid := encodeFlag.String("g", "1x1", "The grid of qrcodes in each video frame, columns x rows(default=1x1), e.g. 2x2, 3x3")
+	encodeFlag.StringVar(encodeGrid, "grid", "1x1", "Alias of -g")
 
 	decodeFlag := flag.NewFlagSet("decode", flag.ExitOnError)
-	decodeInputDir := decodeFlag.String("i", "", "The input dir include video segments to decode")
+	decodeInputDir := decodeFlag.String("i", "", "The input dir include video segments or the video file to decode")
+	decodeOutput := decodeFlag.String("o", "", "The output file path(default=\"\", output_<name> in the input dir), - for stdout")
+	decodeHash := decodeFlag.String("hash", "", "The hash of the file to decode, or all to decode every file(default=\"\", prompt)")
 	decodeBigNx := decodeFlag.Float64("x", -1, "The bigNx of the qrcode in the video(default=-1, adaptive), -1||0.0<x<=10.0")
+	decodePassword := decodeFlag.String("e", "", "The password to decrypt the file with, or set "+PasswordEnv+"(default: prompt)")
+	decodeFlag.StringVar(decodePassword, "password", "", "Alias of -e")
+	decodeIdentity := decodeFlag.String("I", "", "The identity file to decrypt the file with, or set "+IdentityEnv)
+	var decodeTrusted stringsFlag
+	decodeFlag.Var(&decodeTrusted, "T", "A trusted signer public key or a file of public keys, can be repeated")
+	decodeRequireSignature := decodeFlag.Bool("require-signature", false, "Refuse to decode files without a valid signature from a trusted signer")
+	decodeThreads := decodeFlag.Int("threads", 0, "The number of frame decoding threads(default=0, all CPU cores)")
+	decodeReaders := decodeFlag.Int("readers", 1, "The number of ffmpeg readers decoding time ranges of each video in parallel(default=1)")
+	decodeHelper := decodeFlag.String("helper", "", "The command of the persistent pyzbar helper process, quote arguments containing spaces(default=\"\", python3 lumina_qrcode.py next to the program)")
+	decodeDecoders := decodeFlag.String("decoders", DefaultDecoders, "The qrcode decoders tried in order(default="+DefaultDecoders+"): "+strings.Join(FrameDecoderNames(), ", ")+", the first one runs in the decoding threads")
+
+	resolveFlag := flag.NewFlagSet("resolve", flag.ExitOnError)
+	resolveDir := resolveFlag.String("d", "", "The review dir written by decode, lumina_review_<hash> next to the output file")
+	resolveResults := resolveFlag.String("r", "", "The file of scanned results, one qrcode per line(base64 of the raw bytes for binary payload)")
+	resolveOutput := resolveFlag.String("o", "", "The output file path(default=\"\", the output path of decode), - for stdout")
+	resolvePassword := resolveFlag.String("e", "", "The password to decrypt the file with, or set "+PasswordEnv+"(default: prompt)")
+	resolveFlag.StringVar(resolvePassword, "password", "", "Alias of -e")
+	resolveIdentity := resolveFlag.String("I", "", "The identity file to decrypt the file with, or set "+IdentityEnv)
+
+	keygenFlag := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keygenOutput := keygenFlag.String("o", "", "The identity file to write(default=\"\", stdout)")
+	keygenSign := keygenFlag.Bool("s", false, "Generate an Ed25519 signing key pair instead")
 	if len(os.Args) < 2 {
 		AutoRun()
 		PressEnterToContinue()
@@ -1065,7 +2235,142 @@ func main() {
 			fmt.Println(en, "参数解析错误")
 			return
 		}
-		Encode(*encodeInput, *encodeQrcodeErrorCorrection, *encodeDataSliceLen, *encodeQrcodeSize, *encodeOutputFPS, *encodeSegmentSeconds, *encodeFFmpegMode, *encodeSummary)
+		if *encodeFountainRatio < 0 || *encodeFountainRatio > 10 {
+			fmt.Println(en, "喷泉码冗余比例需要在 0-10 之间，请重新输入")
+			flag.Usage()
+			return
+		}
+		if *encodeParityK < 0 || *encodeParityN < 1 || *encodeParityN+*encodeParityK > 255 {
+			fmt.Println(en, "校验帧参数需要满足 n>=1, k>=0, n+k<=255，请重新输入")
+			flag.Usage()
+			return
+		}
+		if *encodeParityK > 0 && *encodeFountainRatio > 0 {
+			fmt.Println(en, "喷泉码与校验帧不能同时使用，请重新输入")
+			flag.Usage()
+			return
+		}
+		recipients, err := ParseRecipients(encodeRecipients)
+		if err != nil {
+			fmt.Println(en, "接收者公钥解析错误:", err)
+			return
+		}
+		if len(recipients) > 0 && *encodePassword != "" {
+			fmt.Println(en, "密码加密与公钥加密不能同时使用，请重新输入")
+			flag.Usage()
+			return
+		}
+		compression, err := ParseCompression(*encodeCompression)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		payload, err := ParsePayloadMode(*encodePayload)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		if *encodeDataSliceLen < 1 || *encodeDataSliceLen > math.MaxUint16 {
+			fmt.Println(en, "每帧数据长度需要在 1-65535 之间，请重新输入")
+			flag.Usage()
+			return
+		}
+		gridCols, gridRows, err := ParseGrid(*encodeGrid)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		codec, err := ParseCodec(*encodeCodec)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		symbol, err := ParseSymbology(*encodeSymbol)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		if err := CheckSymbolPayload(symbol, payload); err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		if codec != CodecQR && symbol != SymbolQR {
+			fmt.Println(en, "二维码制式只能与 qr 帧编码方式同时使用，请重新输入")
+			flag.Usage()
+			return
+		}
+		if codec == CodecQR {
+			if err := CheckSymbolLevel(symbol, *encodeQrcodeErrorCorrection); err != nil {
+				fmt.Println(en, err)
+				flag.Usage()
+				return
+			}
+		}
+		if codec == CodecQR && (*encodeDataSliceLen < 1 || *encodeDataSliceLen > SymbolMaxSlice(symbol, payload, *encodeQrcodeErrorCorrection)) {
+			fmt.Println(en, "每帧数据长度超出", payload, "编码下", symbol, "在纠错等级", *encodeQrcodeErrorCorrection, "的最大容量", SymbolMaxSlice(symbol, payload, *encodeQrcodeErrorCorrection), "，请重新输入")
+			flag.Usage()
+			return
+		}
+		if codec != CodecQR && (*encodeColor || gridCols*gridRows > 1) {
+			fmt.Println(en, "灰度符号与块编码符号不能与彩色模式或网格布局同时使用，请重新输入")
+			flag.Usage()
+			return
+		}
+		if codec == CodecBlock && (*encodeQrcodeErrorCorrection < 0 || *encodeQrcodeErrorCorrection >= len(BlockECCLevels)) {
+			fmt.Println(en, "纠错等级需要在 0-3 之间，请重新输入")
+			flag.Usage()
+			return
+		}
+		canvasWidth, canvasHeight, err := ParseResolution(*encodeResolution)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		if *encodeOutput == StdioPath {
+			fmt.Println(en, "编码输出为视频文件，不支持输出到标准输出")
+			flag.Usage()
+			return
+		}
+		if *encodeThreads < 0 {
+			fmt.Println(en, "线程数不能为负数，请重新输入")
+			flag.Usage()
+			return
+		}
+		if *encodeQuietZone < 0 {
+			fmt.Println(en, "留白模块数不能为负数，请重新输入")
+			flag.Usage()
+			return
+		}
+		framePipe, err := ParsePipe(*encodePipe)
+		if err != nil {
+			fmt.Println(en, err)
+			flag.Usage()
+			return
+		}
+		pixFmt := *encodePixFmt
+		if *encodeColor {
+			pixFmt, err = CheckColorPixelFormat(pixFmt, *encodeQrcodeSize)
+			if err != nil {
+				fmt.Println(en, err)
+				return
+			}
+		}
+		var signingKey ed25519.PrivateKey
+		if *encodeSigningKey != "" {
+			signingKey, err = LoadSigningKey(*encodeSigningKey)
+			if err != nil {
+				fmt.Println(en, "签名私钥读取错误:", err)
+				return
+			}
+		}
+		Encode(*encodeInput, *encodeOutput, *encodeQrcodeErrorCorrection, *encodeDataSliceLen, *encodeQrcodeSize, *encodeOutputFPS, *encodeSegmentSeconds, *encodeFFmpegMode, *encodeSummary, *encodeFountainRatio, *encodeParityN, *encodeParityK, *encodePassword, recipients, signingKey, compression, payload, gridCols, gridRows, *encodeColor, pixFmt, codec, symbol, canvasWidth, canvasHeight, *encodeQuietZone, *encodeThreads, framePipe)
 	case "decode":
 		err := decodeFlag.Parse(os.Args[2:])
 		if err != nil {
@@ -1077,7 +2382,62 @@ func main() {
 			flag.Usage()
 			return
 		}
-		Decode(*decodeInputDir, *decodeBigNx)
+		if *decodeThreads < 0 {
+			fmt.Println(de, "线程数不能为负数，请重新输入")
+			flag.Usage()
+			return
+		}
+		if *decodeReaders < 1 {
+			fmt.Println(de, "读取进程数不能小于 1，请重新输入")
+			flag.Usage()
+			return
+		}
+		decoders, err := ParseDecoders(*decodeDecoders)
+		if err != nil {
+			fmt.Println(de, "识别方式错误:", err)
+			flag.Usage()
+			return
+		}
+		trustedKeys, err := ParseTrustedKeys(decodeTrusted)
+		if err != nil {
+			fmt.Println(de, "信任公钥解析错误:", err)
+			return
+		}
+		if *decodeRequireSignature && len(trustedKeys) == 0 {
+			fmt.Println(de, "启用 --require-signature 时需要通过 -T 参数指定信任的签名公钥")
+			flag.Usage()
+			return
+		}
+		helper, err := ParseHelperCommand(*decodeHelper)
+		if err != nil {
+			fmt.Println(de, err)
+			flag.Usage()
+			return
+		}
+		Decode(*decodeInputDir, *decodeOutput, *decodeHash, *decodeBigNx, *decodePassword, *decodeIdentity, trustedKeys, *decodeRequireSignature, *decodeThreads, *decodeReaders, decoders, helper)
+	case "resolve":
+		err := resolveFlag.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println("Resolve: 参数解析错误")
+			return
+		}
+		if *resolveDir == "" || *resolveResults == "" {
+			fmt.Println("Resolve: 需要通过 -d 指定待检查目录，并通过 -r 指定扫描结果文件")
+			flag.Usage()
+			return
+		}
+		Resolve(*resolveDir, *resolveResults, *resolveOutput, *resolvePassword, *resolveIdentity)
+	case "keygen":
+		err := keygenFlag.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println("KeyGen: 参数解析错误")
+			return
+		}
+		if *keygenSign {
+			SignKeyGen(*keygenOutput)
+			return
+		}
+		KeyGen(*keygenOutput)
 	case "help":
 		flag.Usage()
 		return
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/maruel/rs"
+	"io"
+	"rsc.io/qr/gf256"
+	"sort"
+)
+
+// ParityField 与 rs.QRCodeField256 使用相同的本原多项式，用于擦除纠错
+var ParityField = gf256.NewField(0x11D, 2)
+
+// ParityLayout 描述每组 N 个数据帧后追加 K 个校验帧的划分，校验在各帧同一字节位置上按 RS(N+K, N) 计算
+type ParityLayout struct {
+	DataCount int // 数据帧总数
+	N         int
+	K         int
+}
+
+// Groups 返回帧组数量
+func (l ParityLayout) Groups() int {
+	return (l.DataCount + l.N - 1) / l.N
+}
+
+// GroupData 返回第 group 组的数据帧数(最后一组可能更少)
+func (l ParityLayout) GroupData(group int) int {
+	if group == l.Groups()-1 {
+		return l.DataCount - group*l.N
+	}
+	return l.N
+}
+
+// Count 返回数据帧与校验帧的总数
+func (l ParityLayout) Count() int {
+	return l.DataCount + l.Groups()*l.K
+}
+
+// ParitySource 在内部数据帧来源的每组数据帧之后插入校验帧
+type ParitySource struct {
+	inner       FrameSource
+	fileID      [4]byte
+	n           int
+	k           int
+	slice       int
+	encoder     rs.Encoder
+	dataGroup   int
+	dataCount   int
+	cacheGroup  int
+	cacheParity [][]byte
+}
+
+func NewParitySource(inner FrameSource, fileID [4]byte, slice int, n int, k int) *ParitySource {
+	return &ParitySource{
+		inner:      inner,
+		fileID:     fileID,
+		n:          n,
+		k:          k,
+		slice:      slice,
+		encoder:    rs.NewEncoder(rs.QRCodeField256, k),
+		dataGroup:  -1,
+		cacheGroup: -1,
+	}
+}
+
+// groupData 返回第 group 组的数据帧数(最后一组可能更少)，0 表示该组不存在
+func (p *ParitySource) groupData(group int) int {
+	if p.dataGroup != group {
+		p.dataGroup, p.dataCount = group, 0
+		for p.dataCount < p.n && p.inner.Has(group*p.n+p.dataCount) {
+			p.dataCount++
+		}
+	}
+	return p.dataCount
+}
+
+func (p *ParitySource) Has(seq int) bool {
+	stride := p.n + p.k
+	n := p.groupData(seq / stride)
+	return n > 0 && seq%stride < n+p.k
+}
+
+func (p *ParitySource) Frame(seq int) (FrameHeader, []byte) {
+	stride := p.n + p.k
+	group := seq / stride
+	r := seq % stride
+	n := p.groupData(group)
+	if r < n {
+		return p.inner.Frame(group*p.n + r)
+	}
+	if p.cacheGroup != group {
+		p.cacheParity = p.groupParity(group, n)
+		p.cacheGroup = group
+	}
+	m := r - n
+	return FrameHeader{Kind: FrameKindParity, FileID: p.fileID, Seq: uint32(group*p.k + m)}, p.cacheParity[m]
+}
+
+// groupParity 计算第 group 组的 K 个校验帧
+func (p *ParitySource) groupParity(group int, n int) [][]byte {
+	shards := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		_, shards[i] = p.inner.Frame(group*p.n + i)
+	}
+	parity := make([][]byte, p.k)
+	for m := range parity {
+		parity[m] = make([]byte, p.slice)
+	}
+	column := make([]byte, n)
+	ecc := make([]byte, p.k)
+	for j := 0; j < p.slice; j++ {
+		for i, shard := range shards {
+			column[i] = 0
+			if j < len(shard) {
+				column[i] = shard[j]
+			}
+		}
+		p.encoder.Encode(column, ecc)
+		for m := range parity {
+			parity[m][j] = ecc[m]
+		}
+	}
+	return parity
+}
+
+// ParityWriter 在 FrameWriter 的基础上收集校验帧，结束时用校验帧重建每组中丢失或无法识别的数据帧
+type ParityWriter struct {
+	*FrameWriter
+	layout    ParityLayout
+	parity    map[int][][]byte
+	recovered int
+	log       io.Writer
+}
+
+// NewParityWriter 创建校验帧接收器，log 为重建结果的输出位置
+func NewParityWriter(w *FrameWriter, n int, k int, log io.Writer) *ParityWriter {
+	return &ParityWriter{
+		FrameWriter: w,
+		log:         log,
+		layout:      ParityLayout{DataCount: len(w.received), N: n, K: k},
+		parity:      make(map[int][][]byte),
+	}
+}
+
+func (w *ParityWriter) Write(h FrameHeader, payload []byte) error {
+	if h.Kind != FrameKindParity {
+		return w.FrameWriter.Write(h, payload)
+	}
+	if h.FileID != w.fileID {
+		w.foreign++
+		return errors.New("帧不属于当前文件")
+	}
+	group := int(h.Seq) / w.layout.K
+	m := int(h.Seq) % w.layout.K
+	if group >= w.layout.Groups() {
+		return fmt.Errorf("校验帧序号超出范围: %d", h.Seq)
+	}
+	if len(payload) != w.slice {
+		return fmt.Errorf("校验帧长度不匹配: %d", len(payload))
+	}
+	if _, ok := w.parity[group]; !ok {
+		w.parity[group] = make([][]byte, w.layout.K)
+	}
+	if w.parity[group][m] != nil {
+		w.dup++
+		return nil
+	}
+	w.parity[group][m] = append([]byte(nil), payload...)
+	return nil
+}
+
+// Finish 重建所有可恢复的帧组并截断输出文件
+func (w *ParityWriter) Finish() error {
+	groups := make([]int, 0, len(w.parity))
+	for group := range w.parity {
+		groups = append(groups, group)
+	}
+	sort.Ints(groups)
+	for _, group := range groups {
+		if err := w.recoverGroup(group); err != nil {
+			fmt.Fprintln(w.log, de, "第", group, "组数据帧无法重建:", err)
+		}
+	}
+	if w.recovered > 0 {
+		fmt.Fprintln(w.log, de, "已通过校验帧重建", w.recovered, "个数据帧")
+	}
+	return w.FrameWriter.Finish()
+}
+
+// Redundant 判断数据帧是否为校验帧
+func (w *ParityWriter) Redundant(h FrameHeader) bool {
+	return h.Kind == FrameKindParity
+}
+
+// Recovered 返回通过校验帧重建的数据帧数量
+func (w *ParityWriter) Recovered() int {
+	return w.recovered
+}
+
+func (w *ParityWriter) recoverGroup(group int) error {
+	n := w.layout.GroupData(group)
+	k := w.layout.K
+	base := group * w.layout.N
+	// 码字位置: 0..n-1 为数据帧，n..n+k-1 为校验帧
+	erased := make([]int, 0)
+	for i := 0; i < n; i++ {
+		if !w.received[base+i] {
+			erased = append(erased, i)
+		}
+	}
+	if len(erased) == 0 {
+		return nil
+	}
+	missingData := len(erased)
+	for m, shard := range w.parity[group] {
+		if shard == nil {
+			erased = append(erased, n+m)
+		}
+	}
+	if len(erased) > k {
+		return fmt.Errorf("丢失 %d 个数据帧，可用校验帧 %d 个", missingData, k+missingData-len(erased))
+	}
+	shards := make([][]byte, n+k)
+	for i := 0; i < n; i++ {
+		if !w.received[base+i] {
+			continue
+		}
+		shards[i] = make([]byte, w.slice)
+		_, err := w.file.ReadAt(shards[i], int64(base+i)*int64(w.slice))
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	for m, shard := range w.parity[group] {
+		shards[n+m] = shard
+	}
+	values, err := ParityRecover(shards, erased, w.slice)
+	if err != nil {
+		return err
+	}
+	for idx, pos := range erased {
+		if pos >= n {
+			continue
+		}
+		seq := base + pos
+		offset := int64(seq) * int64(w.slice)
+		payload := values[idx]
+		if offset+int64(len(payload)) > w.size {
+			payload = payload[:w.size-offset]
+		}
+		h := FrameHeader{Kind: FrameKindData, FileID: w.fileID, Seq: uint32(seq)}
+		if err := w.FrameWriter.Write(h, payload); err != nil {
+			return err
+		}
+		w.recovered++
+	}
+	return nil
+}
+
+// ParityRecover 对码字中已知位置的擦除求解，shards 中擦除位置的元素可为 nil，返回与 erased 一一对应的数据
+// 码字 c 满足 c(α^i) = 0 (i < K)，其中第 t 个分片对应 x^(len-1-t) 的系数
+func ParityRecover(shards [][]byte, erased []int, slice int) ([][]byte, error) {
+	e := len(erased)
+	total := len(shards)
+	if total > 255 {
+		return nil, errors.New("码字长度超过 255")
+	}
+	isErased := make([]bool, total)
+	for _, pos := range erased {
+		isErased[pos] = true
+	}
+	// 构建 e×e 范德蒙矩阵 A[i][k] = X_k^i 并求逆
+	xs := make([]byte, e)
+	for k, pos := range erased {
+		xs[k] = ParityField.Exp(total - 1 - pos)
+	}
+	a := make([][]byte, e)
+	for i := range a {
+		a[i] = make([]byte, 2*e)
+		for k := range xs {
+			a[i][k] = parityPow(xs[k], i)
+		}
+		a[i][e+i] = 1
+	}
+	for col := 0; col < e; col++ {
+		pivot := -1
+		for row := col; row < e; row++ {
+			if a[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("擦除矩阵不可逆")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv := ParityField.Inv(a[col][col])
+		for j := range a[col] {
+			a[col][j] = ParityField.Mul(a[col][j], inv)
+		}
+		for row := 0; row < e; row++ {
+			if row == col || a[row][col] == 0 {
+				continue
+			}
+			f := a[row][col]
+			for j := range a[row] {
+				a[row][j] ^= ParityField.Mul(f, a[col][j])
+			}
+		}
+	}
+	// 预先计算每个已知分片在各个校验根上的权重 (α^i)^(len-1-t)
+	weights := make([][]byte, e)
+	for i := range weights {
+		weights[i] = make([]byte, total)
+		for t := 0; t < total; t++ {
+			weights[i][t] = ParityField.Exp(i * (total - 1 - t) % 255)
+		}
+	}
+	values := make([][]byte, e)
+	for k := range values {
+		values[k] = make([]byte, slice)
+	}
+	syndromes := make([]byte, e)
+	for j := 0; j < slice; j++ {
+		for i := 0; i < e; i++ {
+			var s byte
+			for t, shard := range shards {
+				if isErased[t] || j >= len(shard) {
+					continue
+				}
+				s ^= ParityField.Mul(shard[j], weights[i][t])
+			}
+			syndromes[i] = s
+		}
+		for k := 0; k < e; k++ {
+			var y byte
+			for i := 0; i < e; i++ {
+				y ^= ParityField.Mul(a[k][e+i], syndromes[i])
+			}
+			values[k][j] = y
+		}
+	}
+	return values, nil
+}
+
+func parityPow(x byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if x == 0 {
+		return 0
+	}
+	return ParityField.Exp(ParityField.Log(x) * n % 255)
+}
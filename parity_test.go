@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestParityRebuild(t *testing.T) {
+	fileID := [4]byte{7, 7, 7, 7}
+	const slice, n, k = 32, 5, 2
+	data := testData(slice*n*3 + 17) // 最后一组只有 1 个不完整的数据帧
+	tests := []struct {
+		name    string
+		drop    func(f sourceFrame) bool
+		corrupt func(f sourceFrame) bool
+		missing []int
+	}{
+		{"no loss", nil, nil, nil},
+		{"one per group", func(f sourceFrame) bool { return f.header.Kind == FrameKindData && f.header.Seq%n == 1 }, nil, nil},
+		{"k per group", func(f sourceFrame) bool { return f.header.Kind == FrameKindData && f.header.Seq%n < k }, nil, nil},
+		{"last partial frame", func(f sourceFrame) bool { return f.header.Kind == FrameKindData && f.header.Seq == 15 }, nil, nil},
+		{"data and parity", func(f sourceFrame) bool {
+			return (f.header.Kind == FrameKindData && f.header.Seq == 7) || (f.header.Kind == FrameKindParity && f.header.Seq == 2)
+		}, nil, nil},
+		// 校验失败的帧与丢失的帧一样作为擦除处理
+		{"corrupted", nil, func(f sourceFrame) bool { return f.header.Kind == FrameKindData && f.header.Seq%n == 4 }, nil},
+		{"more than k", func(f sourceFrame) bool {
+			return f.header.Kind == FrameKindData && f.header.Seq >= 5 && f.header.Seq < 8
+		}, nil, []int{5, 6, 7}},
+		{"parity lost too", func(f sourceFrame) bool {
+			return (f.header.Kind == FrameKindData && (f.header.Seq == 10 || f.header.Seq == 11)) || (f.header.Kind == FrameKindParity && f.header.Seq == 4)
+		}, nil, []int{10, 11}},
+	}
+	src := NewParitySource(NewPlainSource(NewStreamData(bytes.NewReader(data), slice*n*2), slice, fileID), fileID, slice, n, k)
+	frames := collectFrames(t, src)
+	if layout := (ParityLayout{DataCount: 16, N: n, K: k}); len(frames) != layout.Count() {
+		t.Fatalf("帧数 %d, 期望 %d", len(frames), layout.Count())
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tempOutput(t)
+			w := NewParityWriter(NewFrameWriter(file, fileID, slice, int64(len(data))), n, k, io.Discard)
+			validate := NewFrameValidator(FrameVersion)
+			lost := 0
+			for _, f := range frames {
+				if tt.drop != nil && tt.drop(f) {
+					lost++
+					continue
+				}
+				raw := MarshalFrame(f.header, f.payload)
+				if tt.corrupt != nil && tt.corrupt(f) {
+					raw[len(raw)-FrameCRCLen-1] ^= 0x55
+				}
+				if validate(raw) != nil {
+					lost++
+					continue
+				}
+				h, payload, err := UnmarshalFrame(raw, FrameVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Write(h, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			missing := w.Missing()
+			if len(missing) != len(tt.missing) {
+				t.Fatalf("缺失帧 %v, 期望 %v", missing, tt.missing)
+			}
+			for i := range missing {
+				if missing[i] != tt.missing[i] {
+					t.Fatalf("缺失帧 %v, 期望 %v", missing, tt.missing)
+				}
+			}
+			out, err := os.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != len(data) {
+				t.Fatalf("输出长度 %d, 期望 %d", len(out), len(data))
+			}
+			for seq := 0; seq*slice < len(data); seq++ {
+				end := (seq + 1) * slice
+				if end > len(data) {
+					end = len(data)
+				}
+				isMissing := false
+				for _, m := range tt.missing {
+					isMissing = isMissing || m == seq
+				}
+				if !isMissing && !bytes.Equal(out[seq*slice:end], data[seq*slice:end]) {
+					t.Errorf("第 %d 帧数据不一致", seq)
+				}
+			}
+			if len(tt.missing) == 0 && lost > 0 && w.Recovered() == 0 {
+				t.Error("没有通过校验帧重建任何数据帧")
+			}
+		})
+	}
+}
+
+func TestParityRecover(t *testing.T) {
+	const n, k = 6, 3
+	data := testData(n)
+	src := NewParitySource(NewPlainSource(NewStreamData(bytes.NewReader(data), n), 1, [4]byte{}), [4]byte{}, 1, n, k)
+	codeword := make([][]byte, 0, n+k)
+	for seq := 0; src.Has(seq); seq++ {
+		_, payload := src.Frame(seq)
+		codeword = append(codeword, append([]byte(nil), payload...))
+	}
+	tests := []struct {
+		name   string
+		erased []int
+	}{
+		{"none", []int{}},
+		{"one data", []int{2}},
+		{"k data", []int{0, 3, 5}},
+		{"data and parity", []int{1, 6, 8}},
+		{"parity only", []int{6, 7, 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shards := make([][]byte, len(codeword))
+			copy(shards, codeword)
+			for _, pos := range tt.erased {
+				shards[pos] = nil
+			}
+			values, err := ParityRecover(shards, tt.erased, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, pos := range tt.erased {
+				if !bytes.Equal(values[i], codeword[pos]) {
+					t.Errorf("位置 %d 恢复为 %x, 期望 %x", pos, values[i], codeword[pos])
+				}
+			}
+		})
+	}
+}
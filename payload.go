@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/makiuchi-d/gozxing"
+	"strings"
+)
+
+// 二维码中数据帧的文本编码方式，写入 IndexData 以便解码时还原，索引二维码始终使用 Base64
+const (
+	PayloadBase64 = "base64"
+	PayloadBase45 = "base45"
+	PayloadBinary = "binary"
+)
+
+// payloadQrByteCapacity 与 payloadQrAlnumCapacity 为 40 版本二维码在 L/M/Q/H 纠错等级下字节模式与字母数字模式的最大容量
+var (
+	payloadQrByteCapacity  = [...]int{2953, 2331, 1663, 1273}
+	payloadQrAlnumCapacity = [...]int{4296, 3391, 2420, 1852}
+)
+
+// base45Charset 为 RFC 9285 规定的 Base45 字符表，恰好是二维码字母数字模式的字符集
+const base45Charset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// ParsePayloadMode 检查数据帧编码方式，空字符串视为 Base64
+func ParsePayloadMode(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", PayloadBase64:
+		return PayloadBase64, nil
+	case PayloadBase45:
+		return PayloadBase45, nil
+	case PayloadBinary, "byte":
+		return PayloadBinary, nil
+	}
+	return "", fmt.Errorf("不支持的数据帧编码方式: %s", name)
+}
+
+// PayloadMaxSlice 返回在指定编码方式与纠错等级(0-3)下单个二维码可以容纳的最大数据长度(不含帧头与校验)
+func PayloadMaxSlice(mode string, level int) int {
+	if level < 0 || level >= len(payloadQrByteCapacity) {
+		return 0
+	}
+	overhead := FrameHeaderLen + FrameCRCLen
+	switch mode {
+	case PayloadBase45:
+		return payloadQrAlnumCapacity[level]/3*2 - overhead
+	case PayloadBinary:
+		return payloadQrByteCapacity[level] - overhead
+	}
+	return payloadQrByteCapacity[level]/4*3 - overhead
+}
+
+// EncodedPayloadLen 返回 n 个字节的帧数据编码后的长度
+func EncodedPayloadLen(n int, mode string) int {
+	switch mode {
+	case PayloadBase45:
+		return n/2*3 + n%2*2
+	case PayloadBinary:
+		return n
+	}
+	return base64.StdEncoding.EncodedLen(n)
+}
+
+// EncodePayload 将帧数据编码为写入二维码的内容
+func EncodePayload(data []byte, mode string) string {
+	switch mode {
+	case PayloadBase45:
+		return Base45Encode(data)
+	case PayloadBinary:
+		return string(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// DecodePayload 将二维码识别结果还原为帧数据
+func DecodePayload(content []byte, mode string) ([]byte, error) {
+	switch mode {
+	case PayloadBase45:
+		return Base45Decode(string(content))
+	case PayloadBinary:
+		return content, nil
+	}
+	return base64.StdEncoding.DecodeString(string(content))
+}
+
+// Base45Encode 按 RFC 9285 将每 2 个字节编码为 3 个字符，末尾单个字节编码为 2 个字符
+func Base45Encode(data []byte) string {
+	var sb strings.Builder
+	sb.Grow((len(data) + 1) / 2 * 3)
+	for i := 0; i+1 < len(data); i += 2 {
+		n := int(data[i])<<8 | int(data[i+1])
+		sb.WriteByte(base45Charset[n%45])
+		sb.WriteByte(base45Charset[n/45%45])
+		sb.WriteByte(base45Charset[n/2025])
+	}
+	if len(data)%2 == 1 {
+		n := int(data[len(data)-1])
+		sb.WriteByte(base45Charset[n%45])
+		sb.WriteByte(base45Charset[n/45])
+	}
+	return sb.String()
+}
+
+// Base45Decode 解码 Base45 字符串
+func Base45Decode(s string) ([]byte, error) {
+	if len(s)%3 == 1 {
+		return nil, errors.New("Base45 长度无效")
+	}
+	values := make([]int, len(s))
+	for i := 0; i < len(s); i++ {
+		v := strings.IndexByte(base45Charset, s[i])
+		if v < 0 {
+			return nil, fmt.Errorf("Base45 字符无效: %q", s[i])
+		}
+		values[i] = v
+	}
+	data := make([]byte, 0, len(s)/3*2+1)
+	for i := 0; i < len(values); i += 3 {
+		if i+2 < len(values) {
+			n := values[i] + values[i+1]*45 + values[i+2]*2025
+			if n > 0xffff {
+				return nil, errors.New("Base45 数据无效")
+			}
+			data = append(data, byte(n>>8), byte(n))
+			continue
+		}
+		n := values[i] + values[i+1]*45
+		if n > 0xff {
+			return nil, errors.New("Base45 数据无效")
+		}
+		data = append(data, byte(n))
+	}
+	return data, nil
+}
+
+// DecodePayloadText 将 gozxing 的识别结果还原为帧数据，二进制模式需配合 payloadDecodeHints 按 ISO-8859-1 识别
+func DecodePayloadText(text string, mode string) ([]byte, error) {
+	if mode == PayloadBinary {
+		data := latin1Bytes(text)
+		if data == nil {
+			return nil, errors.New("识别结果不是 ISO-8859-1 字符")
+		}
+		return data, nil
+	}
+	return DecodePayload([]byte(text), mode)
+}
+
+// payloadDecodeHints 返回 gozxing 的识别参数，二进制模式按 ISO-8859-1 解码字节模式，每个字符对应一个原始字节
+func payloadDecodeHints(mode string) map[gozxing.DecodeHintType]interface{} {
+	if mode != PayloadBinary {
+		return nil
+	}
+	return map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_CHARACTER_SET: "ISO-8859-1"}
+}
+
+// latin1Bytes 将按 ISO-8859-1 解码的识别结果还原为原始字节
+func latin1Bytes(s string) []byte {
+	data := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil
+		}
+		data = append(data, byte(r))
+	}
+	return data
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBase45(t *testing.T) {
+	// RFC 9285 中的示例
+	tests := []struct {
+		data    string
+		encoded string
+	}{
+		{"", ""},
+		{"AB", "BB8"},
+		{"Hello!!", "%69 VD92EX0"},
+		{"base-45", "UJCLQE7W581"},
+		{"ietf!", "QED8WEX0"},
+		{"\x00", "00"},
+		{"\xff\xff", "FGW"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoded, func(t *testing.T) {
+			if got := Base45Encode([]byte(tt.data)); got != tt.encoded {
+				t.Errorf("编码为 %q, 期望 %q", got, tt.encoded)
+			}
+			got, err := Base45Decode(tt.encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte(tt.data)) {
+				t.Errorf("解码为 %q, 期望 %q", got, tt.data)
+			}
+		})
+	}
+	invalid := []string{"GGW", ":::", "0", "BB8A", "bb8", "BB#", "Z9"}
+	for _, s := range invalid {
+		if got, err := Base45Decode(s); err == nil {
+			t.Errorf("%q 解码为 %x, 期望返回错误", s, got)
+		}
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	frame := MarshalFrame(FrameHeader{Kind: FrameKindData, FileID: [4]byte{4, 5, 4, 5}, Seq: 12}, testData(257))
+	for _, mode := range []string{"", PayloadBase64, PayloadBase45, PayloadBinary, "byte", "BASE45"} {
+		t.Run(mode, func(t *testing.T) {
+			mode, err := ParsePayloadMode(mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range [][]byte{frame, frame[:FrameHeaderLen+1], {}} {
+				text := EncodePayload(data, mode)
+				if len(text) != EncodedPayloadLen(len(data), mode) {
+					t.Errorf("编码长度 %d, 期望 %d", len(text), EncodedPayloadLen(len(data), mode))
+				}
+				if mode == PayloadBase45 && strings.Trim(text, base45Charset) != "" {
+					t.Errorf("编码结果含有字母数字模式以外的字符: %q", text)
+				}
+				got, err := DecodePayload([]byte(text), mode)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("解码结果 %x %v", got, err)
+				}
+				// gozxing 按 ISO-8859-1 识别二进制模式，每个字节成为一个字符
+				if mode == PayloadBinary {
+					runes := make([]rune, len(data))
+					for i, b := range data {
+						runes[i] = rune(b)
+					}
+					text = string(runes)
+				}
+				got, err = DecodePayloadText(text, mode)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("识别结果解码为 %x %v", got, err)
+				}
+			}
+		})
+	}
+	if _, err := ParsePayloadMode("base32"); err == nil {
+		t.Error("不支持的编码方式没有返回错误")
+	}
+	if _, err := DecodePayloadText("数据", PayloadBinary); err == nil {
+		t.Error("非 ISO-8859-1 字符没有返回错误")
+	}
+	if _, err := DecodePayload([]byte("abc!"), PayloadBase64); err == nil {
+		t.Error("无效的 Base64 没有返回错误")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"image"
+	"runtime"
+)
+
+// Threads 返回实际使用的协程数，0 表示使用所有 CPU 核心
+func Threads(threads int) int {
+	if threads <= 0 {
+		return runtime.NumCPU()
+	}
+	return threads
+}
+
+// renderJob 为一个视频帧的渲染任务，结果通过 result 返回
+type renderJob struct {
+	frames [][]byte
+	result chan renderResult
+}
+
+type renderResult struct {
+	data []byte
+	err  error
+}
+
+// RenderPipeline 使用 threads 个协程并发渲染视频帧，并按原有顺序写出，输出与顺序渲染完全相同
+// next 在调度协程中按顺序调用，返回下一个视频帧中的所有数据帧，返回 nil 表示结束；帧源不是并发安全的，只在这里读取
+// render 在工作协程中并发调用；write 在调用者的协程中按顺序调用
+// 同时处理中的视频帧最多为 2*threads 个，渲染或写出出错时立即停止
+func RenderPipeline(threads int, next func() [][]byte, render func(frames [][]byte) ([]byte, error), write func(data []byte, frames int) error) error {
+	threads = Threads(threads)
+	jobs := make(chan renderJob)
+	pending := make(chan renderJob, 2*threads)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for {
+			frames := next()
+			if frames == nil {
+				return
+			}
+			job := renderJob{frames: frames, result: make(chan renderResult, 1)}
+			select {
+			case pending <- job:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < threads; w++ {
+		go func() {
+			for job := range jobs {
+				data, err := render(job.frames)
+				job.result <- renderResult{data: data, err: err}
+			}
+		}()
+	}
+
+	for job := range pending {
+		r := <-job.result
+		if r.err != nil {
+			return r.err
+		}
+		if err := write(r.data, len(job.frames)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FrameResult 为一个视频帧的识别结果
+type FrameResult struct {
+	Symbols    [][]byte      // 识别出的数据帧
+	Unreadable int           // 无法识别且没有后备识别方式的符号数
+	Rejected   bool          // 有识别结果未通过帧校验
+	Fallback   []image.Image // 快速识别失败、需要交给后备识别的符号
+}
+
+// FallbackSymbol 为后备队列中的一个符号
+type FallbackSymbol struct {
+	Index int
+	Image image.Image
+}
+
+// FallbackResult 为后备识别的结果，Data 为 nil 表示仍然无法识别
+type FallbackResult struct {
+	FallbackSymbol
+	Data     []byte
+	Rejected bool
+}
+
+type decodeJob struct {
+	index  int
+	raw    []byte
+	result chan FrameResult
+}
+
+// DecodePipeline 使用 threads 个协程并发识别视频帧
+// read 在读取协程中按顺序调用，返回下一个视频帧的原始数据，返回 nil 表示结束，视频帧从 start 开始编号
+// decode 在工作协程中并发调用；write 在调用者的协程中按帧序号顺序调用
+// 快速识别失败的符号放入后备队列，由单独的协程调用 slow 处理，不阻塞快速识别，结果交给 writeFallback，同样在调用者的协程中调用
+// write 或 writeFallback 返回错误时立即停止
+func DecodePipeline(threads int, start int, read func() []byte, decode func(index int, raw []byte) FrameResult, write func(index int, r FrameResult) error,
+	slow func(f FallbackSymbol) FallbackResult, writeFallback func(r FallbackResult) error) error {
+	threads = Threads(threads)
+	jobs := make(chan decodeJob)
+	pending := make(chan decodeJob, 2*threads)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for index := start; ; index++ {
+			raw := read()
+			if raw == nil {
+				return
+			}
+			job := decodeJob{index: index, raw: raw, result: make(chan FrameResult, 1)}
+			select {
+			case pending <- job:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < threads; w++ {
+		go func() {
+			for job := range jobs {
+				job.result <- decode(job.index, job.raw)
+			}
+		}()
+	}
+
+	// 后备队列不限长度，由调用者的协程维护，后备协程一次处理一个符号
+	fallbackIn := make(chan FallbackSymbol)
+	fallbackOut := make(chan FallbackResult)
+	defer close(fallbackIn)
+	go func() {
+		for f := range fallbackIn {
+			r := slow(f)
+			select {
+			case fallbackOut <- r:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var queue []FallbackSymbol
+	inflight := 0
+	// step 等待下一个事件: 当前视频帧的结果、向后备协程提交符号或后备识别的结果
+	step := func(result chan FrameResult) (*FrameResult, error) {
+		var in chan FallbackSymbol
+		var head FallbackSymbol
+		if len(queue) > 0 {
+			in, head = fallbackIn, queue[0]
+		}
+		select {
+		case r := <-result:
+			return &r, nil
+		case in <- head:
+			queue = queue[1:]
+			inflight++
+		case r := <-fallbackOut:
+			inflight--
+			return nil, writeFallback(r)
+		}
+		return nil, nil
+	}
+
+	for job := range pending {
+		for {
+			r, err := step(job.result)
+			if err != nil {
+				return err
+			}
+			if r == nil {
+				continue
+			}
+			for _, img := range r.Fallback {
+				queue = append(queue, FallbackSymbol{Index: job.index, Image: img})
+			}
+			if err := write(job.index, *r); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	for len(queue) > 0 || inflight > 0 {
+		if _, err := step(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
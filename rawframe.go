@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// 视频帧写入 ffmpeg 的方式: 未压缩的原始帧，或兼容旧版本的 PNG 图片
+const (
+	PipeRaw = "raw"
+	PipePNG = "png"
+)
+
+// ParsePipe 检查视频帧写入方式，空字符串视为原始帧
+func ParsePipe(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", PipeRaw:
+		return PipeRaw, nil
+	case PipePNG:
+		return PipePNG, nil
+	}
+	return "", fmt.Errorf("不支持的视频帧写入方式: %s", name)
+}
+
+// FramePipe 将视频帧编码为写入 ffmpeg 标准输入的数据
+// 原始帧模式下所有视频帧大小必须相同，较小的帧居中放入 Width x Height 的白色画布；彩色模式写入 rgb24，否则写入 gray
+type FramePipe struct {
+	Mode   string
+	Width  int
+	Height int
+	Color  bool
+}
+
+// Fit 将原始帧的大小扩大到能容纳 b，宽高取偶数以满足 4:2:0 色度子采样
+func (p *FramePipe) Fit(b image.Rectangle) {
+	if w := (b.Dx() + 1) / 2 * 2; w > p.Width {
+		p.Width = w
+	}
+	if h := (b.Dy() + 1) / 2 * 2; h > p.Height {
+		p.Height = h
+	}
+}
+
+// InputArgs 返回 ffmpeg 从标准输入读取视频帧的参数
+func (p *FramePipe) InputArgs(fps int) []string {
+	if p.Mode == PipePNG {
+		return []string{"-f", "image2pipe", "-vcodec", "png", "-r", fmt.Sprintf("%d", fps), "-i", "-"}
+	}
+	pixFmt := "gray"
+	if p.Color {
+		pixFmt = "rgb24"
+	}
+	return []string{"-f", "rawvideo", "-pix_fmt", pixFmt, "-s", fmt.Sprintf("%dx%d", p.Width, p.Height), "-r", fmt.Sprintf("%d", fps), "-i", "-"}
+}
+
+// Encode 将视频帧编码为写入 ffmpeg 的数据
+func (p *FramePipe) Encode(img image.Image) ([]byte, error) {
+	if p.Mode == PipePNG {
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, img); err != nil {
+			return nil, fmt.Errorf("无法编码 PNG: %v", err)
+		}
+		return buf.Bytes(), nil
+	}
+	b := img.Bounds()
+	if b.Dx() > p.Width || b.Dy() > p.Height {
+		return nil, fmt.Errorf("视频帧大小 %dx%d 超出原始帧大小 %dx%d", b.Dx(), b.Dy(), p.Width, p.Height)
+	}
+	if b.Dx() != p.Width || b.Dy() != p.Height {
+		img = CenterCanvas(img, p.Width, p.Height)
+	}
+	if p.Color {
+		return RGBBytes(img), nil
+	}
+	return GrayBytes(img), nil
+}
+
+// GrayBytes 返回图像逐行排列的 8 位灰度数据
+func GrayBytes(img image.Image) []byte {
+	b := img.Bounds()
+	out := make([]byte, 0, b.Dx()*b.Dy())
+	switch src := img.(type) {
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := src.PixOffset(b.Min.X, y)
+			out = append(out, src.Pix[i:i+b.Dx()]...)
+		}
+	case *image.Paletted:
+		// 二维码库生成的调色板图像，先换算调色板中每种颜色的灰度
+		lut := make([]uint8, len(src.Palette))
+		for k, c := range src.Palette {
+			lut[k] = color.GrayModel.Convert(c).(color.Gray).Y
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := src.PixOffset(b.Min.X, y)
+			for _, p := range src.Pix[i : i+b.Dx()] {
+				out = append(out, lut[p])
+			}
+		}
+	case *image.RGBA:
+		// 与 color.GrayModel 相同的加权方式
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := src.PixOffset(b.Min.X, y)
+			for x := 0; x < b.Dx(); x, i = x+1, i+4 {
+				r, g, bl := uint32(src.Pix[i]), uint32(src.Pix[i+1]), uint32(src.Pix[i+2])
+				out = append(out, uint8((19595*r+38470*g+7471*bl+1<<15)>>16))
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				out = append(out, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+	}
+	return out
+}
+
+// RGBBytes 返回图像逐行排列的 rgb24 数据
+func RGBBytes(img image.Image) []byte {
+	b := img.Bounds()
+	out := make([]byte, 0, b.Dx()*b.Dy()*3)
+	if src, ok := img.(*image.RGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := src.PixOffset(b.Min.X, y)
+			for x := 0; x < b.Dx(); x, i = x+1, i+4 {
+				out = append(out, src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+			}
+		}
+		return out
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			out = append(out, c.R, c.G, c.B)
+		}
+	}
+	return out
+}
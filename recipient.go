@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 公钥与私钥的文本前缀
+const (
+	KDFX25519          = "x25519"
+	PublicKeyPrefix    = "lumina-pk-"
+	SecretKeyPrefix    = "LUMINA-SK-"
+	recipientWrapLabel = "lumina/x25519"
+	// IdentityEnv 为解码时读取身份文件路径的环境变量
+	IdentityEnv = "LUMINA_IDENTITY"
+)
+
+var ErrNoIdentity = errors.New("没有可用的身份密钥能解开此文件")
+
+// RecipientStanza 为一个接收者包装后的文件密钥
+type RecipientStanza struct {
+	Ephemeral string `json:"epk"`
+	Wrapped   string `json:"key"`
+}
+
+// Identity 为 X25519 私钥及其对应的公钥
+type Identity struct {
+	Secret []byte
+	Public []byte
+}
+
+// GenerateIdentity 生成新的 X25519 密钥对
+func GenerateIdentity() (*Identity, error) {
+	secret := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return identityFromSecret(secret)
+}
+
+func identityFromSecret(secret []byte) (*Identity, error) {
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Secret: secret, Public: public}, nil
+}
+
+// EncodePublicKey 将公钥编码为 lumina-pk-... 形式的字符串
+func EncodePublicKey(public []byte) string {
+	return PublicKeyPrefix + base64.RawURLEncoding.EncodeToString(public)
+}
+
+// ParsePublicKey 解析 lumina-pk-... 形式的公钥
+func ParsePublicKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, PublicKeyPrefix) {
+		return nil, fmt.Errorf("无效的公钥: %s", s)
+	}
+	public, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, PublicKeyPrefix))
+	if err != nil || len(public) != curve25519.PointSize {
+		return nil, fmt.Errorf("无效的公钥: %s", s)
+	}
+	return public, nil
+}
+
+// ParseRecipients 解析接收者列表，每一项可以是公钥，也可以是每行一个公钥的文件路径
+func ParseRecipients(values []string) ([][]byte, error) {
+	recipients := make([][]byte, 0)
+	for _, value := range values {
+		if !strings.HasPrefix(strings.TrimSpace(value), PublicKeyPrefix) && FileExists(value) {
+			lines, err := readKeyLines(value)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range lines {
+				public, err := ParsePublicKey(line)
+				if err != nil {
+					return nil, err
+				}
+				recipients = append(recipients, public)
+			}
+			continue
+		}
+		public, err := ParsePublicKey(value)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, public)
+	}
+	return recipients, nil
+}
+
+// readKeyLines 读取文件中非空、非注释的行
+func readKeyLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// WriteIdentity 将密钥对以文本形式写入 w
+func WriteIdentity(w io.Writer, id *Identity) error {
+	_, err := fmt.Fprintf(w, "# created: %s\n# public key: %s\n%s%s\n",
+		time.Now().Format(time.RFC3339), EncodePublicKey(id.Public),
+		SecretKeyPrefix, base64.RawURLEncoding.EncodeToString(id.Secret))
+	return err
+}
+
+// LoadIdentities 读取身份文件中的所有私钥
+func LoadIdentities(path string) ([]*Identity, error) {
+	lines, err := readKeyLines(path)
+	if err != nil {
+		return nil, err
+	}
+	identities := make([]*Identity, 0)
+	for _, line := range lines {
+		if !strings.HasPrefix(line, SecretKeyPrefix) {
+			return nil, errors.New("无效的身份文件")
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, SecretKeyPrefix))
+		if err != nil || len(secret) != curve25519.ScalarSize {
+			return nil, errors.New("无效的私钥")
+		}
+		id, err := identityFromSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("身份文件中没有私钥")
+	}
+	return identities, nil
+}
+
+// recipientWrapKey 由 X25519 共享密钥派生包装密钥，盐为临时公钥与接收者公钥
+func recipientWrapKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientWrapLabel)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapFileKey 使用临时密钥对为接收者包装文件密钥
+func WrapFileKey(fileKey []byte, recipient []byte) (RecipientStanza, error) {
+	ephemeral, err := GenerateIdentity()
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+	shared, err := curve25519.X25519(ephemeral.Secret, recipient)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+	wrapKey, err := recipientWrapKey(shared, ephemeral.Public, recipient)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return RecipientStanza{}, err
+	}
+	// 包装密钥只使用一次，可以使用全零随机数
+	wrapped := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+	return RecipientStanza{
+		Ephemeral: base64.RawStdEncoding.EncodeToString(ephemeral.Public),
+		Wrapped:   base64.RawStdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+// UnwrapFileKey 尝试用身份私钥解开接收者包装的文件密钥
+func UnwrapFileKey(stanza RecipientStanza, id *Identity) ([]byte, error) {
+	ephemeral, err := base64.RawStdEncoding.DecodeString(stanza.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(stanza.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(id.Secret, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := recipientWrapKey(shared, ephemeral, id.Public)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil)
+}
+
+// SetRecipients 生成随机文件密钥并为每个接收者包装，返回文件密钥
+func (c *CryptParams) SetRecipients(recipients [][]byte) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("没有接收者")
+	}
+	fileKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	c.KDF = KDFX25519
+	c.N, c.R, c.P = 0, 0, 0
+	c.Salt = ""
+	c.Recipients = make([]RecipientStanza, 0, len(recipients))
+	for _, recipient := range recipients {
+		stanza, err := WrapFileKey(fileKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		c.Recipients = append(c.Recipients, stanza)
+	}
+	return fileKey, nil
+}
+
+// UnlockIdentities 用身份文件中的任一私钥解开文件密钥
+func (c *CryptParams) UnlockIdentities(identities []*Identity) ([]byte, error) {
+	for _, stanza := range c.Recipients {
+		for _, id := range identities {
+			fileKey, err := UnwrapFileKey(stanza, id)
+			if err == nil && len(fileKey) == chacha20poly1305.KeySize {
+				return fileKey, nil
+			}
+		}
+	}
+	return nil, ErrNoIdentity
+}
+
+// KeyGen 生成新的密钥对，写入 outputPath(为空时输出到标准输出)并打印公钥
+func KeyGen(outputPath string) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		fmt.Println("KeyGen: 无法生成密钥对:", err)
+		return
+	}
+	if outputPath == "" {
+		err = WriteIdentity(os.Stdout, id)
+		if err != nil {
+			fmt.Println("KeyGen: 无法输出密钥对:", err)
+		}
+		return
+	}
+	if FileExists(outputPath) {
+		fmt.Println("KeyGen: 错误: 身份文件已存在，拒绝覆盖:", outputPath)
+		return
+	}
+	file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Println("KeyGen: 无法创建身份文件:", err)
+		return
+	}
+	defer file.Close()
+	err = WriteIdentity(file, id)
+	if err != nil {
+		fmt.Println("KeyGen: 无法写入身份文件:", err)
+		return
+	}
+	fmt.Println("KeyGen: 身份文件已保存到:", outputPath)
+	fmt.Println("KeyGen: 公钥:", EncodePublicKey(id.Public))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DecodeReport 记录解码过程中无法识别或未通过校验的视频帧，解码结束时输出损坏报告与各识别方式的统计
+type DecodeReport struct {
+	paths      []string
+	unreadable map[string][]int
+	rejected   map[string][]int
+	decoders   *DecoderChain
+}
+
+func NewDecodeReport(decoders *DecoderChain) *DecodeReport {
+	return &DecodeReport{
+		unreadable: make(map[string][]int),
+		rejected:   make(map[string][]int),
+		decoders:   decoders,
+	}
+}
+
+func (r *DecodeReport) addPath(path string) {
+	for _, p := range r.paths {
+		if p == path {
+			return
+		}
+	}
+	r.paths = append(r.paths, path)
+}
+
+// AddUnreadable 记录所有解码器都无法识别(或识别结果均未通过校验)的视频帧
+func (r *DecodeReport) AddUnreadable(path string, frame int) {
+	r.addPath(path)
+	r.unreadable[path] = insertFrame(r.unreadable[path], frame)
+}
+
+// AddRejected 记录被某个解码器识别出错误数据、随后由其他解码器正确识别的视频帧
+func (r *DecodeReport) AddRejected(path string, frame int) {
+	r.addPath(path)
+	r.rejected[path] = insertFrame(r.rejected[path], frame)
+}
+
+// insertFrame 按顺序插入帧序号并去重，后备识别的结果会乱序到达
+func insertFrame(frames []int, frame int) []int {
+	n := sort.SearchInts(frames, frame)
+	if n < len(frames) && frames[n] == frame {
+		return frames
+	}
+	frames = append(frames, 0)
+	copy(frames[n+1:], frames[n:])
+	frames[n] = frame
+	return frames
+}
+
+// Print 将损坏报告输出到 w，missing 为最终未能还原的数据帧序号
+func (r *DecodeReport) Print(w io.Writer, missing []int, slice int, size int64) {
+	fmt.Fprintln(w, de, "损坏报告:")
+	fmt.Fprintln(w, de, "  ---------------------------")
+	if len(r.paths) == 0 && len(missing) == 0 {
+		fmt.Fprintln(w, de, "  未发现损坏的帧")
+	}
+	for _, path := range r.paths {
+		fmt.Fprintln(w, de, "  视频:", path)
+		if frames := r.unreadable[path]; len(frames) > 0 {
+			fmt.Fprintln(w, de, "    无法识别的帧("+fmt.Sprint(len(frames))+"):", FormatRanges(frames))
+		}
+		if frames := r.rejected[path]; len(frames) > 0 {
+			fmt.Fprintln(w, de, "    校验失败后由其他解码器恢复的帧("+fmt.Sprint(len(frames))+"):", FormatRanges(frames))
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintln(w, de, "  未能还原的数据帧序号:", FormatRanges(missing))
+		fmt.Fprintln(w, de, "  输出文件中损坏的字节范围:", FormatByteRanges(missing, slice, size))
+	}
+	if r.decoders != nil {
+		r.decoders.PrintStats()
+	}
+	fmt.Fprintln(w, de, "  ---------------------------")
+}
+
+// FormatByteRanges 将有序的数据帧序号列表转换为输出文件中的字节范围 "[起始, 结束)"
+func FormatByteRanges(seqs []int, slice int, size int64) string {
+	parts := make([]string, 0)
+	for i := 0; i < len(seqs); {
+		j := i
+		for j+1 < len(seqs) && seqs[j+1] == seqs[j]+1 {
+			j++
+		}
+		start := int64(seqs[i]) * int64(slice)
+		end := int64(seqs[j]+1) * int64(slice)
+		if end > size {
+			end = size
+		}
+		parts = append(parts, fmt.Sprintf("[%d, %d)", start, end))
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 待检查目录中的文件
+const (
+	ReviewManifestName = "review.json"
+	ReviewJournalName  = "frames.bin"
+	ReviewStreamName   = "stream.bin"
+)
+
+// ReviewDirName 返回保存无法识别的视频帧的目录名
+func ReviewDirName(hash string) string {
+	if len(hash) > 16 {
+		hash = hash[:16]
+	}
+	return "lumina_review_" + hash
+}
+
+// ReviewManifest 记录解码结束时仍未还原的文件，resolve 命令根据它修补输出文件
+type ReviewManifest struct {
+	Hash  string        `json:"hash"`
+	Index IndexReadData `json:"index"`
+	// Stream 为帧数据写入的文件，加密或压缩时为还原前的数据流
+	Stream string `json:"stream"`
+	// Output 为输出文件，为空表示解码时输出到标准输出
+	Output  string `json:"output"`
+	Missing []int  `json:"missing"`
+	// RequireSignature 为解码时是否启用了 --require-signature，启用时 Hash 不一致的输出文件会被删除
+	RequireSignature bool `json:"require_signature,omitempty"`
+	// Rename 为 Output 是否为默认路径，加密文件还原后按加密在数据流中的文件名重命名
+	Rename bool `json:"rename,omitempty"`
+}
+
+// ReviewDir 为一个文件的待检查目录: 所有识别方式都无法识别的视频帧按 "seg分段_frame帧序号.png" 保存，
+// 校验帧与喷泉码冗余符号记入日志，解码结束时仍有数据帧缺失则写入清单，否则删除整个目录
+// 目录在第一次写入时创建，可以在多个识别线程中并发使用
+type ReviewDir struct {
+	Path    string
+	mutex   sync.Mutex
+	saved   int
+	journal *bufio.Writer
+	file    *os.File
+}
+
+func NewReviewDir(path string) *ReviewDir {
+	return &ReviewDir{Path: path}
+}
+
+// SaveFrame 保存无法识别的视频帧，同一帧有多个无法识别的符号时依次编号，返回保存的路径
+func (r *ReviewDir) SaveFrame(segment int, frame int, img image.Image) (string, error) {
+	if err := os.MkdirAll(r.Path, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("seg%d_frame%06d", segment, frame)
+	for k := 0; ; k++ {
+		path := filepath.Join(r.Path, name+".png")
+		if k > 0 {
+			path = filepath.Join(r.Path, fmt.Sprintf("%s_%d.png", name, k))
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		err = png.Encode(file, img)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+		r.mutex.Lock()
+		r.saved++
+		r.mutex.Unlock()
+		return path, nil
+	}
+}
+
+// Saved 返回保存的视频帧数量
+func (r *ReviewDir) Saved() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.saved
+}
+
+// Journal 将不直接写入输出文件的数据帧按 "uint32 长度 + 数据帧" 追加到日志，多次 resolve 的扫描结果依次追加
+func (r *ReviewDir) Journal(data []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.journal == nil {
+		if err := os.MkdirAll(r.Path, 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(r.Path, ReviewJournalName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		r.file, r.journal = file, bufio.NewWriter(file)
+	}
+	if err := binary.Write(r.journal, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := r.journal.Write(data)
+	return err
+}
+
+// Close 关闭日志文件
+func (r *ReviewDir) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.journal.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.journal = nil, nil
+	return err
+}
+
+// WriteManifest 写入清单
+func (r *ReviewDir) WriteManifest(m ReviewManifest) error {
+	if err := os.MkdirAll(r.Path, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.Path, ReviewManifestName), data, 0644)
+}
+
+// Remove 删除待检查目录中由程序生成的文件，目录为空时一并删除
+func (r *ReviewDir) Remove() error {
+	_ = r.Close()
+	entries, err := os.ReadDir(r.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == ReviewManifestName || name == ReviewJournalName || name == ReviewStreamName || (strings.HasPrefix(name, "seg") && strings.HasSuffix(name, ".png")) {
+			if err := os.Remove(filepath.Join(r.Path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	_ = os.Remove(r.Path)
+	return nil
+}
+
+// ReadReviewManifest 读取待检查目录中的清单
+func ReadReviewManifest(dir string) (ReviewManifest, error) {
+	var m ReviewManifest
+	data, err := os.ReadFile(filepath.Join(dir, ReviewManifestName))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("无法解析清单: %v", err)
+	}
+	if m.Hash == "" || m.Stream == "" || m.Index.Version < 1 {
+		return m, errors.New("清单不完整")
+	}
+	return m, nil
+}
+
+// ReadJournal 依次读取日志中的数据帧，日志不存在时不做任何操作
+func ReadJournal(path string, fn func(data []byte)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		var n uint32
+		if err := binary.Read(reader, binary.BigEndian, &n); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if n > helperMaxResultLen {
+			return fmt.Errorf("日志中的数据帧长度过大: %d", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		fn(data)
+	}
+}
+
+// ParseResults 读取手动扫描的结果，每行一个二维码内容，空行与 # 开头的行被忽略
+// 二进制载荷的结果为原始字节的 Base64 编码，其他载荷为扫描到的原文；无法解码的行向 log 输出提示后跳过
+func ParseResults(path string, payload string, log io.Writer) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	results := make([][]byte, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), helperMaxResultLen)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var data []byte
+		if payload == PayloadBinary {
+			data, err = base64.StdEncoding.DecodeString(line)
+		} else {
+			data, err = DecodePayload([]byte(line), payload)
+		}
+		if err != nil {
+			fmt.Fprintln(log, "Resolve: 第", n, "行无法解码，跳过:", err)
+			continue
+		}
+		results = append(results, data)
+	}
+	return results, scanner.Err()
+}
+
+// RedundantSink 为带冗余帧的接收器，冗余帧不直接写入输出文件，解码时记入日志以便 resolve 重新使用
+type RedundantSink interface {
+	Redundant(h FrameHeader) bool
+}
+
+// NewFrameSink 按索引信息创建还原输出文件的数据帧接收器，旧格式的视频没有帧头，返回 nil；log 为接收器提示信息的输出位置
+func NewFrameSink(file *os.File, fileID [4]byte, s IndexReadData, log io.Writer) FrameSink {
+	if s.Version >= 1 && s.Fountain > 0 {
+		return NewFountainWriter(file, fileID, s.Slice, s.Size, s.FountainK, s.Fountain)
+	} else if s.Version >= 1 && s.ParityK > 0 {
+		return NewParityWriter(NewFrameWriter(file, fileID, s.Slice, s.Size), s.ParityN, s.ParityK, log)
+	} else if s.Version >= 1 {
+		return NewFrameWriter(file, fileID, s.Slice, s.Size)
+	}
+	return nil
+}
+
+// ReplayStream 将帧数据文件中已经还原的数据帧重新写入新的接收器，missing 为未还原的数据帧(喷泉码为源符号)序号
+func ReplayStream(sink FrameSink, file *os.File, fileID [4]byte, s IndexReadData, missing []int) error {
+	lost := make(map[int]bool, len(missing))
+	for _, seq := range missing {
+		lost[seq] = true
+	}
+	count := int((s.Size + int64(s.Slice) - 1) / int64(s.Slice))
+	var layout FountainLayout
+	if s.Fountain > 0 {
+		layout = NewFountainLayout(s.Size, s.Slice, s.FountainK, s.Fountain)
+	}
+	for g := 0; g < count; g++ {
+		if lost[g] {
+			continue
+		}
+		offset := int64(g) * int64(s.Slice)
+		n := int64(s.Slice)
+		if offset+n > s.Size {
+			n = s.Size - offset
+		}
+		payload := make([]byte, n)
+		if _, err := file.ReadAt(payload, offset); err != nil && err != io.EOF {
+			return err
+		}
+		h := FrameHeader{Kind: FrameKindData, FileID: fileID, Seq: uint32(g)}
+		if s.Fountain > 0 {
+			// 源符号即块内的系统符号，不足一个符号长度的部分补零
+			block, i := g/layout.BlockSymbols, g%layout.BlockSymbols
+			h.Seq = uint32(block*layout.BlockSymbolCount(0) + i)
+			payload = append(payload, make([]byte, s.Slice-len(payload))...)
+		}
+		if err := sink.Write(h, payload); err != nil {
+			return fmt.Errorf("第 %d 个数据帧: %v", g, err)
+		}
+	}
+	return nil
+}
+
+// Resolve 读取待检查目录的清单，将手动扫描的结果与解码时的数据帧一起重新还原，补全缺失的数据帧后输出文件
+// outputPath 为空时使用解码时的输出路径，为 - 时输出到标准输出
+func Resolve(reviewPath string, resultsPath string, outputPath string, password string, identityPath string) {
+	// 输出到标准输出时，所有提示信息改为输出到标准错误，避免混入数据
+	logOut := io.Writer(os.Stdout)
+	if outputPath == StdioPath {
+		logOut = os.Stderr
+	}
+	review := NewReviewDir(reviewPath)
+	m, err := ReadReviewManifest(reviewPath)
+	if err != nil {
+		fmt.Fprintln(logOut, "Resolve: 无法读取待检查目录:", err)
+		return
+	}
+	s := m.Index
+	// 没有指定输出路径时使用解码时的输出路径，默认路径的加密文件按其中的文件名重命名
+	rename := outputPath == "" && m.Rename
+	if outputPath == "" {
+		outputPath = m.Output
+	}
+	if outputPath == "" {
+		fmt.Fprintln(logOut, "Resolve: 解码时输出到标准输出，请使用 -o 指定输出文件路径")
+		return
+	}
+	results, err := ParseResults(resultsPath, s.Payload, logOut)
+	if err != nil {
+		fmt.Fprintln(logOut, "Resolve: 无法读取扫描结果:", err)
+		return
+	}
+	var cryptKey []byte
+	if s.Crypt != nil {
+		cryptKey, err = UnlockCrypt(s.Crypt, password, identityPath, logOut)
+		if err != nil {
+			fmt.Fprintln(logOut, "Resolve: 错误: 无法解锁加密文件", m.Hash+":", err)
+			return
+		}
+	}
+	fmt.Fprintln(logOut, "Resolve: 文件:", s.Name, "Hash:", m.Hash)
+	fmt.Fprintln(logOut, "Resolve: 缺失数据帧数:", len(m.Missing), "扫描结果数:", len(results))
+
+	// 已还原的数据帧与日志中的冗余帧重新写入，再加入扫描结果
+	streamFile, err := os.OpenFile(m.Stream, os.O_RDWR, 0644)
+	if err != nil {
+		fmt.Fprintln(logOut, "Resolve: 无法打开帧数据文件:", err)
+		return
+	}
+	fileID := s.FrameFileID(m.Hash)
+	sink := NewFrameSink(streamFile, fileID, s, logOut)
+	if err := ReplayStream(sink, streamFile, fileID, s, m.Missing); err != nil {
+		streamFile.Close()
+		fmt.Fprintln(logOut, "Resolve: 无法读取帧数据文件:", err)
+		return
+	}
+	err = ReadJournal(filepath.Join(reviewPath, ReviewJournalName), func(data []byte) {
+		if h, payload, err := UnmarshalFrame(data, s.Version); err == nil {
+			_ = sink.Write(h, payload)
+		}
+	})
+	if err != nil {
+		streamFile.Close()
+		fmt.Fprintln(logOut, "Resolve: 无法读取冗余帧日志:", err)
+		return
+	}
+	// 扫描结果中的冗余帧同样记入日志，这次仍无法还原时可以在下一次 resolve 中继续使用
+	redundant, _ := sink.(RedundantSink)
+	validate := NewFrameValidator(s.Version)
+	for n, data := range results {
+		h, payload, err := UnmarshalFrame(data, s.Version)
+		if err == nil && s.Version >= 2 {
+			err = validate(data)
+		}
+		if err == nil && redundant != nil && h.FileID == fileID && redundant.Redundant(h) {
+			if err := review.Journal(data); err != nil {
+				streamFile.Close()
+				fmt.Fprintln(logOut, "Resolve: 无法写入冗余帧日志:", err)
+				return
+			}
+		}
+		if err == nil {
+			err = sink.Write(h, payload)
+		}
+		if err != nil {
+			fmt.Fprintln(logOut, "Resolve: 第", n+1, "个扫描结果不是此文件的数据帧，跳过:", err)
+		}
+	}
+	err = sink.Finish()
+	streamFile.Close()
+	if closeErr := review.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(logOut, "Resolve: 无法写入帧数据文件:", err)
+		return
+	}
+	missing := sink.Missing()
+	if len(missing) > 0 {
+		m.Missing = missing
+		if err := review.WriteManifest(m); err != nil {
+			fmt.Fprintln(logOut, "Resolve: 无法更新待检查目录清单:", err)
+			return
+		}
+		fmt.Fprintln(logOut, "Resolve: 错误: 仍有", len(missing), "个数据帧缺失，无法还原文件")
+		fmt.Fprintln(logOut, "Resolve:   缺失的数据帧:", FormatRanges(missing))
+		fmt.Fprintln(logOut, "Resolve:   缺失的字节范围:", FormatByteRanges(missing, s.Slice, s.Size))
+		return
+	}
+
+	outputFilePath := outputPath
+	if outputPath == StdioPath {
+		tempFile, err := os.CreateTemp("", "lumina_output_*")
+		if err != nil {
+			fmt.Fprintln(logOut, "Resolve: 无法创建临时文件:", err)
+			return
+		}
+		tempFile.Close()
+		outputFilePath = tempFile.Name()
+		defer os.Remove(outputFilePath)
+	}
+	expectedHash := m.Hash
+	if s.Crypt != nil || s.Compress != CompressNone {
+		fmt.Fprintln(logOut, "Resolve: 开始还原数据，是否加密:", s.Crypt != nil, "压缩算法:", s.Compress)
+		var result *RestoreResult
+		result, err = RestoreFile(s.Crypt, cryptKey, s.Compress, s.RawSize, m.Stream, outputFilePath)
+		if err == nil {
+			expectedHash, err = result.ExpectedHash(m.Hash)
+			if err != nil {
+				_ = os.Remove(outputFilePath)
+			}
+		}
+		if err == nil && result.Sealed != nil && rename {
+			if outputFilePath, err = RenameSealedOutput(outputFilePath, result.Sealed.Name); err != nil {
+				fmt.Fprintln(logOut, "Resolve: 无法按加密文件中的文件名重命名输出文件:", err)
+				err = nil
+			}
+			outputPath = outputFilePath
+		}
+	} else if filepath.Clean(m.Stream) != filepath.Clean(outputFilePath) {
+		err = MoveFile(m.Stream, outputFilePath)
+	}
+	if err != nil {
+		fmt.Fprintln(logOut, "Resolve: 错误: 还原数据失败:", err)
+		return
+	}
+	outputFileHash, err := CalculateFileHash(outputFilePath)
+	if err != nil {
+		fmt.Fprintln(logOut, "Resolve: 无法计算输出文件Hash:", err)
+		return
+	}
+	if outputFileHash != expectedHash {
+		fmt.Fprintln(logOut, "Resolve: 错误：输出文件与输入文件不一致，保留待检查目录")
+		fmt.Fprintln(logOut, "Resolve:   输入文件Hash:", expectedHash)
+		fmt.Fprintln(logOut, "Resolve:   输出文件Hash:", outputFileHash)
+		if m.RequireSignature && outputPath != StdioPath {
+			if err := os.Remove(outputFilePath); err != nil {
+				fmt.Fprintln(logOut, "Resolve: 错误: 无法删除未通过校验的输出文件:", err)
+			} else {
+				fmt.Fprintln(logOut, "Resolve: 解码时已启用 --require-signature，已删除未通过校验的输出文件", outputFilePath)
+			}
+		}
+		return
+	}
+	if outputPath == StdioPath {
+		if err := CopyFileTo(os.Stdout, outputFilePath); err != nil {
+			fmt.Fprintln(logOut, "Resolve: 输出到标准输出失败:", err)
+			return
+		}
+	}
+	if err := review.Remove(); err != nil {
+		fmt.Fprintln(logOut, "Resolve: 无法删除待检查目录:", err)
+	}
+	fmt.Fprintln(logOut, "Resolve: 完成，输出文件与输入文件一致:", outputPath)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SeekOverlap 为每个读取区间向前多读的帧数，seek 不精确时由重叠的帧补上，重复的数据帧按帧头序号去重
+const SeekOverlap = 2
+
+// FFmpeg 输出的像素格式，彩色模式需要 rgb24，其他模式只需要 gray
+const (
+	PixFmtRGB  = "rgb24"
+	PixFmtGray = "gray"
+)
+
+// FrameRange 为视频中由一个 FFmpeg 进程读取的帧区间，Count 为 0 表示读到视频结束
+type FrameRange struct {
+	Start int
+	Count int
+}
+
+// ProbeVideo 读取视频的帧数与帧率
+func ProbeVideo(videoFilePath string) (int, float64, error) {
+	output, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=nb_frames,r_frame_rate", "-of", "default=noprint_wrappers=1", videoFilePath).Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	frames, fps := 0, 0.0
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "nb_frames":
+			frames, err = strconv.Atoi(value)
+			if err != nil {
+				return 0, 0, fmt.Errorf("无效的视频帧数: %s", value)
+			}
+		case "r_frame_rate":
+			num, den, _ := strings.Cut(value, "/")
+			n, err1 := strconv.ParseFloat(num, 64)
+			d, err2 := strconv.ParseFloat(den, 64)
+			if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+				return 0, 0, fmt.Errorf("无效的视频帧率: %s", value)
+			}
+			fps = n / d
+		}
+	}
+	if frames <= 0 || fps <= 0 {
+		return 0, 0, fmt.Errorf("无法读取视频帧数与帧率")
+	}
+	return frames, fps, nil
+}
+
+// SplitFrames 将视频的帧均分为 readers 个区间，除第一个区间外每个区间向前重叠 SeekOverlap 帧
+// 最后一个区间读到视频结束，帧数统计不准确时也不会遗漏
+func SplitFrames(frames int, readers int) []FrameRange {
+	if readers > frames/(SeekOverlap+1) {
+		readers = frames / (SeekOverlap + 1)
+	}
+	if readers <= 1 {
+		return []FrameRange{{}}
+	}
+	ranges := make([]FrameRange, 0, readers)
+	for k := 0; k < readers; k++ {
+		start, end := frames*k/readers, frames*(k+1)/readers
+		if k > 0 {
+			start -= SeekOverlap
+		}
+		count := end - start
+		if k == readers-1 {
+			count = 0
+		}
+		ranges = append(ranges, FrameRange{Start: start, Count: count})
+	}
+	return ranges
+}
+
+// FrameReaderArgs 返回读取视频中一个帧区间的 FFmpeg 命令
+// -ss 放在 -i 之前由 FFmpeg 解码并丢弃起始时间之前的帧，起始时间提前半帧以免浮点误差跳过第一帧
+func FrameReaderArgs(videoFilePath string, r FrameRange, fps float64, pixFmt string) []string {
+	args := []string{"ffmpeg"}
+	if r.Start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat((float64(r.Start)-0.5)/fps, 'f', 6, 64))
+	}
+	args = append(args, "-i", videoFilePath)
+	if r.Count > 0 {
+		args = append(args, "-frames:v", strconv.Itoa(r.Count))
+	}
+	return append(args,
+		"-f", "image2pipe",
+		"-pix_fmt", pixFmt,
+		"-vcodec", "rawvideo",
+		"-",
+	)
+}
+
+// ReadVideoFrame 读取视频中的一帧 rgb24 图像，fps 只在 r.Start 大于 0 时使用
+func ReadVideoFrame(videoFilePath string, r FrameRange, fps float64, width int, height int) (image.Image, error) {
+	r.Count = 1
+	args := FrameReaderArgs(videoFilePath, r, fps, PixFmtRGB)
+	ffmpegProcess := exec.Command(args[0], args[1:]...)
+	ffmpegStdout, err := ffmpegProcess.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("无法创建 FFmpeg 标准输出管道: %v", err)
+	}
+	if err := ffmpegProcess.Start(); err != nil {
+		return nil, fmt.Errorf("无法启动 FFmpeg 进程: %v", err)
+	}
+	rawData := make([]byte, width*height*3)
+	_, readErr := io.ReadFull(ffmpegStdout, rawData)
+	ffmpegStdout.Close()
+	waitErr := ffmpegProcess.Wait()
+	if readErr != nil {
+		return nil, fmt.Errorf("无法读取视频帧: %v", readErr)
+	}
+	if waitErr != nil {
+		return nil, fmt.Errorf("FFmpeg 命令执行失败: %v", waitErr)
+	}
+	return RawDataToImage(rawData, width, height), nil
+}
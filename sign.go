@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 签名公钥与私钥的文本前缀
+const (
+	SignPublicKeyPrefix = "lumina-sig-"
+	SignSecretKeyPrefix = "LUMINA-SIGN-SK-"
+	signatureContext    = "lumina-signature-v1\n"
+)
+
+// 签名验证结果
+const (
+	SignatureNone      = "未签名"
+	SignatureInvalid   = "签名无效"
+	SignatureUntrusted = "签名有效，但签名者不在信任列表中"
+	SignatureTrusted   = "签名有效，签名者受信任"
+)
+
+// EncodeSignPublicKey 将签名公钥编码为 lumina-sig-... 形式的字符串
+func EncodeSignPublicKey(public ed25519.PublicKey) string {
+	return SignPublicKeyPrefix + base64.RawURLEncoding.EncodeToString(public)
+}
+
+// ParseSignPublicKey 解析 lumina-sig-... 形式的签名公钥
+func ParseSignPublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, SignPublicKeyPrefix) {
+		return nil, fmt.Errorf("无效的签名公钥: %s", s)
+	}
+	public, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, SignPublicKeyPrefix))
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("无效的签名公钥: %s", s)
+	}
+	return public, nil
+}
+
+// ParseTrustedKeys 解析信任的签名公钥列表，每一项可以是公钥，也可以是每行一个公钥的文件路径
+func ParseTrustedKeys(values []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0)
+	for _, value := range values {
+		lines := []string{value}
+		if !strings.HasPrefix(strings.TrimSpace(value), SignPublicKeyPrefix) && FileExists(value) {
+			var err error
+			lines, err = readKeyLines(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, line := range lines {
+			key, err := ParseSignPublicKey(line)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// WriteSigningKey 将签名私钥以文本形式写入 w
+func WriteSigningKey(w io.Writer, key ed25519.PrivateKey) error {
+	_, err := fmt.Fprintf(w, "# created: %s\n# public key: %s\n%s%s\n",
+		time.Now().Format(time.RFC3339), EncodeSignPublicKey(key.Public().(ed25519.PublicKey)),
+		SignSecretKeyPrefix, base64.RawURLEncoding.EncodeToString(key.Seed()))
+	return err
+}
+
+// LoadSigningKey 读取签名私钥文件
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	lines, err := readKeyLines(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, SignSecretKeyPrefix) {
+			continue
+		}
+		seed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, SignSecretKeyPrefix))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("无效的签名私钥")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	return nil, errors.New("文件中没有签名私钥")
+}
+
+// SignedMessage 返回索引数据的签名内容: 除分段序号与签名本身外的全部字段，其中包含原始文件的 SHA256
+func SignedMessage(indexData IndexData) ([]byte, error) {
+	indexData.Index = 0
+	indexData.Signature = ""
+	data, err := json.Marshal(indexData)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signatureContext), data...), nil
+}
+
+// SignIndex 使用签名私钥对索引数据签名
+func SignIndex(indexData *IndexData, key ed25519.PrivateKey) error {
+	indexData.Signer = EncodeSignPublicKey(key.Public().(ed25519.PublicKey))
+	message, err := SignedMessage(*indexData)
+	if err != nil {
+		return err
+	}
+	indexData.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, message))
+	return nil
+}
+
+// VerifyIndex 验证索引数据的签名，并检查签名者是否在信任列表中
+func VerifyIndex(indexData IndexData, trusted []ed25519.PublicKey) string {
+	if indexData.Signature == "" {
+		return SignatureNone
+	}
+	signer, err := ParseSignPublicKey(indexData.Signer)
+	if err != nil {
+		return SignatureInvalid
+	}
+	signature, err := base64.StdEncoding.DecodeString(indexData.Signature)
+	if err != nil {
+		return SignatureInvalid
+	}
+	message, err := SignedMessage(indexData)
+	if err != nil || !ed25519.Verify(signer, message, signature) {
+		return SignatureInvalid
+	}
+	for _, key := range trusted {
+		if bytes.Equal(key, signer) {
+			return SignatureTrusted
+		}
+	}
+	return SignatureUntrusted
+}
+
+// MergeSignature 合并同一文件多个分段的签名验证结果，各分段签名内容不一致时视为无效
+func MergeSignature(status string, message []byte, other string, otherMessage []byte) string {
+	if status == SignatureInvalid || other == SignatureInvalid {
+		return SignatureInvalid
+	}
+	if status != other || (status != SignatureNone && !bytes.Equal(message, otherMessage)) {
+		return SignatureInvalid
+	}
+	return status
+}
+
+// SignKeyGen 生成新的签名密钥对，写入 outputPath(为空时输出到标准输出)并打印公钥
+func SignKeyGen(outputPath string) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Println("KeyGen: 无法生成签名密钥对:", err)
+		return
+	}
+	if outputPath == "" {
+		err = WriteSigningKey(os.Stdout, key)
+		if err != nil {
+			fmt.Println("KeyGen: 无法输出签名密钥对:", err)
+		}
+		return
+	}
+	if FileExists(outputPath) {
+		fmt.Println("KeyGen: 错误: 签名密钥文件已存在，拒绝覆盖:", outputPath)
+		return
+	}
+	file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Println("KeyGen: 无法创建签名密钥文件:", err)
+		return
+	}
+	defer file.Close()
+	err = WriteSigningKey(file, key)
+	if err != nil {
+		fmt.Println("KeyGen: 无法写入签名密钥文件:", err)
+		return
+	}
+	fmt.Println("KeyGen: 签名密钥文件已保存到:", outputPath)
+	fmt.Println("KeyGen: 签名公钥:", EncodeSignPublicKey(public))
+}
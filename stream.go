@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// StdioPath 作为输入或输出路径时表示标准输入或标准输出
+const StdioPath = "-"
+
+// StdinName 为从标准输入编码时写入索引的文件名
+const StdinName = "stdin"
+
+// CopyFileTo 将文件内容写入 w
+func CopyFileTo(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// MoveFile 移动文件，不在同一文件系统时复制后删除源文件
+func MoveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// EncodeStream 从 src 读取原始数据并压缩、加密，读取得到编码数据流，原始数据只读取一遍
+// c 为 nil 表示不加密，compression 为 none 表示不压缩；c.Sealed 时 meta 与原始数据的 Hash 一起加密在数据流中
+// 编码数据流读到末尾后 Sum 返回原始数据的 SHA-256 与长度，StreamSum 返回编码数据流的 SHA-256
+type EncodeStream struct {
+	io.Reader
+	hash       hash.Hash
+	streamHash hash.Hash
+	counter    *countWriter
+	pipe       *io.PipeReader
+}
+
+func NewEncodeStream(src io.Reader, compression string, c *CryptParams, key []byte, meta SealedMeta) *EncodeStream {
+	s := &EncodeStream{hash: sha256.New(), streamHash: sha256.New(), counter: &countWriter{}}
+	src = io.TeeReader(src, io.MultiWriter(s.hash, s.counter))
+	if compression == CompressNone && c == nil {
+		s.Reader = io.TeeReader(src, s.streamHash)
+		return s
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		if c == nil {
+			pw.CloseWithError(compressStream(pw, src, compression))
+			return
+		}
+		// 压缩与加密同时进行，不生成中间文件
+		cr, cw := io.Pipe()
+		go func() {
+			cw.CloseWithError(compressStream(cw, src, compression))
+		}()
+		var plain io.Reader = cr
+		if c.Sealed {
+			header, err := SealedHeader(meta)
+			if err != nil {
+				cr.CloseWithError(err)
+				pw.CloseWithError(err)
+				return
+			}
+			// 压缩数据读到末尾时原始数据已经读完，这时才计算末尾的 Hash
+			plain = io.MultiReader(bytes.NewReader(header), cr, &sumReader{hash: s.hash})
+		}
+		err := c.EncryptStream(key, pw, plain)
+		cr.CloseWithError(err)
+		pw.CloseWithError(err)
+	}()
+	s.Reader, s.pipe = io.TeeReader(pr, s.streamHash), pr
+	return s
+}
+
+// sumReader 第一次读取时计算 Hash，读取得到 Hash 的原始字节
+type sumReader struct {
+	hash hash.Hash
+	sum  []byte
+}
+
+func (r *sumReader) Read(p []byte) (int, error) {
+	if r.sum == nil {
+		r.sum = r.hash.Sum(nil)
+	}
+	if len(r.sum) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.sum)
+	r.sum = r.sum[n:]
+	return n, nil
+}
+
+// Sum 返回原始数据的 SHA-256 与长度，只有编码数据流读到末尾后才是完整的结果
+func (s *EncodeStream) Sum() (string, int64) {
+	return hex.EncodeToString(s.hash.Sum(nil)), s.counter.n
+}
+
+// StreamSum 返回编码数据流的 SHA-256，加密文件的索引中记录这个 Hash
+func (s *EncodeStream) StreamSum() string {
+	return hex.EncodeToString(s.streamHash.Sum(nil))
+}
+
+// Close 停止压缩与加密协程，编码中途出错时调用
+func (s *EncodeStream) Close() error {
+	if s.pipe != nil {
+		return s.pipe.Close()
+	}
+	return nil
+}
+
+// compressStream 将 src 压缩后写入 dst
+func compressStream(dst io.Writer, src io.Reader, compression string) error {
+	compressor, err := NewCompressWriter(dst, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(compressor, src); err != nil {
+		compressor.Close()
+		return err
+	}
+	return compressor.Close()
+}
+
+// StreamData 按窗口顺序读取编码数据流，内存中只保留当前窗口与上一个窗口，窗口通常为一个分段的数据量
+// 窗口按 window 对齐，window 为数据帧(喷泉码为源块，校验帧为帧组)长度的整数倍时任何数据帧都不会跨越窗口
+// 数据流只能向前读取，长度在读到末尾后才能确定；读取错误会被记录下来，由 Err 返回，之后视为数据流已结束
+type StreamData struct {
+	r      *bufio.Reader
+	window int64
+	start  int64
+	buf    []byte
+	prev   []byte
+	eof    bool
+	err    error
+}
+
+func NewStreamData(r io.Reader, window int64) *StreamData {
+	if window <= 0 {
+		window = 1
+	}
+	return &StreamData{r: bufio.NewReader(r), window: window}
+}
+
+// Size 返回数据流的长度，只有 Has 返回 false 之后才是完整的长度
+func (d *StreamData) Size() int64 {
+	return d.start + int64(len(d.buf))
+}
+
+// Has 判断 off 处是否还有数据，需要时向前读取窗口；off 恰好为当前窗口末尾时只预读一个字节判断
+func (d *StreamData) Has(off int64) bool {
+	if d.buf == nil {
+		d.advance()
+	}
+	for off > d.Size() && !d.eof {
+		d.advance()
+	}
+	return off < d.Size() || (off == d.Size() && !d.eof)
+}
+
+// Slice 返回从 off 开始的 n 个字节，超出数据流末尾的部分被截掉
+// off 只能位于当前窗口、上一个窗口或之后，切换窗口时分配新的缓冲区，之前返回的切片仍然有效
+func (d *StreamData) Slice(off int64, n int) []byte {
+	if !d.Has(off) {
+		return nil
+	}
+	if off == d.Size() {
+		d.advance()
+	}
+	if off < d.start {
+		prevStart := d.start - int64(len(d.prev))
+		if off < prevStart {
+			if d.err == nil {
+				d.err = fmt.Errorf("编码数据流不能回退到位置 %d", off)
+			}
+			return make([]byte, n)
+		}
+		end := off + int64(n)
+		if end > d.start {
+			end = d.start
+		}
+		return d.prev[off-prevStart : end-prevStart]
+	}
+	end := off + int64(n)
+	if end > d.Size() {
+		end = d.Size()
+	}
+	return d.buf[off-d.start : end-d.start]
+}
+
+// advance 读取下一个窗口，并预读一个字节判断数据流是否已经结束
+func (d *StreamData) advance() {
+	if d.eof {
+		return
+	}
+	buf := make([]byte, d.window)
+	n, err := io.ReadFull(d.r, buf)
+	if err == nil {
+		_, err = d.r.Peek(1)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.eof = true
+	} else if err != nil {
+		d.eof = true
+		d.err = err
+	}
+	d.start += int64(len(d.buf))
+	d.prev, d.buf = d.buf, buf[:n]
+}
+
+// Err 返回读取数据流时遇到的第一个错误
+func (d *StreamData) Err() error {
+	return d.err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boombuler/barcode/aztec"
+	"github.com/makiuchi-d/gozxing"
+	zxaztec "github.com/makiuchi-d/gozxing/aztec"
+	"github.com/makiuchi-d/gozxing/datamatrix"
+	qrencode "github.com/skip2/go-qrcode"
+	"image"
+	"io"
+	"strings"
+)
+
+// 数据帧使用的二维码制式，写入 IndexData 以便解码时选择识别器，索引二维码始终使用 QR 码
+const (
+	SymbolQR         = "qr"
+	SymbolDataMatrix = "datamatrix"
+	SymbolAztec      = "aztec"
+	// 最大的 144x144 Data Matrix 有 1558 个数据码字，Base64 文本经过编码器的模式切换后实测约能容纳 1020 字节，这里留出余量
+	symbolDataMatrixBase64Capacity = 1008
+	// symbolQuietZone 为 Data Matrix 与 Aztec 码四周留白的模块数
+	symbolQuietZone = 2
+)
+
+// AztecECCLevels 为纠错等级 0-3 对应的 Aztec 码纠错比例(%)
+var AztecECCLevels = []int{23, 36, 50, 63}
+
+// symbolAztecByteCapacity 为纠错等级 0-3 下 32 层 Aztec 码的最大内容长度(字节)
+// 按每个字节都需要二进制转义的最坏情况实测，任何内容都不会比它更长；Base64 文本同样按这个上限计算
+var symbolAztecByteCapacity = [...]int{1885, 1716, 1565, 1446}
+
+// ParseSymbology 检查二维码制式，空字符串视为 QR 码
+func ParseSymbology(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", SymbolQR:
+		return SymbolQR, nil
+	case SymbolDataMatrix, "dm":
+		return SymbolDataMatrix, nil
+	case SymbolAztec:
+		return SymbolAztec, nil
+	}
+	return "", fmt.Errorf("不支持的二维码制式: %s", name)
+}
+
+// CheckSymbolPayload 检查二维码制式能否承载数据帧编码方式
+// Base45 依赖 QR 码的字母数字模式；Data Matrix 识别结果中字节模式与 ASCII 模式的内容混杂，无法可靠还原二进制数据
+func CheckSymbolPayload(symbol string, payload string) error {
+	if symbol == SymbolQR || payload == PayloadBase64 {
+		return nil
+	}
+	if symbol == SymbolAztec && payload == PayloadBinary {
+		return nil
+	}
+	return fmt.Errorf("%s 不支持 %s 编码", symbol, payload)
+}
+
+// SymbolMaxSlice 返回在指定制式、编码方式与纠错等级(0-3)下单个二维码可以容纳的最大数据长度(不含帧头与校验)
+// 纠错等级对 QR 码与 Aztec 码生效；Data Matrix 的纠错码字数由符号大小决定，只能使用等级 0
+func SymbolMaxSlice(symbol string, payload string, level int) int {
+	overhead := FrameHeaderLen + FrameCRCLen
+	switch symbol {
+	case SymbolDataMatrix:
+		if level != 0 {
+			return 0
+		}
+		return symbolDataMatrixBase64Capacity - overhead
+	case SymbolAztec:
+		if level < 0 || level >= len(symbolAztecByteCapacity) {
+			return 0
+		}
+		if payload == PayloadBinary {
+			return symbolAztecByteCapacity[level] - overhead
+		}
+		return symbolAztecByteCapacity[level]/4*3 - overhead
+	}
+	return PayloadMaxSlice(payload, level)
+}
+
+// CheckSymbolLevel 检查纠错等级是否适用于二维码制式
+func CheckSymbolLevel(symbol string, level int) error {
+	if level < 0 || level > 3 {
+		return errors.New("纠错等级需要在 0-3 之间")
+	}
+	if symbol == SymbolDataMatrix && level != 0 {
+		return errors.New("Data Matrix 的纠错码字数由符号大小决定，不支持 -q 参数")
+	}
+	return nil
+}
+
+// SymbolEncode 将帧数据绘制为指定制式的二维码，size 的含义与 QR 码相同: 负数为每个模块的像素数，正数为图像边长
+func SymbolEncode(frame []byte, symbol string, payload string, level int, size int) (image.Image, error) {
+	content := []byte(EncodePayload(frame, payload))
+	if symbol == SymbolAztec && payload == PayloadBinary {
+		content = frame
+	}
+	return symbolEncodeContent(content, symbol, level, size)
+}
+
+// SymbolWorstCase 绘制 slice 字节的数据帧(含帧头与校验)在指定制式、编码方式与纠错等级下可能生成的最大符号，用于确定原始帧与格子的大小
+// QR 码按字节模式(Base45 按字母数字模式)、Aztec 码按二进制模式计算，是准确的上限；
+// Data Matrix 编码器按启发式选择编码模式，这里按 ASCII 模式估计，个别更大的符号由 SymbolEncodeWithin 缩小模块
+func SymbolWorstCase(slice int, symbol string, payload string, level int, size int) (image.Image, error) {
+	n := EncodedPayloadLen(slice+FrameHeaderLen+FrameCRCLen, payload)
+	worst := "a"
+	switch {
+	case symbol == SymbolAztec:
+		worst = "\xff"
+	case symbol == SymbolDataMatrix:
+		// 大小写字母与符号交替，C40、Text、EDIFACT 模式都不比 ASCII 模式更短
+		worst = "aA+"
+	case payload == PayloadBase45:
+		worst = "A"
+	}
+	content := strings.Repeat(worst, n/len(worst)+1)[:n]
+	return symbolEncodeContent([]byte(content), symbol, level, size)
+}
+
+// SymbolEncodeWithin 与 SymbolEncode 相同，符号超出 limit 时缩小模块重新绘制，limit 为空表示不限制大小
+func SymbolEncodeWithin(frame []byte, symbol string, payload string, level int, size int, limit image.Rectangle) (image.Image, error) {
+	img, err := SymbolEncode(frame, symbol, payload, level, size)
+	if err != nil || limit.Empty() {
+		return img, err
+	}
+	if b := img.Bounds(); b.Dx() <= limit.Dx() && b.Dy() <= limit.Dy() {
+		return img, nil
+	}
+	side := limit.Dx()
+	if limit.Dy() < side {
+		side = limit.Dy()
+	}
+	img, err = SymbolEncode(frame, symbol, payload, level, side)
+	if err != nil {
+		return nil, err
+	}
+	if b := img.Bounds(); b.Dx() > limit.Dx() || b.Dy() > limit.Dy() {
+		return nil, fmt.Errorf("符号大小 %dx%d 超出 %dx%d，可减小 -d 或降低纠错等级", b.Dx(), b.Dy(), limit.Dx(), limit.Dy())
+	}
+	return img, nil
+}
+
+// symbolEncodeContent 将已编码的文本(Aztec 码的二进制模式为原始数据)绘制为指定制式的二维码
+func symbolEncodeContent(content []byte, symbol string, level int, size int) (image.Image, error) {
+	switch symbol {
+	case SymbolDataMatrix:
+		hints := map[gozxing.EncodeHintType]interface{}{gozxing.EncodeHintType_DATA_MATRIX_SHAPE: 1}
+		m, err := datamatrix.NewDataMatrixWriter().Encode(string(content), gozxing.BarcodeFormat_DATA_MATRIX, 0, 0, hints)
+		if err != nil {
+			return nil, err
+		}
+		return symbolImage(m.GetWidth(), m.GetHeight(), m.Get, size), nil
+	case SymbolAztec:
+		// gozxing 只提供 Aztec 码的识别器，编码使用 boombuler/barcode
+		code, err := aztec.Encode(content, AztecECCLevels[level], 0)
+		if err != nil {
+			return nil, err
+		}
+		b := code.Bounds()
+		return symbolImage(b.Dx(), b.Dy(), func(x, y int) bool {
+			r, _, _, _ := code.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			return r < 0x8000
+		}, size), nil
+	}
+	q, err := qrencode.New(string(content), qrencode.RecoveryLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	return q.Image(size), nil
+}
+
+// symbolImage 将 width x height 个模块放大绘制，四周留白
+func symbolImage(width int, height int, get func(x, y int) bool, size int) *image.Gray {
+	module := -size
+	if size > 0 {
+		module = size / (width + 2*symbolQuietZone)
+	}
+	if module < 1 {
+		module = 1
+	}
+	return renderModules(width, height, get, module, symbolQuietZone)
+}
+
+// renderModules 以每个模块 module 像素绘制符号，四周留白 quiet 个模块
+func renderModules(width int, height int, get func(x, y int) bool, module int, quiet int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, (width+2*quiet)*module, (height+2*quiet)*module))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !get(x, y) {
+				continue
+			}
+			for py := (y + quiet) * module; py < (y+quiet+1)*module; py++ {
+				row := img.Pix[py*img.Stride:]
+				for px := (x + quiet) * module; px < (x+quiet+1)*module; px++ {
+					row[px] = 0
+				}
+			}
+		}
+	}
+	return img
+}
+
+// SymbolDecode 使用 gozxing 识别 Data Matrix 或 Aztec 码，识别失败或未通过校验时返回 nil，错误信息输出到 log
+func SymbolDecode(img image.Image, i int, symbol string, validate FrameValidator, payload string, log io.Writer) []byte {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		fmt.Fprintln(log, de, "第", i, "帧识别", symbol, "出现错误:", err)
+		return nil
+	}
+	var reader gozxing.Reader = datamatrix.NewDataMatrixReader()
+	if symbol == SymbolAztec {
+		reader = zxaztec.NewAztecReader()
+	}
+	result, err := reader.Decode(bmp, payloadDecodeHints(payload))
+	if err != nil {
+		fmt.Fprintln(log, de, "第", i, "帧识别", symbol, "出现错误:", err)
+		return nil
+	}
+	data, err := DecodePayloadText(result.GetText(), payload)
+	if err != nil {
+		fmt.Fprintln(log, de, "第", i, "帧识别", symbol, "出现错误: 数据帧解码失败:", err)
+		return nil
+	}
+	if validate != nil {
+		if err := validate(data); err != nil {
+			fmt.Fprintln(log, de, "第", i, "帧识别", symbol, "出现错误: 帧校验失败:", err)
+			return nil
+		}
+	}
+	return data
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSymbolMaxSlice(t *testing.T) {
+	tests := []struct {
+		symbol  string
+		payload string
+		levels  []int
+	}{
+		{SymbolQR, PayloadBase64, []int{0, 1, 2, 3}},
+		{SymbolQR, PayloadBase45, []int{0, 1, 2, 3}},
+		{SymbolQR, PayloadBinary, []int{0, 1, 2, 3}},
+		{SymbolAztec, PayloadBase64, []int{0, 1, 2, 3}},
+		{SymbolAztec, PayloadBinary, []int{0, 1, 2, 3}},
+		{SymbolDataMatrix, PayloadBase64, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.symbol+"-"+tt.payload, func(t *testing.T) {
+			for _, level := range tt.levels {
+				if err := CheckSymbolLevel(tt.symbol, level); err != nil {
+					t.Fatal(err)
+				}
+				slice := SymbolMaxSlice(tt.symbol, tt.payload, level)
+				if slice <= 0 {
+					t.Fatalf("纠错等级 %d 的最大容量为 %d", level, slice)
+				}
+				// 最大容量下最坏情况的内容也必须能够编码
+				if _, err := SymbolWorstCase(slice, tt.symbol, tt.payload, level, -1); err != nil {
+					t.Errorf("纠错等级 %d 下 %d 字节的数据帧无法编码: %v", level, slice, err)
+				}
+			}
+		})
+	}
+	for _, level := range []int{-1, 4, 7} {
+		for _, symbol := range []string{SymbolQR, SymbolDataMatrix, SymbolAztec} {
+			if CheckSymbolLevel(symbol, level) == nil || SymbolMaxSlice(symbol, PayloadBase64, level) != 0 {
+				t.Errorf("%s 接受了纠错等级 %d", symbol, level)
+			}
+		}
+	}
+	if CheckSymbolLevel(SymbolDataMatrix, 1) == nil || SymbolMaxSlice(SymbolDataMatrix, PayloadBase64, 1) != 0 {
+		t.Error("Data Matrix 接受了纠错等级 1")
+	}
+}
+
+func TestSymbolRoundTrip(t *testing.T) {
+	tests := []struct {
+		symbol  string
+		payload string
+		level   int
+	}{
+		{SymbolAztec, PayloadBinary, 0},
+		{SymbolAztec, PayloadBinary, 3},
+		{SymbolAztec, PayloadBase64, 2},
+		{SymbolDataMatrix, PayloadBase64, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.symbol+"-"+tt.payload, func(t *testing.T) {
+			frame := MarshalFrame(FrameHeader{Kind: FrameKindData, FileID: [4]byte{1, 4, 1, 4}, Seq: 2}, testData(200))
+			img, err := SymbolEncode(frame, tt.symbol, tt.payload, tt.level, -3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var log bytes.Buffer
+			got := SymbolDecode(img, 0, tt.symbol, NewFrameValidator(FrameVersion), tt.payload, &log)
+			if !bytes.Equal(got, frame) {
+				t.Fatalf("识别结果 %x: %s", got, log.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+)
+
+// DecoderZbarCmd 调用外部的 zbarimg 命令识别二维码
+const DecoderZbarCmd = "zbar-cmd"
+
+func init() {
+	RegisterFrameDecoder(DecoderZbarCmd, func(DecoderOptions) FrameDecoder { return zbarCmdDecoder{} })
+}
+
+type zbarCmdDecoder struct{}
+
+func (zbarCmdDecoder) Name() string {
+	return DecoderZbarCmd
+}
+
+// Decode 二进制载荷时使用 -Sbinary 让 zbarimg 输出原始字节(需要 zbar 0.23 及以上版本)
+func (zbarCmdDecoder) Decode(img image.Image, validate FrameValidator, payload string) ([]byte, error) {
+	if _, err := exec.LookPath("zbarimg"); err != nil {
+		return nil, errors.New("zbarimg 命令不存在，跳过检测")
+	}
+	imagePath, err := SaveTempImage(img)
+	if err != nil {
+		return nil, fmt.Errorf("无法生成二维码图片: %v", err)
+	}
+	defer os.Remove(imagePath)
+	args := []string{"--quiet", "--raw", "-Sdisable", "-Sqrcode.enable"}
+	if payload == PayloadBinary {
+		args = append(args, "-Sbinary")
+	}
+	cmd := exec.Command("zbarimg", append(args, imagePath)...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("zbarimg 没有识别到二维码: %v", err)
+	}
+	output := stdout.Bytes()
+	if payload == PayloadBinary {
+		// zbarimg 在每个结果后输出换行，原始字节本身也可能以换行结尾，两种情况都尝试
+		return DecodeCandidates("zbarimg", [][]byte{bytes.TrimSuffix(output, []byte("\n")), output}, validate, payload)
+	}
+	// 只取第一个识别结果
+	line, _, _ := bytes.Cut(output, []byte("\n"))
+	return DecodeCandidates("zbarimg", [][]byte{line}, validate, payload)
+}